@@ -32,6 +32,8 @@ var (
 
 const (
 	labelKey = "ws.operator/enabled"
+	// sidecarPortName is the port name the routers discover the sidecar port from.
+	sidecarPortName = "ws"
 )
 
 func init() {
@@ -182,6 +184,7 @@ func (si *SidecarInjector) mutate(ar *admissionv1.AdmissionReview) *admissionv1.
 			Selector:  deployment.Spec.Selector.MatchLabels,
 			Ports: []corev1.ServicePort{
 				{
+					Name:       sidecarPortName,
 					Port:       3000,
 					TargetPort: intstr.FromInt(3000),
 					Protocol:   corev1.ProtocolTCP,
@@ -230,7 +233,7 @@ func (si *SidecarInjector) mutate(ar *admissionv1.AdmissionReview) *admissionv1.
 	}
 
 	log.Printf("Injecting sidecar to deployment %s/%s", deployment.Namespace, deployment.Name)
-	patch, err := createPatch(&deployment)
+	patch, err := createPatch(&deployment, headlessServiceName)
 	if err != nil {
 		log.Printf("Failed to create patch: %v", err)
 		return &admissionv1.AdmissionResponse{
@@ -254,7 +257,7 @@ func (si *SidecarInjector) mutate(ar *admissionv1.AdmissionReview) *admissionv1.
 }
 
 // createPatch creates a JSON patch to add the sidecar container
-func createPatch(deployment *appsv1.Deployment) ([]byte, error) {
+func createPatch(deployment *appsv1.Deployment, serviceName string) ([]byte, error) {
 	var patches []map[string]interface{}
 
 	// Add sidecar container
@@ -263,9 +266,15 @@ func createPatch(deployment *appsv1.Deployment) ([]byte, error) {
 		Image: "docker.io/lukas8219/websocket-operator-sidecar:latest", // Adjust image as needed
 		Ports: []corev1.ContainerPort{
 			{
+				Name:          sidecarPortName,
 				ContainerPort: 3000,
 				Protocol:      corev1.ProtocolTCP,
 			},
+			{
+				Name:          "gossip",
+				ContainerPort: 7946,
+				Protocol:      corev1.ProtocolUDP,
+			},
 		},
 		Resources: corev1.ResourceRequirements{
 			Limits: corev1.ResourceList{
@@ -277,6 +286,30 @@ func createPatch(deployment *appsv1.Deployment) ([]byte, error) {
 				corev1.ResourceMemory: resource.MustParse("25Mi"),
 			},
 		},
+		Env: []corev1.EnvVar{
+			{
+				Name: "NODE_NAME",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+				},
+			},
+			{
+				Name: "POD_IP",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"},
+				},
+			},
+			{
+				Name: "WS_OPERATOR_NAMESPACE",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+				},
+			},
+			{
+				Name:  "WS_OPERATOR_SERVICE",
+				Value: serviceName,
+			},
+		},
 		EnvFrom: []corev1.EnvFromSource{
 			{
 				ConfigMapRef: &corev1.ConfigMapEnvSource{
@@ -286,7 +319,8 @@ func createPatch(deployment *appsv1.Deployment) ([]byte, error) {
 				},
 			},
 		},
-		Command: []string{"./sidecar", "-debug"},
+		// Clients reach the injected sidecars through the load balancer, which forwards the user id it resolved.
+		Command: []string{"./sidecar", "-debug", "-trustForwardedIdentity"},
 	}
 
 	containerPatch := map[string]interface{}{
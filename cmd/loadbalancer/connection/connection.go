@@ -1,44 +1,170 @@
 package connection
 
 import (
+	"bufio"
+	"io"
+	"lukas8219/websocket-operator/internal/identity"
+	"lukas8219/websocket-operator/internal/route"
 	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gobwas/ws"
 )
 
+// maxRedirects bounds how many owner redirects are followed when dialing upstream.
+const maxRedirects = 3
+
 // Connection combines tracking and proxying capabilities
 type Connection struct {
 	*Tracker
 	Proxier
+	// dialMu serializes the initial dial with migrations, they share the redirect and the upstream.
+	dialMu    sync.Mutex
+	fallbacks []route.Target
+	redirect  route.Target
 }
 
-// NewConnection creates a fully configured connection
-func NewConnection(user, upstreamHost, downstreamHost string, downstreamConn net.Conn) *Connection {
-	tracker := NewTracker(user, upstreamHost, downstreamHost, downstreamConn)
-	dialer := ws.Dialer{
-		Header: ws.HandshakeHeaderHTTP{
-			"ws-user-id": []string{user},
-		},
+// upgradeHeader writes the upgrade headers, reading the epoch hash at dial time.
+type upgradeHeader struct {
+	user         string
+	connectionId string
+	epoch        func() uint64
+}
+
+func (h upgradeHeader) WriteTo(w io.Writer) (int64, error) {
+	// The resolved identity is forwarded in the trusted header, ws-user-id is kept for older sidecars.
+	header := ws.HandshakeHeaderHTTP{
+		identity.TrustedHeader:   []string{h.user},
+		"ws-user-id":             []string{h.user},
+		route.ConnectionIdHeader: []string{h.connectionId},
+	}
+	if h.epoch != nil {
+		header[route.EpochHeader] = []string{route.FormatEpoch(h.epoch())}
 	}
-	proxier := NewWSProxier(tracker, &dialer)
+	return header.WriteTo(w)
+}
 
-	return &Connection{
+// NewConnection creates a fully configured connection. epoch is the router's epoch hash, sent to the
+// upstream so it can redirect us when it routes with a different membership.
+func NewConnection(user string, upstream route.Target, downstreamHost string, downstreamConn net.Conn, epoch func() uint64) *Connection {
+	tracker := NewTracker(user, upstream, downstreamHost, downstreamConn)
+	connection := &Connection{
 		Tracker: tracker,
-		Proxier: proxier,
 	}
+	dialer := ws.Dialer{
+		Header:        upgradeHeader{user: user, connectionId: tracker.ID(), epoch: epoch},
+		OnStatusError: connection.recordRedirect,
+	}
+	connection.Proxier = NewWSProxier(tracker, &dialer)
+	return connection
 }
 
-// Handle manages the connection lifecycle
-func (c *Connection) Handle() {
-	proxiedConn, err := c.ProxyDownstreamToUpstream()
+// recordRedirect keeps the owner an upstream redirected the upgrade to.
+func (c *Connection) recordRedirect(status int, _ []byte, resp io.Reader) {
+	if status != http.StatusTemporaryRedirect && status != http.StatusPermanentRedirect {
+		return
+	}
+	response, err := http.ReadResponse(bufio.NewReader(resp), nil)
 	if err != nil {
+		c.Tracker.Error("Failed to read redirect response", "error", err)
+		return
+	}
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || location.Host == "" {
+		c.Tracker.Error("Invalid redirect location", "location", response.Header.Get("Location"))
 		return
 	}
+	c.redirect = route.TargetFromURL(location)
+}
+
+// SetFallbacks sets the lower-ranked upstream targets tried in order when dialing the current upstream fails.
+func (c *Connection) SetFallbacks(targets []route.Target) {
+	c.fallbacks = targets
+}
+
+// Handle dials the upstream, following owner redirects and falling back to the lower-ranked targets,
+// and proxies the connection. When no upstream can be dialed the client is closed and the error of the
+// last dial returned.
+func (c *Connection) Handle() error {
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+	if c.Tracker.UpstreamConn() != nil {
+		// A migration won the race with the initial dial and already connected the client.
+		return nil
+	}
+	proxiedConn, err := c.ProxyDownstreamToUpstream()
+	for redirects := 0; err != nil && !c.redirect.IsZero() && redirects < maxRedirects; redirects++ {
+		redirect := c.redirect
+		c.redirect = route.Target{}
+		c.Tracker.Info("Upstream redirected to owner", "redirect", redirect)
+		c.Tracker.SetUpstream(redirect)
+		proxiedConn, err = c.ProxyDownstreamToUpstream()
+	}
+	for err != nil && len(c.fallbacks) > 0 {
+		fallback := c.fallbacks[0]
+		c.fallbacks = c.fallbacks[1:]
+		c.Tracker.Info("Falling back to next ranked upstream", "fallback", fallback)
+		c.Tracker.SetUpstream(fallback)
+		proxiedConn, err = c.ProxyDownstreamToUpstream()
+	}
+	if err != nil {
+		c.CloseWithStatus(ws.StatusInternalServerError, "no upstream available")
+		return err
+	}
+	// Fallbacks are only valid for the initial placement. Rebalancing decides the host afterwards.
+	c.fallbacks = nil
 	c.Tracker.SetUpstreamConn(proxiedConn)
 
 	c.ProxyUpstreamToDownstream()
+	return nil
+}
+
+// Migrate moves the connection to upstream without losing client frames, following the owner
+// redirects of the new upstream. On failure the connection stays on its current upstream.
+func (c *Connection) Migrate(upstream route.Target) error {
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+	err := c.Proxier.Migrate(upstream)
+	for redirects := 0; err != nil && !c.redirect.IsZero() && redirects < maxRedirects; redirects++ {
+		redirect := c.redirect
+		c.redirect = route.Target{}
+		c.Tracker.Info("Upstream redirected to owner", "redirect", redirect)
+		err = c.Proxier.Migrate(redirect)
+	}
+	if err != nil {
+		return err
+	}
+	// A connection whose initial dial failed only starts proxying client frames now.
+	c.ProxyUpstreamToDownstream()
+	return nil
 }
 
+// Close closes both sides of the connection and marks it done.
 func (c *Connection) Close() {
 	c.Proxier.Close()
+	c.Tracker.downstreamClosed()
+}
+
+// CloseWithStatus tells the client why the connection is closed, then closes it like Close.
+func (c *Connection) CloseWithStatus(code ws.StatusCode, reason string) {
+	c.Proxier.CloseWithStatus(code, reason)
+	c.Tracker.downstreamClosed()
+}
+
+// ExpireAt closes the connection with a policy violation once the credentials it was authenticated
+// with expire. For a JWT that is jwt.Session.Expires, which already tolerates the clock skew.
+func (c *Connection) ExpireAt(expires time.Time) {
+	timer := time.NewTimer(time.Until(expires))
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			c.Tracker.Info("Credentials expired, closing connection", "expires", expires)
+			c.CloseWithStatus(ws.StatusPolicyViolation, "token expired")
+		case <-c.Done():
+		}
+	}()
 }
@@ -0,0 +1,48 @@
+package connection
+
+import (
+	"lukas8219/websocket-operator/internal/route"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestExpireAtClosesWithPolicyViolation(t *testing.T) {
+	dialer := newPipeDialer()
+	proxyEnd, client := net.Pipe()
+	tracker := NewTracker("user", route.TargetFromAddress("old:3000"), "client", proxyEnd)
+	c := &Connection{Tracker: tracker, Proxier: NewWSProxier(tracker, dialer)}
+	t.Cleanup(func() {
+		c.Close()
+		client.Close()
+	})
+	c.Handle()
+	c.ExpireAt(time.Now().Add(50 * time.Millisecond))
+
+	// The frame is read raw, answering it would race with the connection being closed.
+	frame, err := ws.ReadFrame(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Header.OpCode != ws.OpClose {
+		t.Fatalf("expected a close frame, got %v", frame.Header.OpCode)
+	}
+	if code, reason := ws.ParseCloseFrameData(frame.Payload); code != ws.StatusPolicyViolation {
+		t.Fatalf("expected a policy violation, got %d %q", code, reason)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the expired connection to be done")
+	}
+	waitFor(t, "the upstream to be closed", func() bool {
+		select {
+		case <-dialer.sidecar("ws://old:3000").closed:
+			return true
+		default:
+			return false
+		}
+	})
+}
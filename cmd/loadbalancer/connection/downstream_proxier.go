@@ -2,70 +2,109 @@ package connection
 
 import (
 	"context"
+	"errors"
+	"lukas8219/websocket-operator/internal/route"
 	"net"
+	"sync/atomic"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 )
 
-func (p *WSProxier) ProxyDownstreamToUpstream() (net.Conn, error) {
-	host := p.tracker.UpstreamHost()
+// upstream is a dialed sidecar and the proxying of its frames to the client.
+type upstream struct {
+	target route.Target
+	conn   net.Conn
+	// retiring is set once a migration replaced the upstream. Its frames are still sent to the client
+	// until it acknowledges our close frame, which then isn't treated as an error.
+	retiring atomic.Bool
+	// lost is set once its frames stopped being proxied for another reason than retiring.
+	lost atomic.Bool
+	// done is closed once its frames stopped being proxied and conn is closed.
+	done chan struct{}
+}
 
-	p.tracker.Debug("Dialing upstream")
-	upstreamContext := p.tracker.UpstreamContext()
-	upstreamCancelChan := p.tracker.UpstreamCancelChan()
-	downstreamConn := p.tracker.DownstreamConn()
+// ProxyDownstreamToUpstream dials the current upstream of the tracker and proxies its frames to the client.
+func (p *WSProxier) ProxyDownstreamToUpstream() (net.Conn, error) {
+	dialed, err := p.dial(p.tracker.Upstream())
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.current = dialed
+	p.mu.Unlock()
+	if dialed.lost.Load() {
+		// It went away before becoming current, so upstreamLost left the client alone.
+		return nil, errors.New("upstream closed right after dialing")
+	}
+	return dialed.conn, nil
+}
 
-	proxiedConn, _, _, err := p.dialer.Dial(context.Background(), "ws://"+host)
+func (p *WSProxier) dial(target route.Target) (*upstream, error) {
+	p.tracker.Debug("Dialing upstream", "target", target)
+	conn, _, _, err := p.dialer.Dial(context.Background(), target.WebSocketURL(""))
 	if err != nil {
-		p.tracker.Error("Failed to dial upstream", "error", err)
+		p.tracker.Error("Failed to dial upstream", "target", target, "error", err)
 		return nil, err
 	}
-	p.tracker.Debug("Connected to upstream")
+	p.tracker.Debug("Connected to upstream", "target", target)
+	dialed := &upstream{target: target, conn: conn, done: make(chan struct{})}
+	go p.proxyServerToClient(dialed)
+	return dialed, nil
+}
 
-	waitSignal := func() {
-		p.tracker.Debug("Closing upstream connection")
-		select {
-		case upstreamCancelChan <- 1:
-			p.tracker.Debug("Successfully signaled cancellation")
-		default:
-			p.tracker.Debug("No one waiting for cancellation signal, skipping")
+// proxyServerToClient proxies the frames of an upstream to the client until either side goes away.
+func (p *WSProxier) proxyServerToClient(u *upstream) {
+	defer close(u.done)
+	defer func() {
+		if err := u.conn.Close(); err != nil {
+			p.tracker.Error("Failed to close upstream connection", "target", u.target, "error", err)
 		}
-		err := proxiedConn.Close()
+	}()
+	downstream := p.downstream()
+	for {
+		//Read as client - from the server.
+		msg, op, err := wsutil.ReadServerData(u.conn)
 		if err != nil {
-			p.tracker.Error("Failed to close upstream connection", "error", err)
-		}
-	}
-
-	//TODO missing defer
-	proxySidecarServerToClient := func() {
-		defer waitSignal()
-		for {
-			select {
-			case <-upstreamContext.Done():
-				p.tracker.Debug("upstream to downstream context done")
-				proxiedConn.Close()
+			if u.retiring.Load() {
+				p.tracker.Debug("Replaced upstream closed", "target", u.target, "error", err)
 				return
-			default:
-				//Read as client - from the server.
-				msg, op, err := wsutil.ReadServerData(proxiedConn)
-				if err != nil {
-					p.tracker.Error("Failed to read from upstream", "error", err)
-					return
-				}
-				//Write as client - to the proxied connection
-				err = wsutil.WriteServerMessage(downstreamConn, op, msg)
-				if err != nil {
-					p.tracker.Error("Failed to write to downstream", "error", err)
-					return
-				}
-				if op == ws.OpClose {
-					p.tracker.Debug("upstream server closed connection")
-					return
-				}
 			}
+			var closed wsutil.ClosedError
+			if errors.As(err, &closed) {
+				p.tracker.Debug("upstream server closed connection", "target", u.target, "code", closed.Code)
+				p.upstreamLost(u, closed.Code, closed.Reason)
+				return
+			}
+			p.tracker.Error("Failed to read from upstream", "target", u.target, "error", err)
+			p.upstreamLost(u, ws.StatusGoingAway, "upstream unavailable")
+			return
+		}
+		//Write as server - to the client
+		err = wsutil.WriteServerMessage(downstream, op, msg)
+		if err != nil {
+			p.tracker.Error("Failed to write to downstream", "error", err)
+			p.Close()
+			p.tracker.downstreamClosed()
+			return
 		}
 	}
-	go proxySidecarServerToClient()
-	return proxiedConn, nil
+}
+
+// upstreamLost closes the client with code once u went away while it was the current upstream. Codes
+// that can't be sent in a close frame become a normal closure. An upstream lost while migrating is left
+// to Migrate, which closes the client when it can't move it elsewhere.
+func (p *WSProxier) upstreamLost(u *upstream, code ws.StatusCode, reason string) {
+	u.lost.Store(true)
+	p.mu.Lock()
+	current := p.current == u && p.state == MigrationProxying
+	p.mu.Unlock()
+	if !current {
+		return
+	}
+	if code.Empty() || code.IsProtocolReserved() || code.IsNotUsed() {
+		code = ws.StatusNormalClosure
+	}
+	p.CloseWithStatus(code, reason)
+	p.tracker.downstreamClosed()
 }
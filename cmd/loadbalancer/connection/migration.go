@@ -0,0 +1,191 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"lukas8219/websocket-operator/internal/metrics"
+	"lukas8219/websocket-operator/internal/route"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// DefaultMigrationBufferBytes bounds the client frames buffered while a connection migrates. Once it
+// is reached client reads pause until the new upstream is connected.
+const DefaultMigrationBufferBytes = 1 << 20
+
+// retireTimeout bounds how long a replaced upstream is given to acknowledge our close frame.
+const retireTimeout = 5 * time.Second
+
+var (
+	ErrMigrating = errors.New("connection is already migrating")
+	ErrClosed    = errors.New("connection is closed")
+)
+
+var (
+	migrationsSucceeded = metrics.NewCounter("ws_operator_migrations_total", "Connections moved to another upstream", "result", "succeeded")
+	migrationsFailed    = metrics.NewCounter("ws_operator_migrations_total", "Connections moved to another upstream", "result", "failed")
+)
+
+// MigrationState is the state of a connection moving to another upstream:
+//
+//	Proxying -> Buffering -> Proxying, to the new upstream or to the current one when dialing failed
+//	any state -> Closed
+type MigrationState int32
+
+const (
+	// MigrationProxying writes client frames to the current upstream.
+	MigrationProxying MigrationState = iota
+	// MigrationBuffering buffers client frames while the new upstream is dialed.
+	MigrationBuffering
+	// MigrationClosed rejects client frames, the connection is gone.
+	MigrationClosed
+)
+
+func (s MigrationState) String() string {
+	switch s {
+	case MigrationProxying:
+		return "proxying"
+	case MigrationBuffering:
+		return "buffering"
+	case MigrationClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("MigrationState(%d)", int32(s))
+}
+
+// frame is a client message read whole from the downstream connection.
+type frame struct {
+	op      ws.OpCode
+	payload []byte
+}
+
+// State returns where the connection is in migrating.
+func (p *WSProxier) State() MigrationState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// forward writes a client frame to the current upstream, or buffers it while migrating. It blocks,
+// pausing client reads, while the buffer is full.
+func (p *WSProxier) forward(f frame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A frame larger than the limit is still buffered alone, or the migration could never make progress.
+	for p.state == MigrationBuffering && len(p.buffer) > 0 && p.bufferedBytes+len(f.payload) > p.bufferLimit {
+		p.resumed.Wait()
+	}
+	switch p.state {
+	case MigrationBuffering:
+		p.buffer = append(p.buffer, f)
+		p.bufferedBytes += len(f.payload)
+		return nil
+	case MigrationClosed:
+		return ErrClosed
+	}
+	return p.write(p.current, f)
+}
+
+// write sends a client frame to u. The caller must hold the lock.
+func (p *WSProxier) write(u *upstream, f frame) error {
+	if u == nil {
+		return errors.New("no upstream connected")
+	}
+	//Write as client - to the proxied connection
+	return wsutil.WriteClientMessage(u.conn, f.op, f.payload)
+}
+
+// flush writes the buffered client frames to u, in the order they were read. The caller must hold the lock.
+func (p *WSProxier) flush(u *upstream) error {
+	buffer := p.buffer
+	p.buffer, p.bufferedBytes = nil, 0
+	for i, f := range buffer {
+		if err := p.write(u, f); err != nil {
+			return fmt.Errorf("flushed %d of %d buffered frames: %w", i, len(buffer), err)
+		}
+	}
+	return nil
+}
+
+// resume goes back to proxying client frames. The caller must hold the lock.
+func (p *WSProxier) resume() {
+	p.state = MigrationProxying
+	p.resumed.Broadcast()
+}
+
+// Migrate moves the connection to target without dropping or reordering client frames. Client frames
+// are buffered from the next frame boundary, target is dialed, the buffer is flushed to it and only
+// then is the replaced upstream closed. When dialing fails the buffer is flushed to the current
+// upstream, which keeps the connection.
+func (p *WSProxier) Migrate(target route.Target) error {
+	p.mu.Lock()
+	switch p.state {
+	case MigrationBuffering:
+		p.mu.Unlock()
+		return ErrMigrating
+	case MigrationClosed:
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.state = MigrationBuffering
+	previous := p.current
+	p.mu.Unlock()
+
+	next, err := p.dial(target)
+
+	p.mu.Lock()
+	if p.state == MigrationClosed {
+		p.mu.Unlock()
+		if next != nil {
+			next.conn.Close()
+		}
+		return ErrClosed
+	}
+	if err != nil {
+		err = errors.Join(err, p.flush(previous))
+		p.resume()
+		p.mu.Unlock()
+		migrationsFailed.Inc()
+		if previous != nil && previous.lost.Load() {
+			// The current upstream went away while migrating, there is nowhere left to proxy to.
+			p.CloseWithStatus(ws.StatusGoingAway, "upstream unavailable")
+			p.tracker.downstreamClosed()
+		}
+		return err
+	}
+	err = p.flush(next)
+	p.current = next
+	p.tracker.SetUpstream(target)
+	p.tracker.SetUpstreamConn(next.conn)
+	p.resume()
+	p.mu.Unlock()
+
+	if previous != nil {
+		go p.retire(previous)
+	}
+	if err != nil {
+		migrationsFailed.Inc()
+		return err
+	}
+	migrationsSucceeded.Inc()
+	return nil
+}
+
+// retire closes an upstream replaced by a migration. It is closed once it acknowledged our close frame,
+// so the frames it sent in the meantime still reach the client.
+func (p *WSProxier) retire(u *upstream) {
+	u.retiring.Store(true)
+	body := ws.NewCloseFrameBody(ws.StatusNormalClosure, "migrated")
+	if err := wsutil.WriteClientMessage(u.conn, ws.OpClose, body); err != nil {
+		p.tracker.Debug("Failed to send close frame to replaced upstream", "target", u.target, "error", err)
+		u.conn.Close()
+	}
+	select {
+	case <-u.done:
+	case <-time.After(retireTimeout):
+		p.tracker.Error("Timeout waiting for replaced upstream to close", "target", u.target)
+		u.conn.Close()
+	}
+}
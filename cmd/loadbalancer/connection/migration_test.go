@@ -0,0 +1,314 @@
+package connection
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"lukas8219/websocket-operator/internal/route"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// sidecar is a fake upstream recording the client frames it receives.
+type sidecar struct {
+	mu     sync.Mutex
+	frames []string
+	closed chan struct{}
+	conn   net.Conn
+}
+
+// kill drops the connection without a close frame, like a crashed sidecar.
+func (s *sidecar) kill() {
+	s.conn.Close()
+}
+
+func (s *sidecar) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.frames)
+}
+
+// pipeDialer dials fake sidecars over net.Pipe. Dialing a URL of blocked waits for its channel to be
+// closed, dialing a URL of failing fails.
+type pipeDialer struct {
+	mu       sync.Mutex
+	sidecars map[string]*sidecar
+	blocked  map[string]chan struct{}
+	failing  map[string]bool
+}
+
+func newPipeDialer() *pipeDialer {
+	return &pipeDialer{
+		sidecars: make(map[string]*sidecar),
+		blocked:  make(map[string]chan struct{}),
+		failing:  make(map[string]bool),
+	}
+}
+
+func (d *pipeDialer) Dial(ctx context.Context, urlstr string) (net.Conn, *bufio.Reader, ws.Handshake, error) {
+	d.mu.Lock()
+	blocked, failing := d.blocked[urlstr], d.failing[urlstr]
+	d.mu.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+	if failing {
+		return nil, nil, ws.Handshake{}, errors.New("connection refused")
+	}
+	client, server := net.Pipe()
+	s := &sidecar{closed: make(chan struct{}), conn: server}
+	go func() {
+		defer close(s.closed)
+		defer server.Close()
+		for {
+			// A close frame is acknowledged by the control handler and ends the read with an error.
+			msg, _, err := wsutil.ReadClientData(server)
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.frames = append(s.frames, string(msg))
+			s.mu.Unlock()
+		}
+	}()
+	d.mu.Lock()
+	d.sidecars[urlstr] = s
+	d.mu.Unlock()
+	return client, nil, ws.Handshake{}, nil
+}
+
+func (d *pipeDialer) sidecar(urlstr string) *sidecar {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sidecars[urlstr]
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// newTestConnection connects a client to the fake sidecar old:3000. It returns the client end.
+func newTestConnection(t *testing.T, dialer *pipeDialer) (*Connection, *WSProxier, net.Conn) {
+	t.Helper()
+	proxyEnd, clientEnd := net.Pipe()
+	tracker := NewTracker("user", route.TargetFromAddress("old:3000"), "client", proxyEnd)
+	proxier := NewWSProxier(tracker, dialer)
+	c := &Connection{Tracker: tracker, Proxier: proxier}
+	// The sidecars send nothing, but the client end must be read for the proxy to never block on it.
+	go io.Copy(io.Discard, clientEnd)
+	t.Cleanup(func() {
+		c.Close()
+		clientEnd.Close()
+	})
+	c.Handle()
+	if dialer.sidecar("ws://old:3000") == nil {
+		t.Fatal("expected the initial upstream to be dialed")
+	}
+	return c, proxier, clientEnd
+}
+
+// send writes frames numbered from..to-1 as the client.
+func send(t *testing.T, client net.Conn, from, to int) {
+	for i := from; i < to; i++ {
+		if err := wsutil.WriteClientMessage(client, ws.OpText, []byte(fmt.Sprintf("frame-%d", i))); err != nil {
+			t.Errorf("failed to send frame %d: %v", i, err)
+			return
+		}
+	}
+}
+
+func frames(from, to int) []string {
+	expected := make([]string, 0, to-from)
+	for i := from; i < to; i++ {
+		expected = append(expected, fmt.Sprintf("frame-%d", i))
+	}
+	return expected
+}
+
+func TestMigrateKeepsEveryClientFrameInOrder(t *testing.T) {
+	dialer := newPipeDialer()
+	c, _, client := newTestConnection(t, dialer)
+	old := dialer.sidecar("ws://old:3000")
+
+	const total = 2000
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		send(t, client, 0, total)
+	}()
+	waitFor(t, "frames on the old upstream", func() bool { return len(old.received()) >= 100 })
+	if err := c.Migrate(route.TargetFromAddress("new:3000")); err != nil {
+		t.Fatal(err)
+	}
+	<-sent
+	next := dialer.sidecar("ws://new:3000")
+	waitFor(t, "every frame to be proxied", func() bool { return len(old.received())+len(next.received()) == total })
+
+	if got := append(old.received(), next.received()...); !slices.Equal(got, frames(0, total)) {
+		t.Fatalf("frames were dropped or reordered across the migration")
+	}
+	if len(next.received()) == 0 {
+		t.Fatal("expected frames after the migration to reach the new upstream")
+	}
+	select {
+	case <-old.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the replaced upstream to be closed")
+	}
+	if host := c.UpstreamHost(); host != "new:3000" {
+		t.Fatalf("expected the tracker to follow the migration, got %s", host)
+	}
+}
+
+func TestMigratePausesClientReadsWhenTheBufferIsFull(t *testing.T) {
+	dialer := newPipeDialer()
+	c, proxier, client := newTestConnection(t, dialer)
+	old := dialer.sidecar("ws://old:3000")
+	frameSize := len("frame-00")
+	proxier.bufferLimit = 10 * frameSize
+	release := make(chan struct{})
+	dialer.blocked["ws://new:3000"] = release
+
+	send(t, client, 0, 10)
+	waitFor(t, "frames on the old upstream", func() bool { return len(old.received()) == 10 })
+	migrated := make(chan error, 1)
+	go func() {
+		migrated <- c.Migrate(route.TargetFromAddress("new:3000"))
+	}()
+	waitFor(t, "the migration to start buffering", func() bool { return proxier.State() == MigrationBuffering })
+	if err := proxier.Migrate(route.TargetFromAddress("other:3000")); !errors.Is(err, ErrMigrating) {
+		t.Fatalf("expected a concurrent migration to be rejected, got %v", err)
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		send(t, client, 10, 60)
+	}()
+	buffered := func() (int, int) {
+		proxier.mu.Lock()
+		defer proxier.mu.Unlock()
+		return len(proxier.buffer), proxier.bufferedBytes
+	}
+	waitFor(t, "the buffer to fill up", func() bool {
+		frames, _ := buffered()
+		return frames == 10
+	})
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-sent:
+		t.Fatal("expected client reads to pause while the buffer is full")
+	default:
+	}
+	if _, bytes := buffered(); bytes > proxier.bufferLimit {
+		t.Fatalf("buffered %d bytes over the limit of %d", bytes, proxier.bufferLimit)
+	}
+
+	close(release)
+	if err := <-migrated; err != nil {
+		t.Fatal(err)
+	}
+	<-sent
+	next := dialer.sidecar("ws://new:3000")
+	waitFor(t, "every frame to reach the new upstream", func() bool { return len(next.received()) == 50 })
+	if got := append(old.received(), next.received()...); !slices.Equal(got, frames(0, 60)) {
+		t.Fatalf("frames were dropped or reordered across the migration")
+	}
+}
+
+func TestFailedMigrationFlushesToTheCurrentUpstream(t *testing.T) {
+	dialer := newPipeDialer()
+	c, proxier, client := newTestConnection(t, dialer)
+	old := dialer.sidecar("ws://old:3000")
+	release := make(chan struct{})
+	dialer.blocked["ws://new:3000"] = release
+	dialer.failing["ws://new:3000"] = true
+
+	send(t, client, 0, 10)
+	migrated := make(chan error, 1)
+	go func() {
+		migrated <- c.Migrate(route.TargetFromAddress("new:3000"))
+	}()
+	waitFor(t, "the migration to start buffering", func() bool { return proxier.State() == MigrationBuffering })
+	send(t, client, 10, 20)
+	close(release)
+	if err := <-migrated; err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	send(t, client, 20, 30)
+
+	waitFor(t, "every frame to reach the old upstream", func() bool { return len(old.received()) == 30 })
+	if got := old.received(); !slices.Equal(got, frames(0, 30)) {
+		t.Fatalf("frames were dropped or reordered, got %v", got)
+	}
+	if state := proxier.State(); state != MigrationProxying {
+		t.Fatalf("expected the connection to keep proxying, got %s", state)
+	}
+	if host := c.UpstreamHost(); host != "old:3000" {
+		t.Fatalf("expected the connection to stay on its upstream, got %s", host)
+	}
+}
+
+func TestLostUpstreamClosesTheClient(t *testing.T) {
+	cases := []struct {
+		name string
+		lose func(s *sidecar)
+		code ws.StatusCode
+	}{
+		{"Crashed", (*sidecar).kill, ws.StatusGoingAway},
+		{"Closed", func(s *sidecar) {
+			wsutil.WriteServerMessage(s.conn, ws.OpClose, ws.NewCloseFrameBody(ws.StatusCode(4000), "draining"))
+		}, ws.StatusCode(4000)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialer := newPipeDialer()
+			proxyEnd, client := net.Pipe()
+			tracker := NewTracker("user", route.TargetFromAddress("old:3000"), "client", proxyEnd)
+			c := &Connection{Tracker: tracker, Proxier: NewWSProxier(tracker, dialer)}
+			t.Cleanup(func() {
+				c.Close()
+				client.Close()
+			})
+			registry := NewConnectionRegistry()
+			registry.Add(c)
+			if err := c.Handle(); err != nil {
+				t.Fatal(err)
+			}
+			send(t, client, 0, 10)
+			old := dialer.sidecar("ws://old:3000")
+			waitFor(t, "frames on the upstream", func() bool { return len(old.received()) == 10 })
+
+			tc.lose(old)
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			frame, err := ws.ReadFrame(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code, reason := ws.ParseCloseFrameData(frame.Payload); frame.Header.OpCode != ws.OpClose || code != tc.code {
+				t.Fatalf("expected the client to be closed with %d, got %v %d %q", tc.code, frame.Header.OpCode, code, reason)
+			}
+			select {
+			case <-c.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the connection to be done")
+			}
+			waitFor(t, "the connection to leave the registry", func() bool { return registry.Len() == 0 })
+		})
+	}
+}
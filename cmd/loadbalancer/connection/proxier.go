@@ -3,16 +3,24 @@ package connection
 import (
 	"bufio"
 	"context"
+	"io"
+	"lukas8219/websocket-operator/internal/route"
 	"net"
+	"sync"
 
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
 )
 
 // Proxier manages bidirectional proxying of connections
 type Proxier interface {
 	ProxyUpstreamToDownstream()
 	ProxyDownstreamToUpstream() (net.Conn, error)
+	// Migrate moves the connection to another upstream without losing client frames, see WSProxier.Migrate.
+	Migrate(upstream route.Target) error
 	Close()
+	// CloseWithStatus sends the client a close frame with code and reason before closing.
+	CloseWithStatus(code ws.StatusCode, reason string)
 }
 
 type WSDialer interface {
@@ -23,17 +31,61 @@ type WSDialer interface {
 type WSProxier struct {
 	tracker *Tracker
 	dialer  WSDialer
+
+	// mu guards the migration state and serializes client frames written upstream with migrations.
+	mu      sync.Mutex
+	resumed *sync.Cond
+	state   MigrationState
+	current *upstream
+	// buffer holds the client frames read while migrating, bufferedBytes their size.
+	buffer        []frame
+	bufferedBytes int
+	bufferLimit   int
+	pumpOnce      sync.Once
+
+	// downstreamMu serializes the frames written to the client by the upstreams, as the replaced
+	// and the new upstream overlap during a migration.
+	downstreamMu sync.Mutex
 }
 
 // NewWSProxier creates a new WebSocket proxier
 func NewWSProxier(tracker *Tracker, dialer WSDialer) *WSProxier {
-	return &WSProxier{
-		tracker: tracker,
-		dialer:  dialer,
+	p := &WSProxier{
+		tracker:     tracker,
+		dialer:      dialer,
+		bufferLimit: DefaultMigrationBufferBytes,
 	}
+	p.resumed = sync.NewCond(&p.mu)
+	return p
+}
+
+// downstream returns the client connection, with writes serialized with the ones of the upstreams.
+// Control frames answered while reading go through it too.
+func (p *WSProxier) downstream() io.ReadWriter {
+	conn := p.tracker.DownstreamConn()
+	return struct {
+		io.Reader
+		io.Writer
+	}{conn, lockedWriter{conn, &p.downstreamMu}}
+}
+
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (l lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
 }
 
 func (p *WSProxier) Close() {
+	p.mu.Lock()
+	p.state = MigrationClosed
+	p.resumed.Broadcast()
+	p.mu.Unlock()
+
 	upstreamConn := p.tracker.UpstreamConn()
 	downstreamConn := p.tracker.DownstreamConn()
 
@@ -44,3 +96,13 @@ func (p *WSProxier) Close() {
 		downstreamConn.Close()
 	}
 }
+
+func (p *WSProxier) CloseWithStatus(code ws.StatusCode, reason string) {
+	if p.tracker.DownstreamConn() != nil {
+		body := ws.NewCloseFrameBody(code, reason)
+		if err := wsutil.WriteServerMessage(p.downstream(), ws.OpClose, body); err != nil {
+			p.tracker.Debug("Failed to send close frame to client", "error", err)
+		}
+	}
+	p.Close()
+}
@@ -0,0 +1,148 @@
+package connection
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/zeebo/xxh3"
+)
+
+// registryShards is the number of independently locked shards of a ConnectionRegistry.
+const registryShards = 64
+
+// ConnectionRegistry holds the proxied connections of every user, a user having one per device. It is
+// safe for concurrent use: users are spread over shards with their own lock, so connects, disconnects
+// and rebalances of different users rarely contend. A connection is removed once it is done.
+type ConnectionRegistry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	mu sync.RWMutex
+	// users holds the connections of each user by connection id.
+	users map[string]map[string]*Connection
+}
+
+func NewConnectionRegistry() *ConnectionRegistry {
+	r := &ConnectionRegistry{}
+	for i := range r.shards {
+		r.shards[i].users = make(map[string]map[string]*Connection)
+	}
+	return r
+}
+
+func (r *ConnectionRegistry) shard(user string) *registryShard {
+	return &r.shards[xxh3.HashString(user)%registryShards]
+}
+
+// Add registers c next to the other connections of its user. It returns how many connections the user
+// has with c. c is removed once it is done.
+func (r *ConnectionRegistry) Add(c *Connection) int {
+	user := c.User()
+	shard := r.shard(user)
+	shard.mu.Lock()
+	connections := shard.users[user]
+	if connections == nil {
+		connections = make(map[string]*Connection)
+		shard.users[user] = connections
+	}
+	connections[c.ID()] = c
+	n := len(connections)
+	shard.mu.Unlock()
+	go func() {
+		<-c.Done()
+		r.Remove(c)
+	}()
+	return n
+}
+
+// Remove unregisters c. It returns false when c wasn't registered.
+func (r *ConnectionRegistry) Remove(c *Connection) bool {
+	user := c.User()
+	shard := r.shard(user)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	connections := shard.users[user]
+	if connections[c.ID()] != c {
+		return false
+	}
+	delete(connections, c.ID())
+	if len(connections) == 0 {
+		delete(shard.users, user)
+	}
+	return true
+}
+
+// Get returns the connections of user, one per device, oldest first.
+func (r *ConnectionRegistry) Get(user string) []*Connection {
+	shard := r.shard(user)
+	shard.mu.RLock()
+	connections := make([]*Connection, 0, len(shard.users[user]))
+	for _, c := range shard.users[user] {
+		connections = append(connections, c)
+	}
+	shard.mu.RUnlock()
+	slices.SortFunc(connections, func(a, b *Connection) int {
+		return a.Created().Compare(b.Created())
+	})
+	return connections
+}
+
+// Lookup returns the connection of user with the connection id, nil when there is none.
+func (r *ConnectionRegistry) Lookup(user, id string) *Connection {
+	shard := r.shard(user)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.users[user][id]
+}
+
+// Len returns the number of registered connections.
+func (r *ConnectionRegistry) Len() int {
+	n := 0
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		for _, connections := range shard.users {
+			n += len(connections)
+		}
+		shard.mu.RUnlock()
+	}
+	return n
+}
+
+// Snapshot returns the registered connections. Connections added or removed while it runs may or may
+// not be included, it never holds more than one shard lock.
+func (r *ConnectionRegistry) Snapshot() []*Connection {
+	connections := make([]*Connection, 0)
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		for _, user := range shard.users {
+			for _, c := range user {
+				connections = append(connections, c)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return connections
+}
+
+// ByUpstream returns the connections currently proxied to the upstream host:port address.
+func (r *ConnectionRegistry) ByUpstream(host string) []*Connection {
+	connections := make([]*Connection, 0)
+	for _, c := range r.Snapshot() {
+		if c.UpstreamHost() == host {
+			connections = append(connections, c)
+		}
+	}
+	return connections
+}
+
+// UpstreamLoads counts the connections proxied to each upstream host.
+func (r *ConnectionRegistry) UpstreamLoads() map[string]int {
+	loads := make(map[string]int)
+	for _, c := range r.Snapshot() {
+		loads[c.UpstreamHost()]++
+	}
+	return loads
+}
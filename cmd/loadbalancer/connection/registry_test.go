@@ -0,0 +1,73 @@
+package connection
+
+import (
+	"fmt"
+	"lukas8219/websocket-operator/internal/route"
+	"testing"
+)
+
+func newRegistryConnection(user, upstream string) *Connection {
+	return &Connection{Tracker: NewTracker(user, route.TargetFromAddress(upstream), "client", nil)}
+}
+
+func TestRegistryKeepsEveryDeviceOfAUser(t *testing.T) {
+	registry := NewConnectionRegistry()
+	phone := newRegistryConnection("user", "10.0.0.1:3000")
+	if n := registry.Add(phone); n != 1 {
+		t.Fatalf("expected a single device, got %d", n)
+	}
+	laptop := newRegistryConnection("user", "10.0.0.1:3000")
+	if n := registry.Add(laptop); n != 2 {
+		t.Fatalf("expected the second device to be added next to the first, got %d", n)
+	}
+	if devices := registry.Get("user"); len(devices) != 2 || devices[0] != phone || devices[1] != laptop {
+		t.Fatalf("expected both devices oldest first, got %v", devices)
+	}
+	if registry.Lookup("user", laptop.ID()) != laptop {
+		t.Fatal("expected the laptop to be found by its connection id")
+	}
+
+	// One device going away must not remove the other.
+	phone.downstreamClosed()
+	waitFor(t, "the done device to be removed", func() bool { return len(registry.Get("user")) == 1 })
+	if registry.Remove(phone) {
+		t.Fatal("expected the done device not to be registered anymore")
+	}
+	if devices := registry.Get("user"); devices[0] != laptop {
+		t.Fatal("expected the other device to stay registered")
+	}
+
+	laptop.downstreamClosed()
+	waitFor(t, "the last device to be removed", func() bool { return len(registry.Get("user")) == 0 })
+	if n := registry.Len(); n != 0 {
+		t.Fatalf("expected an empty registry, got %d connections", n)
+	}
+}
+
+func TestRegistryLookups(t *testing.T) {
+	registry := NewConnectionRegistry()
+	for i := 0; i < 100; i++ {
+		registry.Add(newRegistryConnection(fmt.Sprintf("user-%d", i), fmt.Sprintf("10.0.0.%d:3000", i%4)))
+	}
+	if n := registry.Len(); n != 100 {
+		t.Fatalf("expected 100 connections, got %d", n)
+	}
+	if n := len(registry.Snapshot()); n != 100 {
+		t.Fatalf("expected a snapshot of 100 connections, got %d", n)
+	}
+	onHost := registry.ByUpstream("10.0.0.1:3000")
+	if len(onHost) != 25 {
+		t.Fatalf("expected 25 connections on the host, got %d", len(onHost))
+	}
+	for _, c := range onHost {
+		if c.UpstreamHost() != "10.0.0.1:3000" {
+			t.Fatalf("%s is on %s", c.User(), c.UpstreamHost())
+		}
+	}
+	if loads := registry.UpstreamLoads(); len(loads) != 4 || loads["10.0.0.3:3000"] != 25 {
+		t.Fatalf("unexpected loads %v", loads)
+	}
+	if devices := registry.Get("user-42"); len(devices) != 1 || devices[0].User() != "user-42" {
+		t.Fatalf("expected the connection of user-42, got %v", devices)
+	}
+}
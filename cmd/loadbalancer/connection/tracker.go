@@ -1,10 +1,11 @@
 package connection
 
 import (
-	"context"
 	"log/slog"
+	"lukas8219/websocket-operator/internal/route"
 	"net"
 	"sync"
+	"time"
 )
 
 // Logger defines the logging behavior
@@ -18,32 +19,43 @@ type Logger interface {
 type ConnectionTracker interface {
 	Logger
 	Close()
+	ID() string
 	UpstreamConn() net.Conn
 	DownstreamConn() net.Conn
 	User() string
+	Upstream() route.Target
 	UpstreamHost() string
 	DownstreamHost() string
-	UpstreamContext() context.Context
-	UpstreamCancelChan() chan int
 	SetUpstreamConn(conn net.Conn)
-	SetUpstreamHost(host string)
+	SetUpstream(upstream route.Target)
 	SetDownstreamConn(conn net.Conn)
-	SwitchUpstreamHost(host string)
+	Done() <-chan struct{}
 }
 
 // Tracker implements ConnectionTracker
 type Tracker struct {
+	id             string
+	created        time.Time
 	user           string
-	upstreamHost   string
+	upstream       route.Target
 	downstreamHost string
 	upstreamConn   net.Conn
 	downstreamConn net.Conn
-	cancelFunc     context.CancelFunc
-	ctx            context.Context
-	cancelChan     chan int
+	done           chan struct{}
+	doneOnce       sync.Once
 	mu             sync.RWMutex
 }
 
+// ID tells the connections of a user apart. It is sent to the upstream on every dial.
+func (t *Tracker) ID() string {
+	return t.id
+}
+
+// Created is when the client connected.
+func (t *Tracker) Created() time.Time {
+	return t.created
+}
+
 // Create accessor methods without "Get" prefix (more idiomatic in Go)
 func (t *Tracker) User() string {
 	t.mu.RLock()
@@ -51,10 +63,15 @@ func (t *Tracker) User() string {
 	return t.user
 }
 
-func (t *Tracker) UpstreamHost() string {
+func (t *Tracker) Upstream() route.Target {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
-	return t.upstreamHost
+	return t.upstream
+}
+
+// UpstreamHost is the host:port address of the upstream.
+func (t *Tracker) UpstreamHost() string {
+	return t.Upstream().Address()
 }
 
 func (t *Tracker) DownstreamHost() string {
@@ -75,28 +92,16 @@ func (t *Tracker) DownstreamConn() net.Conn {
 	return t.downstreamConn
 }
 
-func (t *Tracker) UpstreamContext() context.Context {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-	return t.ctx
-}
-
-func (t *Tracker) UpstreamCancelChan() chan int {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-	return t.cancelChan
-}
-
 func (t *Tracker) SetUpstreamConn(conn net.Conn) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.upstreamConn = conn
 }
 
-func (t *Tracker) SetUpstreamHost(host string) {
+func (t *Tracker) SetUpstream(upstream route.Target) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	t.upstreamHost = host
+	t.upstream = upstream
 }
 
 func (t *Tracker) SetDownstreamConn(conn net.Conn) {
@@ -105,24 +110,29 @@ func (t *Tracker) SetDownstreamConn(conn net.Conn) {
 	t.downstreamConn = conn
 }
 
-func (t *Tracker) SwitchUpstreamHost(host string) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.cancelFunc()
-	t.ctx, t.cancelFunc = context.WithCancel(context.Background())
-	t.upstreamHost = host
+// Done is closed once the downstream client went away. Migrating to another upstream doesn't close it.
+func (t *Tracker) Done() <-chan struct{} {
+	return t.done
+}
+
+// downstreamClosed marks the connection as done.
+func (t *Tracker) downstreamClosed() {
+	t.doneOnce.Do(func() {
+		close(t.done)
+	})
 }
 
 // Logging methods with chaining
 func (t *Tracker) Info(message string, args ...any) Logger {
 	t.mu.RLock()
 	user := t.user
-	upstreamHost := t.upstreamHost
+	upstream := t.upstream
 	downstreamHost := t.downstreamHost
 	t.mu.RUnlock()
 
 	slog.With("user", user).
-		With("upstreamHost", upstreamHost).
+		With("connectionId", t.id).
+		With("upstream", upstream).
 		With("downstreamHost", downstreamHost).
 		With("component", "connection-tracker").
 		Info(message, args...)
@@ -132,12 +142,13 @@ func (t *Tracker) Info(message string, args ...any) Logger {
 func (t *Tracker) Error(message string, args ...any) Logger {
 	t.mu.RLock()
 	user := t.user
-	upstreamHost := t.upstreamHost
+	upstream := t.upstream
 	downstreamHost := t.downstreamHost
 	t.mu.RUnlock()
 
 	slog.With("user", user).
-		With("upstreamHost", upstreamHost).
+		With("connectionId", t.id).
+		With("upstream", upstream).
 		With("downstreamHost", downstreamHost).
 		With("component", "connection-tracker").
 		Error(message, args...)
@@ -147,12 +158,13 @@ func (t *Tracker) Error(message string, args ...any) Logger {
 func (t *Tracker) Debug(message string, args ...any) Logger {
 	t.mu.RLock()
 	user := t.user
-	upstreamHost := t.upstreamHost
+	upstream := t.upstream
 	downstreamHost := t.downstreamHost
 	t.mu.RUnlock()
 
 	slog.With("user", user).
-		With("upstreamHost", upstreamHost).
+		With("connectionId", t.id).
+		With("upstream", upstream).
 		With("downstreamHost", downstreamHost).
 		With("component", "connection-tracker").
 		Debug(message, args...)
@@ -160,15 +172,14 @@ func (t *Tracker) Debug(message string, args ...any) Logger {
 }
 
 // NewTracker creates a new connection tracker
-func NewTracker(user, upstreamHost, downstreamHost string, downstreamConn net.Conn) *Tracker {
-	ctx, cancel := context.WithCancel(context.Background())
+func NewTracker(user string, upstream route.Target, downstreamHost string, downstreamConn net.Conn) *Tracker {
 	return &Tracker{
+		id:             route.NewConnectionId(),
+		created:        time.Now(),
 		user:           user,
-		upstreamHost:   upstreamHost,
+		upstream:       upstream,
 		downstreamHost: downstreamHost,
 		downstreamConn: downstreamConn,
-		ctx:            ctx,
-		cancelFunc:     cancel,
-		cancelChan:     make(chan int, 1),
+		done:           make(chan struct{}),
 	}
 }
@@ -1,43 +1,44 @@
 package connection
 
 import (
-	"context"
-	"log/slog"
-	"net"
-
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 )
 
+// ProxyUpstreamToDownstream proxies the client frames to the current upstream. It starts once per
+// connection, migrations switch the upstream under it instead of restarting it. Once it stops the
+// connection is closed, as nothing reads the client anymore.
 func (p *WSProxier) ProxyUpstreamToDownstream() {
-	go _proxyUpstreamToDownstream(p.tracker.UpstreamContext(), p.tracker.User(), p.tracker.DownstreamConn(), p.tracker.UpstreamConn())
+	p.pumpOnce.Do(func() {
+		go func() {
+			if p.proxyClientToServer() {
+				p.Close()
+			} else {
+				p.CloseWithStatus(ws.StatusGoingAway, "upstream unavailable")
+			}
+			p.tracker.downstreamClosed()
+		}()
+	})
 }
 
-func _proxyUpstreamToDownstream(ctx context.Context, user string, downstreamConn net.Conn, upstreamConn net.Conn) {
-	log := slog.With("user", user).
-		With("upstreamHost", upstreamConn.RemoteAddr().String()).
-		With("downstreamHost", downstreamConn.RemoteAddr().String())
+// proxyClientToServer returns true when it stopped because the downstream client went away.
+func (p *WSProxier) proxyClientToServer() bool {
+	downstream := p.downstream()
 	for {
-		select {
-		case <-ctx.Done():
-			log.Debug("downstream to upstream context done")
-			return
-		default:
-			msg, op, err := wsutil.ReadClientData(downstreamConn)
-			if err != nil {
-				log.Error("Failed to read from downstream", "error", err)
-				return
-			}
-			err = wsutil.WriteClientMessage(upstreamConn, op, msg)
-			if err != nil {
-				log.Error("Failed to write to upstream", "error", err)
-				return
-			}
-			if op == ws.OpClose {
-				log.Debug("downstream server closed connection")
-				return
-			}
+		// Frames are read whole, so a migration always starts at a frame boundary.
+		msg, op, err := wsutil.ReadClientData(downstream)
+		if err != nil {
+			p.tracker.Error("Failed to read from downstream", "error", err)
+			return true
+		}
+		err = p.forward(frame{op: op, payload: msg})
+		if err != nil {
+			p.tracker.Error("Failed to write to upstream", "error", err)
+			return false
+		}
+		if op == ws.OpClose {
+			p.tracker.Debug("downstream server closed connection")
+			return true
 		}
 	}
-
 }
@@ -1,26 +1,89 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log/slog"
 	"lukas8219/websocket-operator/cmd/loadbalancer/server"
+	"lukas8219/websocket-operator/internal/identity"
+	"lukas8219/websocket-operator/internal/jwt"
 	"lukas8219/websocket-operator/internal/logger"
 	"lukas8219/websocket-operator/internal/route"
-)
-
-var (
-	router route.RouterImpl
+	"os"
+	"strings"
 )
 
 func main() {
 	port := flag.String("port", "3000", "Port to listen on")
-	mode := flag.String("mode", "kubernetes", "Mode to use")
+	mode := flag.String("mode", "kubernetes", "Router mode to use, one of "+strings.Join(route.Modes(), ", "))
 	debug := flag.Bool("debug", false, "Debug mode")
+	poolsFile := flag.String("pools", os.Getenv("WS_OPERATOR_POOLS_FILE"), "YAML or JSON file of named upstream pools, each with its own mode and discovery target. Overrides -mode")
+	identitySpec := flag.String("identity", os.Getenv("WS_OPERATOR_IDENTITY"), "Comma-separated sources the user id is read from, in order: header:<name>, query:<name>, cookie:<name>, subprotocol:<prefix> or jwt:<claim>[:<source>]. Defaults to header:ws-user-id")
+	jwks := flag.String("jwks", os.Getenv("WS_OPERATOR_JWKS"), "JWKS file or http(s) URL the tokens of connections are verified against. Enables JWT authentication")
+	jwksRefresh := flag.Duration("jwksRefreshInterval", jwt.DefaultRefreshInterval, "How often the JWKS is reloaded to pick up rotated keys")
+	jwtIssuer := flag.String("jwtIssuer", os.Getenv("WS_OPERATOR_JWT_ISSUER"), "Required iss claim of the tokens, any issuer when empty")
+	jwtAudience := flag.String("jwtAudience", os.Getenv("WS_OPERATOR_JWT_AUDIENCE"), "Required aud claim of the tokens, any audience when empty")
+	jwtLeeway := flag.Duration("jwtLeeway", 0, "Clock skew tolerated on the exp and nbf claims")
+	jwtUserClaim := flag.String("jwtUserClaim", jwt.DefaultUserClaim, "Claim of the token holding the user id")
+	jwtToken := flag.String("jwtToken", "header:Authorization,query:access_token", "Comma-separated sources the token is read from, in order, like -identity")
+	metaFlags := route.BindMetaFlags(flag.CommandLine)
 	flag.Parse()
 	logger.SetupLogger(*debug)
-	router = route.NewRouter(route.RouterConfig{Mode: route.RouterConfigMode(*mode)})
-	router.InitializeHosts()
-	server.StartServer(server.ServerConfig{
-		Router: router,
-		Port:   *port,
-	})
+	meta, err := metaFlags.Meta()
+	if err != nil {
+		slog.Error("Invalid router configuration", "error", err)
+		os.Exit(1)
+	}
+	pools := []server.PoolConfig{{Name: server.DefaultPool, Mode: *mode}}
+	if *poolsFile != "" {
+		data, err := os.ReadFile(*poolsFile)
+		if err == nil {
+			pools, err = server.ParsePoolsFile(data)
+		}
+		if err != nil {
+			slog.Error("Invalid pools file", "file", *poolsFile, "error", err)
+			os.Exit(1)
+		}
+	}
+	extractor, err := identity.Parse(*identitySpec)
+	if err != nil {
+		slog.Error("Invalid identity source", "identity", *identitySpec, "error", err)
+		os.Exit(1)
+	}
+	config := server.ServerConfig{Port: *port, Identity: extractor}
+	if *jwks != "" {
+		keys, err := jwt.NewKeySet(*jwks, *jwksRefresh)
+		if err != nil {
+			slog.Error("Failed to load the JWKS", "jwks", *jwks, "error", err)
+			os.Exit(1)
+		}
+		go keys.Run(context.Background())
+		token, err := identity.Parse(*jwtToken)
+		if err != nil {
+			slog.Error("Invalid token source", "jwtToken", *jwtToken, "error", err)
+			os.Exit(1)
+		}
+		config.Auth = &jwt.Authenticator{
+			Verifier: jwt.NewVerifier(keys, jwt.Config{Issuer: *jwtIssuer, Audience: *jwtAudience, Leeway: *jwtLeeway}),
+			Claim:    *jwtUserClaim,
+			Token:    token,
+		}
+	}
+	for _, pool := range pools {
+		poolMeta := pool.Meta(meta)
+		router, err := route.NewRouter(route.RouterConfig{
+			Mode:       route.RouterConfigMode(pool.Mode),
+			ConfigMeta: poolMeta,
+		})
+		if err != nil {
+			slog.Error("Failed to create router", "pool", pool.Name, "error", err)
+			os.Exit(1)
+		}
+		if err := router.InitializeHosts(); err != nil {
+			slog.Error("Failed to initialize hosts", "pool", pool.Name, "error", err)
+		}
+		go route.WatchHasherAgreement(router, poolMeta, route.DefaultHasherCheckInterval)
+		config.Pools = append(config.Pools, server.Pool{Name: pool.Name, Router: router, Match: pool.Match})
+	}
+	server.StartServer(config)
 }
@@ -3,42 +3,91 @@ package server
 import (
 	"log/slog"
 	"lukas8219/websocket-operator/cmd/loadbalancer/connection"
+	"lukas8219/websocket-operator/internal/identity"
+	"lukas8219/websocket-operator/internal/jwt"
+	"lukas8219/websocket-operator/internal/metrics"
 	"lukas8219/websocket-operator/internal/route"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gobwas/ws"
 )
 
-func createHandler(router route.RouterImpl, connections map[string]*connection.Connection) http.HandlerFunc {
+func createHandler(pools []*pool, extractor identity.Extractor, auth *jwt.Authenticator) http.HandlerFunc {
+	metricsHandler := metrics.Handler()
+	snapshotHandlers := make(map[string]http.Handler, len(pools))
+	for _, p := range pools {
+		snapshotHandlers[p.Name] = route.SnapshotHandler(p.Router)
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		handleConnection(router, connections, w, r)
+		if r.Method == http.MethodGet && r.URL.Path == metrics.Path {
+			metricsHandler.ServeHTTP(w, r)
+			return
+		}
+		// ?pool=<name> selects the pool, the first one by default.
+		if r.Method == http.MethodGet && r.URL.Path == route.SnapshotPath {
+			p := findPool(pools, r.URL.Query().Get("pool"))
+			if p == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			snapshotHandlers[p.Name].ServeHTTP(w, r)
+			return
+		}
+		p := selectPool(pools, r)
+		if p == nil {
+			slog.Debug("No pool matches the request", "host", r.Host, "path", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		handleConnection(p.Router, p.connections, extractor, auth, w, r)
 	}
 }
 
-func handleConnection(router route.RouterImpl, connections map[string]*connection.Connection, w http.ResponseWriter, r *http.Request) {
-	user := r.Header.Get("ws-user-id")
-	if user == "" {
-		slog.Error("No user id provided")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+func handleConnection(router route.RouterImpl, connections *connection.ConnectionRegistry, extractor identity.Extractor, auth *jwt.Authenticator, w http.ResponseWriter, r *http.Request) {
+	var user string
+	var expires time.Time
+	if auth != nil {
+		// The user comes from the verified token instead of the identity source.
+		session, err := auth.Authenticate(r)
+		if err != nil {
+			slog.Info("Rejected unauthenticated connection", "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		user, expires = session.User, session.Expires
+		// The token may be carried in a subprotocol the upgrade must select.
+		extractor = auth
+	} else {
+		var err error
+		if user, err = extractor.Extract(r); err != nil {
+			slog.Error("No user id provided", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 	}
 	//TODO: we should only accept `NewConnection` already with client connection and host set.`
 	//As only the `connection` pkg should alter it`.
 
-	host := router.Route(user)
+	if reporter, ok := router.(route.LoadReporter); ok {
+		reporter.ReportLoads(connections.UpstreamLoads())
+	}
+	targets := colocate(router.RouteN(user, route.FailoverTargets), connections.Get(user))
 	slog.With("user", user).Debug("New connection")
-	if host == "" {
+	if len(targets) == 0 || targets[0].IsZero() {
 		slog.Error("No host found for user")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	upstream := targets[0]
 
 	slog.With("user", user).Debug("Upgrading HTTP connection")
 	upgrader := ws.HTTPUpgrader{
+		Protocol: identity.Protocol(extractor),
 		Header: http.Header{
 			"x-ws-operator-proxy-instance": []string{os.Getenv("HOSTNAME")},
-			"x-ws-operator-upstream-host":  []string{host},
+			"x-ws-operator-upstream-host":  []string{upstream.Address()},
 		},
 	}
 	downstreamConn, _, _, err := upgrader.Upgrade(r, w)
@@ -49,9 +98,43 @@ func handleConnection(router route.RouterImpl, connections map[string]*connectio
 		return
 	}
 
-	proxiedConnection := connection.NewConnection(user, host, downstreamConn.RemoteAddr().String(), downstreamConn)
-	connections[user] = proxiedConnection
+	proxiedConnection := connection.NewConnection(user, upstream, downstreamConn.RemoteAddr().String(), downstreamConn, router.EpochHash)
+	proxiedConnection.SetFallbacks(targets[1:])
+	if !expires.IsZero() {
+		proxiedConnection.ExpireAt(expires)
+	}
+	devices := connections.Add(proxiedConnection)
 
-	proxiedConnection.Debug("New connection")
-	go proxiedConnection.Handle()
+	proxiedConnection.Debug("New connection", "devices", devices)
+	go func() {
+		if err := proxiedConnection.Handle(); err != nil {
+			proxiedConnection.Error("No upstream could be dialed, closed the connection", "error", err)
+			return
+		}
+		// Redirects and fallbacks may have connected the user elsewhere than the first target.
+		connected := proxiedConnection.Upstream()
+		route.CountConnectionHop(router, connected)
+		if tracker, ok := router.(route.RecipientTracker); ok {
+			tracker.Track(user, connected)
+			<-proxiedConnection.Done()
+			// Each device is tracked once, the user stays tracked while any of them is connected.
+			tracker.Forget(user)
+		}
+	}()
+}
+
+// colocate puts the upstream the other devices of the user are connected to first, so every device of
+// a user shares a sidecar which fans messages out to all of them, and they are rebalanced together.
+func colocate(targets []route.Target, devices []*connection.Connection) []route.Target {
+	if len(devices) == 0 {
+		return targets
+	}
+	current := devices[0].Upstream()
+	colocated := []route.Target{current}
+	for _, t := range targets {
+		if t.Address() != current.Address() {
+			colocated = append(colocated, t)
+		}
+	}
+	return colocated
 }
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"lukas8219/websocket-operator/internal/identity"
+	"lukas8219/websocket-operator/internal/jwt"
+	"lukas8219/websocket-operator/internal/route"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// newIdentitySidecar accepts websocket connections and sends the user id forwarded on each upgrade.
+func newIdentitySidecar(t *testing.T) (route.Target, <-chan string) {
+	forwarded := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get(identity.TrustedHeader)
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := wsutil.ReadClientData(conn); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return route.TargetFromAddress(strings.TrimPrefix(server.URL, "http://")), forwarded
+}
+
+func TestHandleConnectionForwardsTheResolvedIdentity(t *testing.T) {
+	sidecar, forwarded := newIdentitySidecar(t)
+	router := &stressRouter{targets: []route.Target{sidecar}, Logger: slog.Default()}
+	extractor, err := identity.Parse("query:user,subprotocol:user.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadbalancer := httptest.NewServer(createHandler(newPools(ServerConfig{Router: router}), extractor, nil))
+	t.Cleanup(loadbalancer.Close)
+	url := strings.Replace(loadbalancer.URL, "http://", "ws://", 1)
+
+	t.Run("From a query parameter", func(t *testing.T) {
+		// A client can't pick the identity the sidecar trusts by setting the header itself.
+		dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP{identity.TrustedHeader: []string{"mallory"}}}
+		conn, _, _, err := dialer.Dial(context.Background(), url+"/?user=alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if user := <-forwarded; user != "alice" {
+			t.Fatalf("expected alice to be forwarded, got %q", user)
+		}
+	})
+
+	t.Run("From a subprotocol", func(t *testing.T) {
+		dialer := ws.Dialer{Protocols: []string{"chat", "user.bob"}}
+		conn, _, handshake, err := dialer.Dial(context.Background(), url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if user := <-forwarded; user != "bob" {
+			t.Fatalf("expected bob to be forwarded, got %q", user)
+		}
+		if handshake.Protocol != "user.bob" {
+			t.Fatalf("expected the identity subprotocol to be selected, got %q", handshake.Protocol)
+		}
+	})
+
+	t.Run("Without an identity", func(t *testing.T) {
+		if _, _, _, err := ws.Dial(context.Background(), url); err == nil {
+			t.Fatal("expected the upgrade to be rejected")
+		}
+	})
+}
+
+// newTestAuthenticator verifies tokens against a JWKS file of a fresh RSA key. It returns a function
+// signing tokens for user expiring at expires.
+func newTestAuthenticator(t *testing.T) (*jwt.Authenticator, func(user string, expires time.Time) string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA", "kid": "test", "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jwt.NewKeySet(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(user string, expires time.Time) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+		claims, _ := json.Marshal(map[string]any{"sub": user, "aud": "websocket", "exp": expires.Unix()})
+		signed := encode(header) + "." + encode(claims)
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + encode(signature)
+	}
+	return &jwt.Authenticator{Verifier: jwt.NewVerifier(keys, jwt.Config{Audience: "websocket"})}, sign
+}
+
+func TestHandleConnectionRequiresAValidToken(t *testing.T) {
+	sidecar, forwarded := newIdentitySidecar(t)
+	router := &stressRouter{targets: []route.Target{sidecar}, Logger: slog.Default()}
+	auth, sign := newTestAuthenticator(t)
+	extractor := identity.Header{Name: identity.DefaultHeader}
+	loadbalancer := httptest.NewServer(createHandler(newPools(ServerConfig{Router: router}), extractor, auth))
+	t.Cleanup(loadbalancer.Close)
+	url := strings.Replace(loadbalancer.URL, "http://", "ws://", 1)
+
+	t.Run("Without a token", func(t *testing.T) {
+		// The identity source is ignored once connections are authenticated.
+		dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP{identity.DefaultHeader: []string{"mallory"}}}
+		_, _, _, err := dialer.Dial(context.Background(), url)
+		if status, ok := err.(ws.StatusError); !ok || int(status) != http.StatusUnauthorized {
+			t.Fatalf("expected the upgrade to be unauthorized, got %v", err)
+		}
+	})
+
+	t.Run("With an expired token", func(t *testing.T) {
+		_, _, _, err := ws.Dial(context.Background(), url+"/?access_token="+sign("alice", time.Now().Add(-time.Minute)))
+		if status, ok := err.(ws.StatusError); !ok || int(status) != http.StatusUnauthorized {
+			t.Fatalf("expected the upgrade to be unauthorized, got %v", err)
+		}
+	})
+
+	t.Run("Closed once the token expires", func(t *testing.T) {
+		expires := time.Now().Add(1500 * time.Millisecond)
+		dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP{"Authorization": []string{"Bearer " + sign("alice", expires)}}}
+		conn, _, _, err := dialer.Dial(context.Background(), url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if user := <-forwarded; user != "alice" {
+			t.Fatalf("expected the user of the token to be forwarded, got %q", user)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		frame, err := ws.ReadFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Header.OpCode != ws.OpClose {
+			t.Fatalf("expected a close frame, got %v", frame.Header.OpCode)
+		}
+		if code, reason := ws.ParseCloseFrameData(frame.Payload); code != ws.StatusPolicyViolation {
+			t.Fatalf("expected a policy violation, got %d %q", code, reason)
+		}
+	})
+}
+
+// fallbackRouter ranks the same targets for every user and records the target each user is tracked on.
+type fallbackRouter struct {
+	stressRouter
+	tracked chan route.Target
+	forgot  chan string
+}
+
+func (r *fallbackRouter) RouteN(user string, n int) []route.Target {
+	return r.targets[:min(n, len(r.targets))]
+}
+func (r *fallbackRouter) Track(user string, t route.Target) { r.tracked <- t }
+func (r *fallbackRouter) Forget(user string)                { r.forgot <- user }
+func (r *fallbackRouter) Move(user string, t route.Target)  {}
+
+// deadTarget is an address nothing listens on.
+func deadTarget(t *testing.T) route.Target {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return route.TargetFromAddress(strings.TrimPrefix(server.URL, "http://"))
+}
+
+func TestHandleConnectionTracksTheFallbackTarget(t *testing.T) {
+	sidecar := newStressSidecar(t)
+	router := &fallbackRouter{
+		stressRouter: stressRouter{targets: []route.Target{deadTarget(t), sidecar}, Logger: slog.Default()},
+		tracked:      make(chan route.Target, 1),
+		forgot:       make(chan string, 1),
+	}
+	pools := newPools(ServerConfig{Router: router})
+	loadbalancer := httptest.NewServer(createHandler(pools, identity.Header{Name: identity.DefaultHeader}, nil))
+	t.Cleanup(loadbalancer.Close)
+	url := strings.Replace(loadbalancer.URL, "http://", "ws://", 1)
+
+	dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP{identity.DefaultHeader: []string{"alice"}}}
+	conn, _, _, err := dialer.Dial(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case target := <-router.tracked:
+		if target.Address() != sidecar.Address() {
+			t.Fatalf("expected alice to be tracked on the fallback %s, got %s", sidecar.Address(), target.Address())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected alice to be tracked")
+	}
+	conn.Close()
+	select {
+	case <-router.forgot:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected alice to be forgotten once disconnected")
+	}
+}
+
+func TestHandleConnectionClosesTheClientWithoutUpstream(t *testing.T) {
+	router := &fallbackRouter{
+		stressRouter: stressRouter{targets: []route.Target{deadTarget(t), deadTarget(t)}, Logger: slog.Default()},
+		tracked:      make(chan route.Target, 1),
+		forgot:       make(chan string, 1),
+	}
+	pools := newPools(ServerConfig{Router: router})
+	loadbalancer := httptest.NewServer(createHandler(pools, identity.Header{Name: identity.DefaultHeader}, nil))
+	t.Cleanup(loadbalancer.Close)
+	url := strings.Replace(loadbalancer.URL, "http://", "ws://", 1)
+
+	dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP{identity.DefaultHeader: []string{"alice"}}}
+	conn, _, _, err := dialer.Dial(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := ws.ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := ws.ParseCloseFrameData(frame.Payload); frame.Header.OpCode != ws.OpClose || code != ws.StatusInternalServerError {
+		t.Fatalf("expected the client to be closed with an internal error, got %v %d", frame.Header.OpCode, code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pools[0].connections.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to be removed from the registry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case target := <-router.tracked:
+		t.Fatalf("expected alice not to be tracked, got %s", target.Address())
+	default:
+	}
+}
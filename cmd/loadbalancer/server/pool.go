@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"lukas8219/websocket-operator/cmd/loadbalancer/connection"
+	"lukas8219/websocket-operator/internal/route"
+	"net"
+	"net/http"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultPool is the name of the pool of a load balancer configured with a single router.
+const DefaultPool = "default"
+
+// Pool is a named set of upstream sidecars with its own router. A connection goes to the first pool
+// whose Match matches its upgrade request.
+type Pool struct {
+	Name   string
+	Router route.RouterImpl
+	Match  Match
+}
+
+// Match selects the requests of a pool. Empty fields match every request, so a pool with an empty
+// Match takes the connections no other pool matched.
+type Match struct {
+	// Host matches the Host header, without port and case-insensitively.
+	Host string `json:"host,omitempty"`
+	// PathPrefix matches the start of the request path.
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// Header is a header the request must carry, with HeaderValue as value when set.
+	Header      string `json:"header,omitempty"`
+	HeaderValue string `json:"headerValue,omitempty"`
+}
+
+func (m Match) Matches(r *http.Request) bool {
+	if m.Host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(host, m.Host) {
+			return false
+		}
+	}
+	if m.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, m.PathPrefix) {
+		return false
+	}
+	if m.Header != "" {
+		values := r.Header.Values(m.Header)
+		if len(values) == 0 || (m.HeaderValue != "" && values[0] != m.HeaderValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// PoolConfig is a pool of the pools file. Its discovery fields override the ones of the flags.
+type PoolConfig struct {
+	Name  string `json:"name"`
+	Mode  string `json:"mode"`
+	Match Match  `json:"match,omitempty"`
+	// Namespace, Service and PortName select the sidecars in kubernetes mode.
+	Namespace string `json:"namespace,omitempty"`
+	Service   string `json:"service,omitempty"`
+	PortName  string `json:"portName,omitempty"`
+	// Record is the SRV record of the dns mode.
+	Record string `json:"record,omitempty"`
+	// Hosts are the sidecars of the static mode, HostsFile the file of the file mode.
+	Hosts     []string `json:"hosts,omitempty"`
+	HostsFile string   `json:"hostsFile,omitempty"`
+}
+
+// poolsFile is the format of the pools file:
+//
+//	pools:
+//	  - name: chat
+//	    mode: kubernetes
+//	    service: chat-ws
+//	    match:
+//	      host: chat.example.com
+//	  - name: games
+//	    mode: static
+//	    hosts: ["10.0.0.1:3000"]
+//	    match:
+//	      pathPrefix: /games
+type poolsFile struct {
+	Pools []PoolConfig `json:"pools"`
+}
+
+// ParsePoolsFile parses the YAML or JSON content of a pools file.
+func ParsePoolsFile(data []byte) ([]PoolConfig, error) {
+	var file poolsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Pools) == 0 {
+		return nil, errors.New("no pools configured")
+	}
+	names := make(map[string]bool, len(file.Pools))
+	for _, pool := range file.Pools {
+		if pool.Name == "" {
+			return nil, errors.New("pool without a name")
+		}
+		if names[pool.Name] {
+			return nil, fmt.Errorf("pool %q is configured twice", pool.Name)
+		}
+		names[pool.Name] = true
+	}
+	return file.Pools, nil
+}
+
+// Meta returns meta with the discovery target of the pool.
+func (p PoolConfig) Meta(meta route.RouterMeta) route.RouterMeta {
+	if p.Namespace != "" {
+		meta.Kubernetes.Namespace = p.Namespace
+	}
+	if p.Service != "" {
+		meta.Kubernetes.Service = p.Service
+	}
+	if p.PortName != "" {
+		meta.Kubernetes.PortName = p.PortName
+	}
+	if p.Record != "" {
+		meta.Dns.Record = p.Record
+	}
+	if len(p.Hosts) > 0 {
+		meta.Static.Hosts = p.Hosts
+	}
+	if p.HostsFile != "" {
+		meta.Static.File = p.HostsFile
+	}
+	return meta
+}
+
+// pool holds the connections proxied through a Pool.
+type pool struct {
+	Pool
+	connections *connection.ConnectionRegistry
+}
+
+// selectPool returns the first pool matching r, nil when none does.
+func selectPool(pools []*pool, r *http.Request) *pool {
+	for _, p := range pools {
+		if p.Match.Matches(r) {
+			return p
+		}
+	}
+	return nil
+}
+
+// findPool returns the pool named name, the first pool when name is empty.
+func findPool(pools []*pool, name string) *pool {
+	if name == "" {
+		return pools[0]
+	}
+	for _, p := range pools {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"lukas8219/websocket-operator/internal/route"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePoolsFile(t *testing.T) {
+	pools, err := ParsePoolsFile([]byte(`
+pools:
+  - name: chat
+    mode: kubernetes
+    service: chat-ws
+    match:
+      host: chat.example.com
+  - name: games
+    mode: static
+    hosts: ["10.0.0.1:3000"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 2 || pools[0].Match.Host != "chat.example.com" || pools[1].Hosts[0] != "10.0.0.1:3000" {
+		t.Fatalf("unexpected pools %+v", pools)
+	}
+	meta := pools[0].Meta(route.RouterMeta{})
+	if meta.Kubernetes.Service != "chat-ws" {
+		t.Fatalf("expected the pool service to override the flags, got %+v", meta.Kubernetes)
+	}
+	for _, invalid := range []string{"pools: []", "pools:\n  - mode: static", "pools:\n  - name: a\n  - name: a", "pools:\n  - name: a\n    target: b"} {
+		if _, err := ParsePoolsFile([]byte(invalid)); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestSelectPool(t *testing.T) {
+	pools := newPools(ServerConfig{Pools: []Pool{
+		{Name: "chat", Match: Match{Host: "chat.example.com"}},
+		{Name: "games", Match: Match{PathPrefix: "/games"}},
+		{Name: "beta", Match: Match{Header: "X-App", HeaderValue: "beta"}},
+	}})
+	cases := map[string]string{
+		"http://CHAT.example.com:8080/": "chat",
+		"http://lb/games/chess":         "games",
+		"http://lb/":                    "",
+	}
+	for url, expected := range cases {
+		p := selectPool(pools, httptest.NewRequest("GET", url, nil))
+		if (p == nil && expected != "") || (p != nil && p.Name != expected) {
+			t.Errorf("%s: expected pool %q, got %v", url, expected, p)
+		}
+	}
+	r := httptest.NewRequest("GET", "http://lb/", nil)
+	r.Header.Set("X-App", "beta")
+	if p := selectPool(pools, r); p == nil || p.Name != "beta" {
+		t.Fatalf("expected the header to select beta, got %v", p)
+	}
+	if p := findPool(pools, ""); p.Name != "chat" {
+		t.Fatalf("expected the first pool by default, got %s", p.Name)
+	}
+}
@@ -4,50 +4,51 @@ import (
 	"log/slog"
 	"lukas8219/websocket-operator/cmd/loadbalancer/connection"
 	"lukas8219/websocket-operator/internal/route"
-	"time"
 )
 
-func handleRebalanceLoop(router route.RouterImpl, connections map[string]*connection.Connection) {
+func handleRebalanceLoop(router route.RouterImpl, connections *connection.ConnectionRegistry) {
 	slog.Debug("Starting rebalance loop")
 	for {
 		select {
-		case hosts := <-router.RebalanceRequests():
-			slog.Debug("Received message to rebalance", "hosts", hosts)
-			upstreamHostsToConnectionTracker := make(map[string]*connection.Connection, len(connections))
-			slog.Debug("Flat mapping ConnectionTracker to upstreamHosts", "connections", connections)
-			for _, connectionTracker := range connections {
-				upstreamHostsToConnectionTracker[connectionTracker.User()] = connectionTracker
-			}
-			for _, affectedHost := range hosts {
-				recipientId := affectedHost[0]
-				newHost := affectedHost[1]
-				connectionTracker := upstreamHostsToConnectionTracker[recipientId]
-				if connectionTracker == nil {
+		case requests := <-router.RebalanceRequests():
+			slog.Debug("Received message to rebalance", "requests", requests)
+			//the router only sends moved recipients, so each one is looked up directly instead of scanning every connection
+			for _, request := range requests {
+				recipientId := request.RecipientId
+				devices := connections.Get(recipientId)
+				if len(devices) == 0 {
 					slog.Debug("No connection tracker found", "user", recipientId)
 					continue
 				}
-				oldHost := connectionTracker.UpstreamHost()
-				if connectionTracker.UpstreamHost() == newHost {
-					connectionTracker.Debug("No need to rebalance")
-					continue
+				//every device of the recipient moves, so they keep sharing a sidecar
+				var moved route.Target
+				for _, connectionTracker := range devices {
+					if rebalance(connectionTracker, request.New) {
+						moved = connectionTracker.Upstream()
+					}
 				}
-				connectionTracker.Debug("Waiting for upstream to cancel", "oldHost", oldHost)
-				connectionTracker.SwitchUpstreamHost(newHost)
-
-				select {
-				case <-connectionTracker.UpstreamCancelChan():
-					connectionTracker.Debug("Successfully received cancellation signal")
-				case <-time.After(5 * time.Second):
-					connectionTracker.Error("Timeout waiting for upstream cancellation, proceeding anyway")
+				// The router keeps the recipient on its old owner until a connection moved, so a recipient
+				// whose migration failed is rebalanced again on the next membership change.
+				if tracker, ok := router.(route.RecipientTracker); ok && !moved.IsZero() {
+					tracker.Move(recipientId, moved)
 				}
-
-				connections[recipientId] = connectionTracker
-				//TODO: gut feeling here. either we move rebalance to the connection pkg or we re-design stuff
-				//connectionTracker.UpstreamContext, connectionTracker.CancelUpstream = context.WithCancel(context.Background())
-				connectionTracker.Info("Rebalancing connection from", "old", oldHost, "new", newHost)
-				//TODO: stopping down -> up could cause issues if this is mid read/write
-				go connectionTracker.Handle()
 			}
 		}
 	}
 }
+
+// rebalance migrates a connection to target. It returns whether the connection is on target, or on the
+// owner target redirected it to.
+func rebalance(connectionTracker *connection.Connection, target route.Target) bool {
+	old := connectionTracker.Upstream()
+	if old.Address() == target.Address() {
+		connectionTracker.Debug("No need to rebalance")
+		return true
+	}
+	if err := connectionTracker.Migrate(target); err != nil {
+		connectionTracker.Error("Failed to rebalance connection, keeping the current upstream", "new", target, "error", err)
+		return false
+	}
+	connectionTracker.Info("Rebalanced connection", "old", old, "new", connectionTracker.Upstream())
+	return true
+}
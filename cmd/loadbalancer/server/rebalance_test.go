@@ -3,10 +3,12 @@ package server
 import (
 	"bufio"
 	"context"
+	"errors"
 	"io"
 	"log"
 	"log/slog"
 	"lukas8219/websocket-operator/cmd/loadbalancer/connection"
+	"lukas8219/websocket-operator/internal/route"
 	"net"
 	"sync"
 	"testing"
@@ -16,20 +18,26 @@ import (
 )
 
 type MockRouter struct {
-	rebalanceChan chan [][2]string
+	rebalanceChan chan []route.RebalanceRequest
 	*slog.Logger
 }
 
-func (m *MockRouter) RebalanceRequests() <-chan [][2]string {
+func (m *MockRouter) RebalanceRequests() <-chan []route.RebalanceRequest {
 	return m.rebalanceChan
 }
 
-func (m *MockRouter) Route(string) string { return "" }
-func (m *MockRouter) Add([]string)        {}
+func (m *MockRouter) Route(string) route.Target         { return route.Target{} }
+func (m *MockRouter) RouteN(string, int) []route.Target { return []route.Target{} }
+func (m *MockRouter) Add([]string)                      {}
 func (m *MockRouter) GetAllUpstreamHosts() []string {
 	return []string{}
 }
 func (m *MockRouter) InitializeHosts() error { return nil }
+func (m *MockRouter) Epoch() uint64          { return 0 }
+func (m *MockRouter) EpochHash() uint64      { return 0 }
+func (m *MockRouter) Snapshot() route.Snapshot {
+	return route.Snapshot{}
+}
 
 type NetConnectionMock struct {
 	net.Conn
@@ -68,10 +76,10 @@ func (m *NetConnectionMock) Read(b []byte) (int, error) {
 
 func (m *NetConnectionMock) Write(b []byte) (int, error) {
 	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.isClosed {
 		return 0, io.EOF
 	}
-	defer m.mu.Unlock()
 	m.writtenBytes += len(b)
 	return len(b), nil
 }
@@ -90,7 +98,9 @@ func (m *NetConnectionMock) Close() error {
 type MockWSDialer struct {
 	dialCalls   []string
 	connections []*NetConnectionMock
-	mu          sync.RWMutex
+	// refused is a URL whose dials fail.
+	refused string
+	mu      sync.RWMutex
 }
 
 func (m *MockWSDialer) Dial(ctx context.Context, urlstr string) (net.Conn, *bufio.Reader, ws.Handshake, error) {
@@ -98,6 +108,9 @@ func (m *MockWSDialer) Dial(ctx context.Context, urlstr string) (net.Conn, *bufi
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.dialCalls = append(m.dialCalls, urlstr)
+	if urlstr == m.refused {
+		return nil, nil, ws.Handshake{}, errors.New("connection refused")
+	}
 	mockConn := &NetConnectionMock{
 		remoteAddr:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080},
 		name:         urlstr,
@@ -110,7 +123,7 @@ func (m *MockWSDialer) Dial(ctx context.Context, urlstr string) (net.Conn, *bufi
 }
 
 func NewMockConnection(user, upstreamHost string, downstreamConn net.Conn, wsDialer *MockWSDialer) *connection.Connection {
-	tracker := connection.NewTracker(user, upstreamHost, "downstream", downstreamConn)
+	tracker := connection.NewTracker(user, route.TargetFromAddress(upstreamHost), "downstream", downstreamConn)
 	return &connection.Connection{
 		Tracker: tracker,
 		Proxier: connection.NewWSProxier(tracker, wsDialer),
@@ -119,9 +132,9 @@ func NewMockConnection(user, upstreamHost string, downstreamConn net.Conn, wsDia
 
 func TestHandleRebalanceLoop(t *testing.T) {
 	mockRouter := &MockRouter{
-		rebalanceChan: make(chan [][2]string, 1),
+		rebalanceChan: make(chan []route.RebalanceRequest, 1),
 	}
-	connections := make(map[string]*connection.Connection)
+	connections := connection.NewConnectionRegistry()
 
 	go handleRebalanceLoop(mockRouter, connections)
 
@@ -135,11 +148,14 @@ func TestHandleRebalanceLoop(t *testing.T) {
 		mockWSDialer := &MockWSDialer{}
 		mockConn := NewMockConnection("user1", "old-host:3000", mockDownstreamConn, mockWSDialer)
 		go mockConn.Handle()
-		connections[mockConn.Tracker.User()] = mockConn
+		connections.Add(mockConn)
 
-		mockConn.Tracker.UpstreamCancelChan() <- 1
 		time.Sleep(100 * time.Millisecond)
-		mockRouter.rebalanceChan <- [][2]string{{mockConn.Tracker.User(), "new-host:3000"}}
+		mockRouter.rebalanceChan <- []route.RebalanceRequest{{
+			RecipientId: mockConn.Tracker.User(),
+			Old:         route.TargetFromAddress("old-host:3000"),
+			New:         route.TargetFromAddress("new-host:3000"),
+		}}
 		time.Sleep(100 * time.Millisecond)
 
 		if mockConn.UpstreamHost() != "new-host:3000" {
@@ -156,23 +172,112 @@ func TestHandleRebalanceLoop(t *testing.T) {
 
 		writtenBytes := 0
 		for _, clientConnections := range mockWSDialer.connections {
+			clientConnections.mu.Lock()
 			writtenBytes += clientConnections.writtenBytes
+			clientConnections.mu.Unlock()
 		}
+		mockDownstreamConn.mu.Lock()
+		readBytes := mockDownstreamConn.readBytes
+		mockDownstreamConn.mu.Unlock()
 
 		if writtenBytes == 0 {
 			t.Errorf("Expected written bytes to be greater than 0, got %d", writtenBytes)
 			return
 		}
 
-		if mockDownstreamConn.readBytes == 0 {
-			t.Errorf("Expected read bytes to be greater than 0, got %d", mockDownstreamConn.readBytes)
+		if readBytes == 0 {
+			t.Errorf("Expected read bytes to be greater than 0, got %d", readBytes)
 			return
 		}
 
-		ratio := float64(writtenBytes) / float64(mockDownstreamConn.readBytes)
+		ratio := float64(writtenBytes) / float64(readBytes)
 		if ratio < 0.99 {
 			t.Errorf("Expected ratio of written bytes to read bytes to be greater than 0.99, got %f", ratio)
 		}
 	})
 
+	t.Run("Every device of the recipient is rebalanced", func(t *testing.T) {
+		mockWSDialer := &MockWSDialer{}
+		devices := make([]*connection.Connection, 0, 2)
+		for _, name := range []string{"phone", "laptop"} {
+			mockDownstreamConn := &NetConnectionMock{
+				remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080},
+				name:       name,
+			}
+			device := NewMockConnection("user2", "old-host:3000", mockDownstreamConn, mockWSDialer)
+			go device.Handle()
+			connections.Add(device)
+			devices = append(devices, device)
+		}
+		if n := len(connections.Get("user2")); n != 2 {
+			t.Fatalf("Expected both devices to be registered, got %d", n)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		mockRouter.rebalanceChan <- []route.RebalanceRequest{{
+			RecipientId: "user2",
+			Old:         route.TargetFromAddress("old-host:3000"),
+			New:         route.TargetFromAddress("new-host:3000"),
+		}}
+		// The devices are migrated one after the other.
+		deadline := time.Now().Add(5 * time.Second)
+		for devices[1].UpstreamHost() != "new-host:3000" && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		for _, device := range devices {
+			if device.UpstreamHost() != "new-host:3000" {
+				t.Errorf("Expected %s to move to new-host:3000, got %s", device.ID(), device.UpstreamHost())
+			}
+			device.Close()
+		}
+	})
+
+}
+
+// TrackingRouter records the recipients moved by the rebalance loop.
+type TrackingRouter struct {
+	MockRouter
+	moved chan route.Target
+}
+
+func (m *TrackingRouter) Track(string, route.Target) {}
+func (m *TrackingRouter) Forget(string)              {}
+func (m *TrackingRouter) Move(user string, t route.Target) {
+	m.moved <- t
+}
+
+func TestRebalanceMovesRecipientsOnceMigrated(t *testing.T) {
+	router := &TrackingRouter{
+		MockRouter: MockRouter{rebalanceChan: make(chan []route.RebalanceRequest, 1)},
+		moved:      make(chan route.Target, 1),
+	}
+	connections := connection.NewConnectionRegistry()
+	go handleRebalanceLoop(router, connections)
+	mockWSDialer := &MockWSDialer{refused: "ws://refused-host:3000"}
+	mockConn := NewMockConnection("user3", "old-host:3000", &NetConnectionMock{name: "downstream"}, mockWSDialer)
+	go mockConn.Handle()
+	connections.Add(mockConn)
+	defer mockConn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	router.rebalanceChan <- []route.RebalanceRequest{{RecipientId: "user3", New: route.TargetFromAddress("refused-host:3000")}}
+	select {
+	case moved := <-router.moved:
+		t.Fatalf("a failed migration must keep the recipient on its owner, moved to %v", moved)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if mockConn.UpstreamHost() != "old-host:3000" {
+		t.Fatalf("expected the connection to stay on old-host:3000, got %s", mockConn.UpstreamHost())
+	}
+
+	router.rebalanceChan <- []route.RebalanceRequest{{RecipientId: "user3", New: route.TargetFromAddress("new-host:3000")}}
+	select {
+	case moved := <-router.moved:
+		if moved.Address() != "new-host:3000" {
+			t.Fatalf("expected the recipient to move to new-host:3000, got %v", moved)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the recipient to move")
+	}
 }
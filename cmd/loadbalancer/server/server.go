@@ -3,20 +3,53 @@ package server
 import (
 	"log/slog"
 	"lukas8219/websocket-operator/cmd/loadbalancer/connection"
+	"lukas8219/websocket-operator/internal/identity"
+	"lukas8219/websocket-operator/internal/jwt"
 	"lukas8219/websocket-operator/internal/route"
 	"net/http"
 )
 
 type ServerConfig struct {
+	// Router routes every connection when Pools is empty.
 	Router route.RouterImpl
-	Port   string
+	// Pools are the upstream pools connections are matched against, in order.
+	Pools []Pool
+	Port  string
+	// Identity resolves the user of a connection, the ws-user-id header when nil.
+	Identity identity.Extractor
+	// Auth requires connections to carry a valid JWT, the user coming from its claim instead of
+	// Identity. Connections are closed when their token expires. Nil accepts every connection.
+	Auth *jwt.Authenticator
 }
 
 func StartServer(config ServerConfig) {
 	slog.Info("Starting load balancer server", "port", config.Port)
-	router := config.Router
-	connections := make(map[string]*connection.Connection) //TODO: This could be a broadcast instead of a single recipient/connection
-	go handleRebalanceLoop(router, connections)
+	pools := newPools(config)
+	for _, p := range pools {
+		go handleRebalanceLoop(p.Router, p.connections)
+	}
 	//TODO how to properly test this - aka not having a server running at all
-	http.ListenAndServe("0.0.0.0:"+config.Port, createHandler(router, connections))
+	http.ListenAndServe("0.0.0.0:"+config.Port, createHandler(pools, config.identity(), config.Auth))
+}
+
+func (config ServerConfig) identity() identity.Extractor {
+	if config.Identity == nil {
+		return identity.Header{Name: identity.DefaultHeader}
+	}
+	return config.Identity
+}
+
+func newPools(config ServerConfig) []*pool {
+	configured := config.Pools
+	if len(configured) == 0 {
+		configured = []Pool{{Name: DefaultPool, Router: config.Router}}
+	}
+	pools := make([]*pool, len(configured))
+	for i, p := range configured {
+		pools[i] = &pool{
+			Pool:        p,
+			connections: connection.NewConnectionRegistry(), //TODO: This could be a broadcast instead of a single recipient/connection
+		}
+	}
+	return pools
 }
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"lukas8219/websocket-operator/internal/identity"
+	"lukas8219/websocket-operator/internal/route"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// stressRouter places users on fixed targets and lets the test send rebalance requests.
+type stressRouter struct {
+	targets   []route.Target
+	rebalance chan []route.RebalanceRequest
+	*slog.Logger
+}
+
+func (r *stressRouter) owner(user string) int {
+	n := 0
+	for _, c := range user {
+		n += int(c)
+	}
+	return n % len(r.targets)
+}
+
+func (r *stressRouter) Route(user string) route.Target { return r.targets[r.owner(user)] }
+func (r *stressRouter) RouteN(user string, n int) []route.Target {
+	return []route.Target{r.Route(user)}
+}
+func (r *stressRouter) RebalanceRequests() <-chan []route.RebalanceRequest { return r.rebalance }
+func (r *stressRouter) InitializeHosts() error                             { return nil }
+func (r *stressRouter) Epoch() uint64                                      { return 0 }
+func (r *stressRouter) EpochHash() uint64                                  { return 0 }
+func (r *stressRouter) Snapshot() route.Snapshot                           { return route.Snapshot{} }
+
+// newStressSidecar serves websocket connections, discarding what they send.
+func newStressSidecar(t *testing.T) route.Target {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := wsutil.ReadClientData(conn); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return route.TargetFromAddress(strings.TrimPrefix(server.URL, "http://"))
+}
+
+func TestConcurrentConnectDisconnectAndRebalance(t *testing.T) {
+	router := &stressRouter{
+		targets:   []route.Target{newStressSidecar(t), newStressSidecar(t), newStressSidecar(t)},
+		rebalance: make(chan []route.RebalanceRequest),
+		Logger:    slog.Default(),
+	}
+	pools := newPools(ServerConfig{Router: router})
+	go handleRebalanceLoop(router, pools[0].connections)
+	loadbalancer := httptest.NewServer(createHandler(pools, identity.Header{Name: identity.DefaultHeader}, nil))
+	t.Cleanup(loadbalancer.Close)
+	url := strings.Replace(loadbalancer.URL, "http://", "ws://", 1)
+
+	const workers, iterations, users = 8, 20, 10
+	stop := make(chan struct{})
+	rebalanced := make(chan struct{})
+	go func() {
+		defer close(rebalanced)
+		for i := 0; ; i++ {
+			request := route.RebalanceRequest{
+				RecipientId: fmt.Sprintf("user-%d", i%users),
+				New:         router.targets[i%len(router.targets)],
+			}
+			select {
+			case router.rebalance <- []route.RebalanceRequest{request}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				user := fmt.Sprintf("user-%d", (w+i)%users)
+				dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP{"ws-user-id": []string{user}}}
+				conn, _, _, err := dialer.Dial(context.Background(), url)
+				if err != nil {
+					t.Errorf("%s failed to connect: %v", user, err)
+					return
+				}
+				// Messages are spread over a few milliseconds so rebalances hit open connections.
+				for m := 0; m < 5; m++ {
+					if err := wsutil.WriteClientText(conn, []byte(fmt.Sprintf("message-%d", m))); err != nil {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				conn.Close()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	<-rebalanced
+
+	deadline := time.Now().Add(10 * time.Second)
+	for pools[0].connections.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected every closed connection to be removed, %d left", pools[0].connections.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
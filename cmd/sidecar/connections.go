@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/gobwas/ws"
+)
+
+// connectionSet holds the local connections of every user, a user having one per device. It is safe
+// for concurrent use.
+type connectionSet struct {
+	mu    sync.RWMutex
+	users map[string]map[string]*ConnectionTracker
+}
+
+func newConnectionSet() *connectionSet {
+	return &connectionSet{users: make(map[string]map[string]*ConnectionTracker)}
+}
+
+func (s *connectionSet) add(c *ConnectionTracker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := s.users[c.user]
+	if devices == nil {
+		devices = make(map[string]*ConnectionTracker)
+		s.users[c.user] = devices
+	}
+	devices[c.id] = c
+}
+
+// remove unregisters c, leaving the other devices of its user.
+func (s *connectionSet) remove(c *ConnectionTracker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := s.users[c.user]
+	if devices[c.id] != c {
+		return
+	}
+	delete(devices, c.id)
+	if len(devices) == 0 {
+		delete(s.users, c.user)
+	}
+}
+
+// get returns the connections of user, empty when none is local.
+func (s *connectionSet) get(user string) []*ConnectionTracker {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	devices := make([]*ConnectionTracker, 0, len(s.users[user]))
+	for _, c := range s.users[user] {
+		devices = append(devices, c)
+	}
+	return devices
+}
+
+// deliver writes a message to every device of a user. A device failing doesn't stop delivery to the
+// others, it is logged and left to its own proxy loop to close. It returns how many devices got it.
+func deliver(devices []*ConnectionTracker, op ws.OpCode, msg []byte) int {
+	delivered := 0
+	for _, device := range devices {
+		if err := device.writeUpstream(op, msg); err != nil {
+			device.Error("Failed to deliver message to device", "error", err)
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
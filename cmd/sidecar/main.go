@@ -7,36 +7,51 @@ import (
 	"io"
 	"log/slog"
 	"lukas8219/websocket-operator/cmd/sidecar/proxy"
+	"lukas8219/websocket-operator/internal/identity"
 	"lukas8219/websocket-operator/internal/logger"
+	"lukas8219/websocket-operator/internal/metrics"
+	"lukas8219/websocket-operator/internal/route"
 	"net"
 	"net/http"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 )
 
 type ConnectionTracker struct {
+	id             string
 	user           string
 	upstreamHost   string
 	downstreamHost string
 	upstreamConn   net.Conn
 	downstreamConn net.Conn
+	// writeMu serializes the messages of the user's own client and of other users written upstream.
+	writeMu sync.Mutex
+}
+
+// writeUpstream writes a client message to the local application.
+func (c *ConnectionTracker) writeUpstream(op ws.OpCode, msg []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return wsutil.WriteClientMessage(c.upstreamConn, op, msg)
 }
 
 func (c *ConnectionTracker) Info(message string, args ...any) *ConnectionTracker {
-	slog.With("user", c.user).With("upstreamHost", c.upstreamHost).With("downstreamHost", c.downstreamHost).With("component", "connection-tracker").Info(message, args...)
+	slog.With("user", c.user).With("connectionId", c.id).With("upstreamHost", c.upstreamHost).With("downstreamHost", c.downstreamHost).With("component", "connection-tracker").Info(message, args...)
 	return c
 }
 
 func (c *ConnectionTracker) Error(message string, args ...any) *ConnectionTracker {
-	slog.With("user", c.user).With("upstreamHost", c.upstreamHost).With("downstreamHost", c.downstreamHost).With("component", "connection-tracker").Error(message, args...)
+	slog.With("user", c.user).With("connectionId", c.id).With("upstreamHost", c.upstreamHost).With("downstreamHost", c.downstreamHost).With("component", "connection-tracker").Error(message, args...)
 	return c
 }
 
 func (c *ConnectionTracker) Debug(message string, args ...any) *ConnectionTracker {
-	slog.With("user", c.user).With("upstreamHost", c.upstreamHost).With("downstreamHost", c.downstreamHost).With("component", "connection-tracker").Debug(message, args...)
+	slog.With("user", c.user).With("connectionId", c.id).With("upstreamHost", c.upstreamHost).With("downstreamHost", c.downstreamHost).With("component", "connection-tracker").Debug(message, args...)
 	return c
 }
 
@@ -51,27 +66,78 @@ var incomingMessageStruct = reflect.StructOf([]reflect.StructField{
 func main() {
 	port := flag.String("port", "3000", "Port to listen on")
 	targetPort := flag.String("targetPort", "3001", "Port to target")
-	mode := flag.String("mode", "kubernetes", "Mode to use")
+	mode := flag.String("mode", "kubernetes", "Router mode to use, one of "+strings.Join(route.Modes(), ", "))
 	debug := flag.Bool("debug", false, "Debug mode")
+	replicas := flag.Int("replicas", 1, "Number of ranked sidecars a routed message is sent to")
+	identitySpec := flag.String("identity", os.Getenv("WS_OPERATOR_IDENTITY"), "Comma-separated sources the user id of a client connecting directly is read from, in order: header:<name>, query:<name>, cookie:<name>, subprotocol:<prefix> or jwt:<claim>[:<source>]. Defaults to header:ws-user-id")
+	trustForwarded := flag.Bool("trustForwardedIdentity", false, "Trust the user id the load balancer forwards in the "+identity.TrustedHeader+" header. Only enable it when clients reach the sidecar through the load balancer, anyone else could claim to be any user")
+	metaFlags := route.BindMetaFlags(flag.CommandLine)
 	flag.Parse()
 	logger.SetupLogger(*debug)
-	proxy.InitializeProxy(*mode)
+	meta, err := metaFlags.Meta()
+	if err != nil {
+		slog.Error("Invalid router configuration", "error", err)
+		os.Exit(1)
+	}
+	extractor, err := identity.Parse(*identitySpec)
+	if err != nil {
+		slog.Error("Invalid identity source", "identity", *identitySpec, "error", err)
+		os.Exit(1)
+	}
+	if *trustForwarded {
+		extractor = identity.Forwarded{Next: extractor}
+	}
+	// In gossip mode the sidecar advertises itself, on the pod IP in a cluster and on localhost otherwise.
+	if meta.Gossip.Host == "" {
+		podIP := os.Getenv("POD_IP")
+		if podIP == "" {
+			podIP = "127.0.0.1"
+		}
+		meta.Gossip.Host = net.JoinHostPort(podIP, *port)
+	}
+	// Users are placed in the zone of the load balancer they came through, so the sidecar doesn't prefer
+	// its own zone and tries the placement candidates in ranking order instead.
+	meta.Zone.RankOnly = true
+	proxy.InitializeProxy(route.RouterConfig{
+		Mode:       route.RouterConfigMode(*mode),
+		ConfigMeta: meta,
+	}, *replicas)
+	hasherInfo, err := json.Marshal(route.NewHasherInfo(meta))
+	if err != nil {
+		slog.Error("Failed to encode hasher info", "error", err)
+		os.Exit(1)
+	}
 	slog.Info("Starting server", "port", *port)
-	// Map to store active WebSocket connections
-	// Key: user ID, Value: ConnectionTracker
-	connections := make(map[string]*ConnectionTracker)
+	// Active WebSocket connections, by user ID and connection ID
+	connections := newConnectionSet()
+	metricsHandler := metrics.Handler()
+	snapshotHandler := route.SnapshotHandler(proxy.Router())
 	http.ListenAndServe("0.0.0.0:"+*port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		slog.Debug("Request received", "method", r.Method, "path", r.URL.Path)
+		if r.Method == http.MethodGet && r.URL.Path == metrics.Path {
+			metricsHandler.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == route.SnapshotPath {
+			snapshotHandler.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == route.HasherPath {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(hasherInfo)
+			return
+		}
+		w.Header().Set(route.EpochHeader, route.FormatEpoch(proxy.EpochHash()))
 		if r.Method == http.MethodPost && r.URL.Path == "/message" {
-			if connections[r.Header.Get("ws-user-id")] == nil {
-				slog.Debug("No recipient found in-memory", "user", r.Header.Get("ws-user-id"))
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
 			userId := r.Header.Get("ws-user-id")
-			connectionTracker := connections[userId]
-			if connectionTracker == nil {
-				slog.Debug("No connection found", "userId", userId)
+			devices := connections.get(userId)
+			if len(devices) == 0 {
+				if owner, ok := proxy.OwnerRedirect(r, r.Header.Get("ws-user-id")); ok {
+					slog.Debug("Redirecting message to owner", "user", r.Header.Get("ws-user-id"), "owner", owner)
+					http.Redirect(w, r, owner.HTTPURL("/message"), http.StatusTemporaryRedirect)
+					return
+				}
+				slog.Debug("No recipient found in-memory", "user", r.Header.Get("ws-user-id"))
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
@@ -84,47 +150,64 @@ func main() {
 
 			opCode := ws.OpCode(body[0])
 			message := body[1:]
-			slog.Debug("Writing message to client", "userId", userId, "opCode", opCode, "message", string(message))
-			err = wsutil.WriteClientMessage(connectionTracker.upstreamConn, opCode, message)
-			if err != nil {
-				slog.Error("Failed to write WebSocket message", "error", err)
+			slog.Debug("Writing message to client", "userId", userId, "devices", len(devices), "opCode", opCode, "message", string(message))
+			if deliver(devices, opCode, message) == 0 {
+				slog.Error("Failed to write WebSocket message to any device", "userId", userId)
+				w.WriteHeader(http.StatusBadGateway)
 				return
 			}
 			return
 		}
-		user := r.Header.Get("ws-user-id")
-		if user == "" {
-			slog.Debug("No user id provided")
+		user, err := extractor.Extract(r)
+		if err != nil {
+			slog.Debug("No user id provided", "error", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 		slog := slog.With("recipientId", user)
+		if owner, ok := proxy.OwnerRedirect(r, user); ok {
+			slog.Info("Redirecting connection to owner", "owner", owner)
+			w.Header().Set("Location", owner.WebSocketURL(""))
+			w.WriteHeader(http.StatusTemporaryRedirect)
+			return
+		}
 		w.Header().Set("x-ws-operator-instance", os.Getenv("HOSTNAME"))
 		slog.Info("New connection")
 		slog.Debug("Upgrading HTTP connection")
-		clientConn, _, _, err := ws.UpgradeHTTP(r, w)
+		upgrader := ws.HTTPUpgrader{Protocol: identity.Protocol(extractor)}
+		clientConn, _, _, err := upgrader.Upgrade(r, w)
 		if err != nil {
 			slog.Error("Failed to upgrade HTTP connection", "error", err)
 			return
 		}
+		connectionId := r.Header.Get(route.ConnectionIdHeader)
+		if connectionId == "" {
+			connectionId = route.NewConnectionId()
+		}
 		slog.Debug("Dialing proxied connection")
-		proxiedConn, _, _, err := ws.Dial(context.Background(), "ws://localhost:"+*targetPort)
+		// The application learns who the connection belongs to from the identity resolved here.
+		dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP{
+			identity.TrustedHeader:   []string{user},
+			route.ConnectionIdHeader: []string{connectionId},
+		}}
+		proxiedConn, _, _, err := dialer.Dial(context.Background(), "ws://localhost:"+*targetPort)
 		connectionTracker := &ConnectionTracker{
+			id:             connectionId,
 			user:           user,
 			upstreamHost:   "localhost:" + *targetPort,
 			downstreamHost: r.RemoteAddr,
 			upstreamConn:   proxiedConn,
 			downstreamConn: clientConn,
 		}
-		connections[user] = connectionTracker
 		if err != nil {
 			connectionTracker.Error("Failed to dial proxied connection", "error", err)
 			clientConn.Close()
 			return
 		}
+		connections.add(connectionTracker)
 		//TODO no good here
 		closeConnections := func() {
-			connections[user] = nil
+			connections.remove(connectionTracker)
 			connectionTracker.downstreamConn.Close()
 			connectionTracker.upstreamConn.Close()
 		}
@@ -160,7 +243,7 @@ func proxySidecarServerToClient(deferClose func(), connectionTracker *Connection
 }
 
 // TODO functions is doing too much. Split into smaller modules
-func handleIncomingMessagesToProxy(connections map[string]*ConnectionTracker, deferClose func(), connectionTracker *ConnectionTracker) {
+func handleIncomingMessagesToProxy(connections *connectionSet, deferClose func(), connectionTracker *ConnectionTracker) {
 	defer deferClose()
 	for {
 		msg, op, err := wsutil.ReadClientData(connectionTracker.downstreamConn)
@@ -185,10 +268,10 @@ func handleIncomingMessagesToProxy(connections map[string]*ConnectionTracker, de
 			return
 		}
 
-		recipientConnection := connections[recipientIdString]
+		recipientDevices := connections.get(recipientIdString)
 
-		slog.Debug("Message recipient", "recipientId", recipientIdString, "recipientConnection", recipientConnection)
-		if recipientConnection == nil {
+		slog.Debug("Message recipient", "recipientId", recipientIdString, "devices", len(recipientDevices))
+		if len(recipientDevices) == 0 {
 			slog.Debug("No recipient found in-memory. Routing message to the correct target.", "recipientId", recipientIdString)
 			err := proxy.SendProxiedMessage(recipientIdString, msg, op)
 			if err != nil {
@@ -197,10 +280,9 @@ func handleIncomingMessagesToProxy(connections map[string]*ConnectionTracker, de
 			continue
 		}
 
-		err = wsutil.WriteClientMessage(recipientConnection.upstreamConn, op, msg)
-		if err != nil {
-			connectionTracker.Error("Failed to write to client", "error", err, "recipientId", recipientIdString)
-			return
+		//every device of the recipient gets the message, a failing one is closed by its own proxy loop
+		if deliver(recipientDevices, op, msg) == 0 {
+			connectionTracker.Error("Failed to write to client", "recipientId", recipientIdString)
 		}
 		if op == ws.OpClose {
 			connectionTracker.Info("Client closed connection")
@@ -4,40 +4,105 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"lukas8219/websocket-operator/internal/route"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/gobwas/ws"
 )
 
+const maxRedirects = 3
+
 var (
 	router route.RouterImpl
+	// client follows the redirects answered by sidecars routing with a different membership epoch.
+	client = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many owner redirects")
+			}
+			return nil
+		},
+	}
+	// replicas is how many ranked sidecars a proxied message is fanned out to.
+	replicas = 1
+	// candidates is how many ranked sidecars a recipient may be placed on. With bounded load the
+	// sidecar has no load information, so messages look for the owner among all of them.
+	candidates = 1
 )
 
-func InitializeProxy(mode string) {
-	router = route.NewRouter(route.RouterConfig{Mode: route.RouterConfigMode(mode)})
-	err := router.InitializeHosts()
+// InitializeProxy creates the router used to find the sidecar owning a recipient.
+func InitializeProxy(config route.RouterConfig, messageReplicas int) {
+	if messageReplicas > 0 {
+		replicas = messageReplicas
+	}
+	candidates = route.MetaFromConfig(config).Candidates()
+	var err error
+	router, err = route.NewRouter(config)
+	if err != nil {
+		slog.Error("Failed to create router", "error", err)
+		os.Exit(1)
+	}
+	err = router.InitializeHosts()
 	if err != nil {
 		slog.Error("failed to initialize hosts", "error", err)
 		//TODO should we panic here?
 	}
+	// The sidecar doesn't hold connections to other sidecars' users, so rebalance requests
+	// are drained to keep the router from blocking on them.
+	go func() {
+		for range router.RebalanceRequests() {
+		}
+	}()
+	go route.WatchHasherAgreement(router, route.MetaFromConfig(config), route.DefaultHasherCheckInterval)
 }
 
+// SendProxiedMessage routes the message to the ranked owners of the recipient. The ranking is walked
+// until replicas sidecars accepted it, a sidecar the recipient isn't connected to answering 404, so a
+// recipient the load balancer fell back to a lower-ranked sidecar is still reached. A sidecar answering
+// any other non-2xx status is skipped the same way.
 func SendProxiedMessage(recipientId string, message []byte, opCode ws.OpCode) error {
-	host := router.Route(recipientId)
-	slog := slog.With("recipientId", recipientId).With("opCode", opCode).With("host", host).With("component", "proxy")
-	if host == "" {
+	// Past the replicas the ranking holds the targets the load balancer falls back to.
+	targets := router.RouteN(recipientId, max(replicas+route.FailoverTargets-1, candidates))
+	if len(targets) == 0 {
+		slog.With("recipientId", recipientId).With("component", "proxy").Error("no host found")
+		return errors.New("no host found")
+	}
+	messageWithOpCode := append([]byte{byte(opCode)}, message...)
+	var errs []error
+	delivered := 0
+	for _, upstream := range targets {
+		err := sendToTarget(upstream, recipientId, messageWithOpCode, opCode)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delivered++
+		if delivered == replicas {
+			break
+		}
+	}
+	if delivered == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func sendToTarget(upstream route.Target, recipientId string, messageWithOpCode []byte, opCode ws.OpCode) error {
+	slog := slog.With("recipientId", recipientId).With("opCode", opCode).With("target", upstream).With("component", "proxy")
+	if upstream.IsZero() {
 		slog.Error("no host found")
 		return errors.New("no host found")
 	}
 	slog.Debug("Routing message")
+	route.CountMessageHop(router, upstream)
 	//TODO hardcoded 5 seconds to debug DNS resolve issues
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
-	messageWithOpCode := append([]byte{byte(opCode)}, message...)
-	url := "http://" + host + "/message"
+	url := upstream.HTTPURL("/message")
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(messageWithOpCode))
 	if err != nil {
 		slog.Error("failed to create request", "error", err)
@@ -45,14 +110,38 @@ func SendProxiedMessage(recipientId string, message []byte, opCode ws.OpCode) er
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("ws-user-id", recipientId)
+	req.Header.Set(route.EpochHeader, route.FormatEpoch(router.EpochHash()))
 
 	slog.Debug("POST request", "url", url)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		slog.Error("Error sending request", "error", err)
 		return err
 	}
 	slog.Debug("Received response", "status", resp.Status)
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("recipient not connected to %s", upstream.Address())
+	}
+	// Any other failure, like a sidecar shutting down or overloaded, moves on to the next ranked target.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.Error("Sidecar failed the message", "status", resp.Status)
+		return fmt.Errorf("%s answered %s", upstream.Address(), resp.Status)
+	}
 	return nil
 }
+
+// OwnerRedirect returns the owner a request for a recipient that isn't connected here should be redirected to.
+func OwnerRedirect(r *http.Request, recipientId string) (route.Target, bool) {
+	return route.OwnerRedirect(router, r, recipientId, candidates)
+}
+
+// EpochHash identifies the members the sidecar routes with.
+func EpochHash() uint64 {
+	return router.EpochHash()
+}
+
+// Router returns the router created by InitializeProxy.
+func Router() route.RouterImpl {
+	return router
+}
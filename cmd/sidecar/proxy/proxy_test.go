@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"log/slog"
+	"lukas8219/websocket-operator/internal/route"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+// rankedRouter ranks the same targets for every recipient.
+type rankedRouter struct {
+	targets []route.Target
+	*slog.Logger
+}
+
+func (r *rankedRouter) Route(recipientId string) route.Target { return r.targets[0] }
+func (r *rankedRouter) RouteN(recipientId string, n int) []route.Target {
+	return r.targets[:min(n, len(r.targets))]
+}
+func (r *rankedRouter) RebalanceRequests() <-chan []route.RebalanceRequest { return nil }
+func (r *rankedRouter) InitializeHosts() error                             { return nil }
+func (r *rankedRouter) Epoch() uint64                                      { return 0 }
+func (r *rankedRouter) EpochHash() uint64                                  { return 0 }
+func (r *rankedRouter) Snapshot() route.Snapshot                           { return route.Snapshot{} }
+
+// newTestSidecar answers POST /message with status, like 404 for a sidecar the recipient isn't connected to,
+// counting the messages it accepted.
+func newTestSidecar(t *testing.T, status int) (route.Target, *atomic.Int32) {
+	accepted := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		accepted.Add(1)
+	}))
+	t.Cleanup(server.Close)
+	return route.TargetFromAddress(strings.TrimPrefix(server.URL, "http://")), accepted
+}
+
+func useRouter(t *testing.T, messageReplicas int, targets ...route.Target) {
+	previousRouter, previousReplicas := router, replicas
+	router, replicas = &rankedRouter{targets: targets, Logger: slog.Default()}, messageReplicas
+	t.Cleanup(func() { router, replicas = previousRouter, previousReplicas })
+}
+
+func TestSendProxiedMessageReachesTheFallbackOwner(t *testing.T) {
+	owner, ownerAccepted := newTestSidecar(t, http.StatusNotFound)
+	fallback, fallbackAccepted := newTestSidecar(t, http.StatusOK)
+	useRouter(t, 1, owner, fallback)
+	if err := SendProxiedMessage("alice", []byte("hello"), ws.OpText); err != nil {
+		t.Fatal(err)
+	}
+	if ownerAccepted.Load() != 0 || fallbackAccepted.Load() != 1 {
+		t.Fatalf("expected the fallback sidecar to accept the message, owner %d fallback %d", ownerAccepted.Load(), fallbackAccepted.Load())
+	}
+
+	notConnected, _ := newTestSidecar(t, http.StatusNotFound)
+	useRouter(t, 1, owner, notConnected)
+	if err := SendProxiedMessage("alice", []byte("hello"), ws.OpText); err == nil {
+		t.Fatal("expected an error when no sidecar has the recipient")
+	}
+}
+
+func TestSendProxiedMessageStopsAtTheOwner(t *testing.T) {
+	owner, ownerAccepted := newTestSidecar(t, http.StatusOK)
+	fallback, fallbackAccepted := newTestSidecar(t, http.StatusOK)
+	useRouter(t, 1, owner, fallback)
+	if err := SendProxiedMessage("alice", []byte("hello"), ws.OpText); err != nil {
+		t.Fatal(err)
+	}
+	if ownerAccepted.Load() != 1 || fallbackAccepted.Load() != 0 {
+		t.Fatalf("expected only the owner to receive the message, owner %d fallback %d", ownerAccepted.Load(), fallbackAccepted.Load())
+	}
+}
+
+func TestSendProxiedMessageFansOutToReplicas(t *testing.T) {
+	first, firstAccepted := newTestSidecar(t, http.StatusOK)
+	missing, _ := newTestSidecar(t, http.StatusNotFound)
+	second, secondAccepted := newTestSidecar(t, http.StatusOK)
+	third, thirdAccepted := newTestSidecar(t, http.StatusOK)
+	useRouter(t, 2, first, missing, second, third)
+	if err := SendProxiedMessage("alice", []byte("hello"), ws.OpText); err != nil {
+		t.Fatal(err)
+	}
+	if firstAccepted.Load() != 1 || secondAccepted.Load() != 1 || thirdAccepted.Load() != 0 {
+		t.Fatalf("expected the message on two replicas, got %d %d %d", firstAccepted.Load(), secondAccepted.Load(), thirdAccepted.Load())
+	}
+}
+
+func TestSendProxiedMessageSkipsFailingSidecars(t *testing.T) {
+	for _, status := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusInternalServerError} {
+		failing, _ := newTestSidecar(t, status)
+		fallback, fallbackAccepted := newTestSidecar(t, http.StatusOK)
+		useRouter(t, 1, failing, fallback)
+		if err := SendProxiedMessage("alice", []byte("hello"), ws.OpText); err != nil {
+			t.Fatal(err)
+		}
+		if fallbackAccepted.Load() != 1 {
+			t.Fatalf("expected the next sidecar to accept the message after a %d", status)
+		}
+	}
+	failing, _ := newTestSidecar(t, http.StatusServiceUnavailable)
+	useRouter(t, 1, failing)
+	if err := SendProxiedMessage("alice", []byte("hello"), ws.OpText); err == nil {
+		t.Fatal("expected an error when every sidecar failed")
+	}
+}
@@ -0,0 +1,243 @@
+package balancer
+
+import (
+	"fmt"
+	"lukas8219/websocket-operator/internal/rendezvous"
+)
+
+// Balancer maps keys to members. Every component routing the same keys must use the same
+// algorithm and hasher so they agree on the owner of a key.
+type Balancer interface {
+	Add(member string)
+	Remove(member string)
+	Lookup(key string) string
+	// LookupN returns up to n distinct members ranked for the key, the first one being Lookup.
+	LookupN(key string, n int) []string
+	Members() []string
+}
+
+const (
+	AlgorithmRendezvous = "rendezvous"
+	AlgorithmRing       = "ring"
+	AlgorithmMaglev     = "maglev"
+	AlgorithmJump       = "jump"
+)
+
+// Algorithms lists the algorithms New accepts.
+var Algorithms = []string{AlgorithmRendezvous, AlgorithmRing, AlgorithmMaglev, AlgorithmJump}
+
+// Dynamic reports whether algorithm moves few keys on any membership change, which routers whose
+// members come and go need. Jump only does when the member changing sorts last, so it is limited to
+// fixed hosts.
+func Dynamic(algorithm string) bool {
+	return algorithm != AlgorithmJump
+}
+
+// New creates an empty balancer for algorithm. Weights, bounded load and zones are only
+// honored by rendezvous, the other algorithms use the hasher and ignore the rest of config.
+func New(algorithm string, config rendezvous.Config) (Balancer, error) {
+	hasher := config.Hasher
+	if hasher == nil {
+		hasher = &rendezvous.DefaultHasher{}
+	}
+	switch algorithm {
+	case "", AlgorithmRendezvous:
+		return rendezvous.New([]rendezvous.WeightedMember{}, config), nil
+	case AlgorithmRing:
+		return NewRing(hasher), nil
+	case AlgorithmMaglev:
+		return NewMaglev(hasher, DefaultMaglevTableSize), nil
+	case AlgorithmJump:
+		return NewJump(hasher), nil
+	default:
+		return nil, fmt.Errorf("unknown balancer algorithm %q, expected one of %v", algorithm, Algorithms)
+	}
+}
+
+// rebuilder is implemented by balancers that can create a copy of themselves with other members.
+// It is used to diff memberships for algorithms without an incremental Diff.
+type rebuilder interface {
+	rebuild(members []string) Balancer
+}
+
+// AddMember adds a weighted member, dropping the weight and zone when b doesn't support them.
+func AddMember(b Balancer, member rendezvous.WeightedMember) {
+	if weighted, ok := b.(interface {
+		AddMember(rendezvous.WeightedMember)
+	}); ok {
+		weighted.AddMember(member)
+		return
+	}
+	b.Add(member.Member())
+}
+
+// UpdateWeight changes the weight of a member. It returns false when the weight didn't change
+// or b doesn't support weights.
+func UpdateWeight(b Balancer, member string, weight float64) bool {
+	if weighted, ok := b.(interface {
+		UpdateWeight(string, float64) bool
+	}); ok {
+		return weighted.UpdateWeight(member, weight)
+	}
+	return false
+}
+
+// Nodes returns the weighted members of b. Balancers without weights report DefaultWeight.
+func Nodes(b Balancer) []rendezvous.WeightedMember {
+	if weighted, ok := b.(interface {
+		GetNodes() []rendezvous.WeightedMember
+	}); ok {
+		return weighted.GetNodes()
+	}
+	members := b.Members()
+	nodes := make([]rendezvous.WeightedMember, len(members))
+	for i, member := range members {
+		nodes[i] = rendezvous.NewWeightedMember(member, rendezvous.DefaultWeight)
+	}
+	return nodes
+}
+
+// PlaceN returns up to n ranked members for a new key. It is LookupN unless b does load or zone aware placement.
+func PlaceN(b Balancer, key string, n int) []string {
+	if placer, ok := b.(interface {
+		PlaceN(string, int) []string
+	}); ok {
+		return placer.PlaceN(key, n)
+	}
+	return b.LookupN(key, n)
+}
+
+// Place returns the member a new key should be placed on.
+func Place(b Balancer, key string) string {
+	placed := PlaceN(b, key, 1)
+	if len(placed) == 0 {
+		return ""
+	}
+	return placed[0]
+}
+
+// SetLoads reports the current number of keys per member to balancers doing bounded-load placement.
+func SetLoads(b Balancer, loads map[string]int) {
+	if bounded, ok := b.(interface {
+		SetLoads(map[string]int)
+	}); ok {
+		bounded.SetLoads(loads)
+	}
+}
+
+// Diff returns the keys of owners whose owner changes when the membership goes from oldMembers to newMembers.
+// Balancers without an incremental Diff look every key up again in a copy holding newMembers.
+func Diff(b Balancer, oldMembers, newMembers []rendezvous.WeightedMember, owners map[string]string) []rendezvous.KeyMove {
+	if differ, ok := b.(interface {
+		Diff([]rendezvous.WeightedMember, []rendezvous.WeightedMember, map[string]string) []rendezvous.KeyMove
+	}); ok {
+		return differ.Diff(oldMembers, newMembers, owners)
+	}
+	rebuilder, ok := b.(rebuilder)
+	if !ok {
+		return nil
+	}
+	names := make([]string, len(newMembers))
+	for i, member := range newMembers {
+		names[i] = member.Member()
+	}
+	next := rebuilder.rebuild(names)
+	moves := make([]rendezvous.KeyMove, 0)
+	for key, owner := range owners {
+		if newOwner := next.Lookup(key); newOwner != owner {
+			moves = append(moves, rendezvous.KeyMove{Key: key, OldOwner: owner, NewOwner: newOwner})
+		}
+	}
+	return moves
+}
+
+type zoned interface {
+	LocalZone() string
+	SetLocalZone(string)
+	Zone(string) string
+}
+
+// LocalZone returns the zone b prefers, empty when b isn't zone aware.
+func LocalZone(b Balancer) string {
+	if z, ok := b.(zoned); ok {
+		return z.LocalZone()
+	}
+	return ""
+}
+
+// SetLocalZone sets the zone b prefers. It does nothing when b isn't zone aware.
+func SetLocalZone(b Balancer, zone string) {
+	if z, ok := b.(zoned); ok {
+		z.SetLocalZone(zone)
+	}
+}
+
+// Zone returns the zone of member, empty when unknown or b isn't zone aware.
+func Zone(b Balancer, member string) string {
+	if z, ok := b.(zoned); ok {
+		return z.Zone(member)
+	}
+	return ""
+}
+
+// SameMembers reports whether both member sets hold the same members with the same weights.
+func SameMembers(a, b []rendezvous.WeightedMember) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	weights := make(map[string]float64, len(a))
+	for _, member := range a {
+		weights[member.Member()] = member.Weight()
+	}
+	for _, member := range b {
+		if weight, ok := weights[member.Member()]; !ok || weight != member.Weight() {
+			return false
+		}
+	}
+	return true
+}
+
+// SetMembers changes the members of b to members. Members already in b are kept, with their weight updated.
+// Balancers rebuilding their state on every change, like maglev, have it replaced at once.
+func SetMembers(b Balancer, members []rendezvous.WeightedMember) {
+	if replacer, ok := b.(interface {
+		SetMembers([]string)
+	}); ok {
+		names := make([]string, len(members))
+		for i, member := range members {
+			names[i] = member.Member()
+		}
+		replacer.SetMembers(names)
+		return
+	}
+	current := make(map[string]bool)
+	for _, member := range b.Members() {
+		current[member] = true
+	}
+	next := make(map[string]bool, len(members))
+	for _, member := range members {
+		next[member.Member()] = true
+	}
+	for member := range current {
+		if !next[member] {
+			b.Remove(member)
+		}
+	}
+	for _, member := range members {
+		if current[member.Member()] {
+			UpdateWeight(b, member.Member(), member.Weight())
+		} else {
+			AddMember(b, member)
+		}
+	}
+}
+
+// mix64 is the murmur3 64-bit finalizer, used to derive independent hashes from one key hash.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,205 @@
+package balancer
+
+import (
+	"fmt"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"math"
+	"testing"
+)
+
+const (
+	testMembers = 10
+	testKeys    = 50000
+)
+
+func newBalancer(t *testing.T, algorithm string, members int) Balancer {
+	t.Helper()
+	b, err := New(algorithm, rendezvous.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < members; i++ {
+		b.Add(fmt.Sprintf("10.0.0.%d:3000", i))
+	}
+	return b
+}
+
+func owners(b Balancer) map[string]string {
+	owners := make(map[string]string, testKeys)
+	for i := 0; i < testKeys; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		owners[key] = b.Lookup(key)
+	}
+	return owners
+}
+
+func TestUniformity(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			b := newBalancer(t, algorithm, testMembers)
+			counts := make(map[string]int)
+			for _, owner := range owners(b) {
+				counts[owner]++
+			}
+			if len(counts) != testMembers {
+				t.Fatalf("expected keys on %d members, got %d", testMembers, len(counts))
+			}
+			mean := float64(testKeys) / testMembers
+			for member, count := range counts {
+				if deviation := math.Abs(float64(count)-mean) / mean; deviation > 0.15 {
+					t.Errorf("%s owns %d keys, %.0f%% away from the mean %.0f", member, count, deviation*100, mean)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupNStartsWithLookup(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			b := newBalancer(t, algorithm, testMembers)
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("user-%d", i)
+				ranked := b.LookupN(key, 3)
+				if len(ranked) != 3 || ranked[0] != b.Lookup(key) {
+					t.Fatalf("LookupN(%s) = %v does not start with Lookup = %s", key, ranked, b.Lookup(key))
+				}
+				if ranked[0] == ranked[1] || ranked[1] == ranked[2] || ranked[0] == ranked[2] {
+					t.Fatalf("LookupN(%s) = %v has duplicates", key, ranked)
+				}
+			}
+			if got := b.LookupN("user", testMembers+5); len(got) != testMembers {
+				t.Fatalf("expected LookupN to be capped to %d members, got %d", testMembers, len(got))
+			}
+		})
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			b := newBalancer(t, algorithm, 1)
+			b.Remove("10.0.0.0:3000")
+			if got := b.Lookup("user"); got != "" {
+				t.Fatalf("expected no owner, got %s", got)
+			}
+			if got := b.LookupN("user", 2); len(got) != 0 {
+				t.Fatalf("expected no owners, got %v", got)
+			}
+		})
+	}
+}
+
+// TestMinimalDisruption checks that removing or adding a member moves few keys besides the
+// ones it owned or now owns. Jump hash is only minimal when the member sorts last, which is why it
+// isn't Dynamic.
+func TestMinimalDisruption(t *testing.T) {
+	// Extra keys moved, as a share of all keys, on top of the ones that had to move.
+	tolerance := map[string]float64{
+		AlgorithmRendezvous: 0,
+		AlgorithmRing:       0.05,
+		AlgorithmMaglev:     0.02,
+		AlgorithmJump:       0,
+	}
+	first, middle, last := "10.0.0.0:3000", fmt.Sprintf("10.0.0.%d:3000", testMembers/2), fmt.Sprintf("10.0.0.%d:3000", testMembers-1)
+	for _, algorithm := range Algorithms {
+		changes := []string{first, middle, last}
+		if !Dynamic(algorithm) {
+			changes = []string{last}
+		}
+		for _, changed := range changes {
+			t.Run(algorithm+"/"+changed, func(t *testing.T) {
+				b := newBalancer(t, algorithm, testMembers)
+				before := owners(b)
+
+				b.Remove(changed)
+				removed := owners(b)
+				orphaned, moved := 0, 0
+				for key, owner := range before {
+					if owner == changed {
+						orphaned++
+					}
+					if removed[key] != owner {
+						moved++
+					}
+				}
+				if extra := float64(moved-orphaned) / testKeys; extra > tolerance[algorithm] {
+					t.Errorf("remove moved %d keys for %d orphaned", moved, orphaned)
+				}
+
+				b.Add(changed)
+				added := owners(b)
+				gained, moved := 0, 0
+				for key, owner := range removed {
+					if added[key] == changed {
+						gained++
+					}
+					if added[key] != owner {
+						moved++
+					}
+				}
+				if extra := float64(moved-gained) / testKeys; extra > tolerance[algorithm] {
+					t.Errorf("add moved %d keys for %d gained", moved, gained)
+				}
+			})
+		}
+	}
+}
+
+func TestDiffMatchesLookup(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			b := newBalancer(t, algorithm, testMembers)
+			before := owners(b)
+			oldMembers := Nodes(b)
+			newMembers := append(Nodes(b), rendezvous.NewWeightedMember("10.0.1.0:3000", rendezvous.DefaultWeight))
+			moves := Diff(b, oldMembers, newMembers, before)
+
+			b.Add("10.0.1.0:3000")
+			after := owners(b)
+			expected := 0
+			for key, owner := range before {
+				if after[key] != owner {
+					expected++
+				}
+			}
+			if len(moves) != expected {
+				t.Fatalf("Diff returned %d moves, lookup moved %d keys", len(moves), expected)
+			}
+			for _, move := range moves {
+				if after[move.Key] != move.NewOwner {
+					t.Fatalf("Diff moved %s to %s, lookup owner is %s", move.Key, move.NewOwner, after[move.Key])
+				}
+			}
+		})
+	}
+}
+
+func TestNewRejectsUnknownAlgorithm(t *testing.T) {
+	if _, err := New("modulo", rendezvous.Config{}); err == nil {
+		t.Fatal("expected an error for an unknown algorithm")
+	}
+}
+
+func TestSetMembersMatchesAFreshBalancer(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			b := newBalancer(t, algorithm, testMembers)
+			members := make([]rendezvous.WeightedMember, 0, testMembers)
+			for i := 3; i < testMembers+3; i++ {
+				members = append(members, rendezvous.NewWeightedMember(fmt.Sprintf("10.0.0.%d:3000", i), rendezvous.DefaultWeight))
+			}
+			SetMembers(b, members)
+			fresh, _ := New(algorithm, rendezvous.Config{})
+			for _, member := range members {
+				fresh.Add(member.Member())
+			}
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("user-%d", i)
+				if b.Lookup(key) != fresh.Lookup(key) {
+					t.Fatalf("expected %s on %s like a balancer built with the members, got %s", key, fresh.Lookup(key), b.Lookup(key))
+				}
+			}
+		})
+	}
+}
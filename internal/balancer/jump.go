@@ -0,0 +1,86 @@
+package balancer
+
+import (
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"slices"
+	"sync"
+)
+
+// Jump is Lamping and Veach's jump consistent hash over the members sorted by name.
+// It needs no memory besides the member list, but only moves the minimum of keys when
+// the member changing sorts last. Any other change shifts the buckets of the members after it.
+type Jump struct {
+	mu      sync.RWMutex
+	hasher  rendezvous.Hasher
+	members []string
+}
+
+func NewJump(hasher rendezvous.Hasher) *Jump {
+	return &Jump{hasher: hasher}
+}
+
+// jumpHash returns the bucket in [0, buckets) of key.
+func jumpHash(key uint64, buckets int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func (j *Jump) Add(member string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if i, found := slices.BinarySearch(j.members, member); !found {
+		j.members = slices.Insert(j.members, i, member)
+	}
+}
+
+func (j *Jump) Remove(member string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if i, found := slices.BinarySearch(j.members, member); found {
+		j.members = slices.Delete(j.members, i, i+1)
+	}
+}
+
+func (j *Jump) Lookup(key string) string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if len(j.members) == 0 {
+		return ""
+	}
+	return j.members[jumpHash(j.hasher.Sum64([]byte(key)), len(j.members))]
+}
+
+// LookupN ranks the members by jumping again over the ones not picked yet, rehashing the key each round.
+func (j *Jump) LookupN(key string, n int) []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	n = min(n, len(j.members))
+	if n <= 0 {
+		return []string{}
+	}
+	remaining := slices.Clone(j.members)
+	hosts := make([]string, 0, n)
+	hash := j.hasher.Sum64([]byte(key))
+	for len(hosts) < n {
+		i := jumpHash(hash, len(remaining))
+		hosts = append(hosts, remaining[i])
+		remaining = slices.Delete(remaining, i, i+1)
+		hash = mix64(hash)
+	}
+	return hosts
+}
+
+func (j *Jump) Members() []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return slices.Clone(j.members)
+}
+
+func (j *Jump) rebuild(members []string) Balancer {
+	return &Jump{hasher: j.hasher, members: slices.Compact(slices.Sorted(slices.Values(members)))}
+}
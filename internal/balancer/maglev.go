@@ -0,0 +1,139 @@
+package balancer
+
+import (
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"slices"
+	"sync"
+)
+
+// DefaultMaglevTableSize is the lookup table size. It must be prime and much larger than the number of members.
+const DefaultMaglevTableSize = 65537
+
+// Maglev is Google's Maglev consistent hashing: every member fills the lookup table following
+// its own permutation, so lookups are O(1) and members own near equal shares of the table.
+// Membership changes rebuild the table, moving few keys besides the ones of the changed member.
+type Maglev struct {
+	mu      sync.RWMutex
+	hasher  rendezvous.Hasher
+	size    uint64
+	members []string
+	table   []int
+}
+
+func NewMaglev(hasher rendezvous.Hasher, size uint64) *Maglev {
+	return &Maglev{hasher: hasher, size: size}
+}
+
+func (m *Maglev) Add(member string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, found := slices.BinarySearch(m.members, member)
+	if found {
+		return
+	}
+	m.members = slices.Insert(m.members, i, member)
+	m.populate()
+}
+
+func (m *Maglev) Remove(member string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, found := slices.BinarySearch(m.members, member)
+	if !found {
+		return
+	}
+	m.members = slices.Delete(m.members, i, i+1)
+	m.populate()
+}
+
+// SetMembers replaces the members, filling the lookup table once instead of once per changed member.
+func (m *Maglev) SetMembers(members []string) {
+	sorted := slices.Compact(slices.Sorted(slices.Values(members)))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slices.Equal(sorted, m.members) {
+		return
+	}
+	m.members = sorted
+	m.populate()
+}
+
+// populate fills the lookup table. Members are sorted so the table only depends on the membership.
+// The caller must hold the lock.
+func (m *Maglev) populate() {
+	if len(m.members) == 0 {
+		m.table = nil
+		return
+	}
+	offsets := make([]uint64, len(m.members))
+	skips := make([]uint64, len(m.members))
+	next := make([]uint64, len(m.members))
+	for i, member := range m.members {
+		hash := m.hasher.Sum64([]byte(member))
+		offsets[i] = hash % m.size
+		skips[i] = mix64(hash)%(m.size-1) + 1
+	}
+	table := make([]int, m.size)
+	for i := range table {
+		table[i] = -1
+	}
+	for filled := uint64(0); ; {
+		for i := range m.members {
+			slot := (offsets[i] + next[i]*skips[i]) % m.size
+			for table[slot] >= 0 {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % m.size
+			}
+			table[slot] = i
+			next[i]++
+			filled++
+			if filled == m.size {
+				m.table = table
+				return
+			}
+		}
+	}
+}
+
+func (m *Maglev) Lookup(key string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.table) == 0 {
+		return ""
+	}
+	return m.members[m.table[m.hasher.Sum64([]byte(key))%m.size]]
+}
+
+// LookupN walks the table from the slot of the key, ranking members by their first slot.
+func (m *Maglev) LookupN(key string, n int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n = min(n, len(m.members))
+	if n <= 0 {
+		return []string{}
+	}
+	hosts := make([]string, 0, n)
+	seen := make([]bool, len(m.members))
+	slot := m.hasher.Sum64([]byte(key)) % m.size
+	for steps := uint64(0); len(hosts) < n && steps < m.size; steps++ {
+		if i := m.table[slot]; !seen[i] {
+			seen[i] = true
+			hosts = append(hosts, m.members[i])
+		}
+		slot = (slot + 1) % m.size
+	}
+	return hosts
+}
+
+func (m *Maglev) Members() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.members)
+}
+
+func (m *Maglev) rebuild(members []string) Balancer {
+	next := NewMaglev(m.hasher, m.size)
+	next.members = slices.Compact(slices.Sorted(slices.Values(members)))
+	next.populate()
+	return next
+}
@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"sort"
+	"sync"
+
+	"github.com/buraksezer/consistent"
+)
+
+const (
+	// DefaultRingPartitions is prime so keys spread evenly over partitions. It also bounds the
+	// number of members, every member needs at least one partition.
+	DefaultRingPartitions = 7919
+	// DefaultRingReplicas is the number of virtual nodes per member.
+	DefaultRingReplicas = 64
+	// DefaultRingLoad bounds how many partitions a member owns, relative to the average.
+	DefaultRingLoad = 1.25
+)
+
+type ringMember string
+
+func (m ringMember) String() string {
+	return string(m)
+}
+
+// Ring is a consistent-hash ring with virtual nodes and bounded partition load.
+type Ring struct {
+	mu     sync.RWMutex
+	hasher rendezvous.Hasher
+	ring   *consistent.Consistent
+	size   int
+}
+
+func NewRing(hasher rendezvous.Hasher) *Ring {
+	return newRing(hasher, nil)
+}
+
+func newRing(hasher rendezvous.Hasher, members []string) *Ring {
+	var ringMembers []consistent.Member
+	if len(members) > 0 {
+		ringMembers = make([]consistent.Member, len(members))
+		for i, member := range members {
+			ringMembers[i] = ringMember(member)
+		}
+	}
+	return &Ring{
+		hasher: hasher,
+		ring: consistent.New(ringMembers, consistent.Config{
+			Hasher:            hasher,
+			PartitionCount:    DefaultRingPartitions,
+			ReplicationFactor: DefaultRingReplicas,
+			Load:              DefaultRingLoad,
+		}),
+		size: len(ringMembers),
+	}
+}
+
+func (r *Ring) Add(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ring.Add(ringMember(member))
+	r.size = len(r.ring.GetMembers())
+}
+
+func (r *Ring) Remove(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ring.Remove(member)
+	r.size = len(r.ring.GetMembers())
+}
+
+func (r *Ring) Lookup(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.size == 0 {
+		return ""
+	}
+	return r.ring.LocateKey([]byte(key)).String()
+}
+
+func (r *Ring) LookupN(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n = min(n, r.size)
+	if n <= 0 {
+		return []string{}
+	}
+	members, err := r.ring.GetClosestN([]byte(key), n)
+	if err != nil {
+		return []string{}
+	}
+	hosts := make([]string, len(members))
+	for i, member := range members {
+		hosts[i] = member.String()
+	}
+	return hosts
+}
+
+func (r *Ring) Members() []string {
+	members := r.ring.GetMembers()
+	hosts := make([]string, len(members))
+	for i, member := range members {
+		hosts[i] = member.String()
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (r *Ring) rebuild(members []string) Balancer {
+	return newRing(r.hasher, members)
+}
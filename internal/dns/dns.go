@@ -2,106 +2,160 @@ package dns
 
 import (
 	"context"
-	"log/slog"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/membership"
+	"lukas8219/websocket-operator/internal/recipients"
 	"lukas8219/websocket-operator/internal/rendezvous"
-	"net"
 	"os"
-	"strconv"
 	"time"
 )
 
-type DnsRouter struct {
-	loadbalancer *rendezvous.Rendezvous
-}
+const (
+	DefaultRefreshInterval    = 30 * time.Second
+	DefaultMinRefreshInterval = time.Second
+	DefaultNotFoundGrace      = 2 * time.Minute
+)
 
-func (r *DnsRouter) Info(msg string, args ...any) {
-	slog.With("component", "router").With("mode", "dns").Info(msg, args...)
+// Config configures how the SRV record is resolved and refreshed.
+type Config struct {
+	// Record is the SRV record listing the sidecars. Empty uses WS_OPERATOR_SRV_DNS_RECORD.
+	Record string
+	// Server is the nameserver address, like 127.0.0.1:53 for the CoreDNS of deployments/local.
+	// Empty uses WS_OPERATOR_DNS_SERVER, then the nameservers of resolv.conf.
+	Server string
+	// Interval is the longest time between refreshes. Records with a shorter TTL are refreshed when they expire.
+	Interval time.Duration
+	// MinInterval bounds how often records with a short TTL are refreshed.
+	MinInterval time.Duration
+	// NotFoundGrace is how long the record may be missing, or list no address, before its hosts are
+	// dropped. Until then the current hosts are kept, as a missing record is often a DNS hiccup.
+	NotFoundGrace time.Duration
 }
 
-func (r *DnsRouter) Debug(msg string, args ...any) {
-	slog.With("component", "router").With("mode", "dns").Debug(msg, args...)
+// nextRefresh is how long to wait before resolving records with ttl again.
+func (c Config) nextRefresh(ttl time.Duration) time.Duration {
+	if ttl <= 0 || ttl > c.Interval {
+		return c.Interval
+	}
+	return max(ttl, c.MinInterval)
 }
 
-func (r *DnsRouter) Error(msg string, args ...any) {
-	slog.With("component", "router").With("mode", "dns").Error(msg, args...)
+// nextRetry is how long to wait after a failed refresh, doubling the previous wait from MinInterval
+// up to Interval. previous is 0 after a successful refresh.
+func (c Config) nextRetry(previous time.Duration) time.Duration {
+	if previous <= 0 {
+		return c.MinInterval
+	}
+	return min(2*previous, c.Interval)
 }
 
-func WithDns(loadbalancer *rendezvous.Rendezvous) *DnsRouter {
-	return &DnsRouter{
-		loadbalancer,
-	}
+type DnsRouter struct {
+	*membership.Membership
+	config   Config
+	resolver resolver
+	// notFoundSince is when the record was first found missing, zero while it is found. It is only used
+	// by refresh, which isn't called concurrently.
+	notFoundSince time.Time
 }
 
-func (r *DnsRouter) InitializeHosts() error {
-	srvRecord := os.Getenv("WS_OPERATOR_SRV_DNS_RECORD")
-	if srvRecord == "" {
-		srvRecord = "ws-operator.local"
+// WithDns creates a router for the SRV record of config. The recipients of tracked are rebalanced
+// when the record changes, nil tracks them in a default store.
+func WithDns(loadbalancer balancer.Balancer, tracked *recipients.Store, config Config) *DnsRouter {
+	if config.Record == "" {
+		config.Record = os.Getenv("WS_OPERATOR_SRV_DNS_RECORD")
 	}
-	hosts, err := r.getCurrentHosts(srvRecord)
-	if err != nil {
-		return err
+	if config.Record == "" {
+		config.Record = "ws-operator.local"
 	}
-	for _, host := range hosts {
-		r.loadbalancer.Add(host)
+	if config.Server == "" {
+		config.Server = defaultServer()
 	}
-	return nil
-}
-
-func createResolver() *net.Resolver {
-	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
-		return &net.Resolver{}
+	if config.Interval <= 0 {
+		config.Interval = DefaultRefreshInterval
 	}
-	// Create a custom resolver that first tries localhost:53 (for testing)
-	// and falls back to the system resolver if that fails
-	r := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			// First try localhost:53
-			d := net.Dialer{}
-			ctx, cancel := context.WithTimeout(ctx, time.Second*5)
-			defer cancel()
-			slog.Debug("Looking for address on localhost:53", "address", address)
-			conn, err := d.DialContext(ctx, "udp", "0.0.0.0:53")
-			if err != nil {
-				slog.Debug("Failed to connect to localhost:53, falling back to system resolver", "error", err)
-				return d.DialContext(ctx, network, address)
-			}
-			return conn, nil
-		},
+	if config.MinInterval <= 0 {
+		config.MinInterval = DefaultMinRefreshInterval
 	}
-
-	return r
-}
-
-func (r *DnsRouter) getCurrentHosts(service string) ([]string, error) {
-	resolver := createResolver()
-	slog.Debug("Getting random SRV host for service", "service", service)
-	_, addrs, err := resolver.LookupSRV(context.Background(), "", "", service)
-	if err != nil {
-		return nil, err
+	if config.NotFoundGrace <= 0 {
+		config.NotFoundGrace = DefaultNotFoundGrace
 	}
-
-	if len(addrs) == 0 {
-		return []string{}, nil
+	return &DnsRouter{
+		Membership: membership.New("dns", loadbalancer, tracked, nil),
+		config:     config,
+		resolver:   newResolver(config.Server, 5*time.Second),
 	}
+}
 
-	// Create a slice of tuples [addr,port] from the SRV records
-	addrPorts := make([]string, len(addrs))
-	for i, srv := range addrs {
-		addr, err := resolver.LookupIP(context.Background(), "ip", srv.Target)
+// InitializeHosts resolves the SRV record and keeps refreshing it in the background until Stop.
+// A failed first lookup is returned, and retried in the background with backoff.
+func (r *DnsRouter) InitializeHosts() error {
+	ttl, err := r.refresh()
+	go r.refreshLoop(ttl, err)
+	return err
+}
+
+// refreshLoop refreshes the record when its ttl expires, or with backoff while err says the last
+// refresh failed.
+func (r *DnsRouter) refreshLoop(ttl time.Duration, err error) {
+	var retry time.Duration
+	for {
+		wait := r.config.nextRefresh(ttl)
 		if err != nil {
-			return nil, err
+			retry = r.config.nextRetry(retry)
+			wait = retry
+		} else {
+			retry = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.Stopped():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		ttl, err = r.refresh()
+		if err != nil {
+			r.Error("Failed to refresh hosts, keeping the current ones", "record", r.config.Record, "error", err, "retryIn", r.config.nextRetry(retry))
 		}
-		addrPorts[i] = net.JoinHostPort(addr[0].String(), strconv.Itoa(int(srv.Port)))
 	}
-	slog.Debug("Found addresses", "addrs", addrPorts)
-	return addrPorts, nil
 }
 
-func (r *DnsRouter) Route(recipientId string) string {
-	return r.loadbalancer.Lookup(recipientId)
+// refresh resolves the record and applies the membership changes, emitting a rebalance
+// request for the tracked recipients whose owner changed. It returns the TTL of the records.
+// A missing record fails the refresh, keeping the current hosts, until NotFoundGrace has passed.
+func (r *DnsRouter) refresh() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.resolver.timeout)
+	defer cancel()
+	r.Debug("Resolving SRV record", "record", r.config.Record, "server", r.config.Server)
+	members, ttl, err := r.resolver.lookupSRV(ctx, r.config.Record)
+	switch {
+	case isNotFound(err):
+		if r.notFoundSince.IsZero() {
+			r.notFoundSince = time.Now()
+		}
+		if time.Since(r.notFoundSince) < r.config.NotFoundGrace {
+			r.Sync.Failed(err)
+			return 0, err
+		}
+		r.Error("SRV record missing for longer than the grace period, dropping the hosts", "record", r.config.Record, "grace", r.config.NotFoundGrace)
+		members = nil
+	case err != nil:
+		r.Sync.Failed(err)
+		return 0, err
+	default:
+		r.notFoundSince = time.Time{}
+	}
+	r.Sync.Succeeded()
+	r.Debug("Resolved SRV record", "record", r.config.Record, "members", members, "ttl", ttl)
+	r.Apply(membership.Update{Members: members})
+	return ttl, nil
 }
 
-func (r *DnsRouter) RebalanceRequests() <-chan [][2]string {
-	return nil
+// srvWeight converts the SRV weight field into a rendezvous weight.
+// A zero SRV weight means "no preference" so it maps to the default weight.
+func srvWeight(weight uint16) float64 {
+	if weight == 0 {
+		return rendezvous.DefaultWeight
+	}
+	return float64(weight)
 }
@@ -0,0 +1,356 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"lukas8219/websocket-operator/internal/target"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubServer answers SRV queries for one record with the configured targets, and A queries for the targets.
+type stubServer struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	record  string
+	ttl     uint32
+	targets []net.IP
+	queries int
+	// failing answers every query with SERVFAIL.
+	failing bool
+}
+
+func newStubServer(t *testing.T, record string, ttl uint32) *stubServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubServer{conn: conn, record: record + ".", ttl: ttl}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *stubServer) setTargets(targets ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets = s.targets[:0]
+	for _, target := range targets {
+		s.targets = append(s.targets, net.ParseIP(target).To4())
+	}
+}
+
+func (s *stubServer) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+func (s *stubServer) queryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+func (s *stubServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var request dnsmessage.Message
+		if err := request.Unpack(buf[:n]); err != nil || len(request.Questions) != 1 {
+			continue
+		}
+		answer := s.answer(request)
+		response, err := answer.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(response, addr)
+	}
+}
+
+func (s *stubServer) answer(request dnsmessage.Message) dnsmessage.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries++
+	question := request.Questions[0]
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: request.ID, Response: true, Authoritative: true},
+		Questions: request.Questions,
+	}
+	if s.failing {
+		response.RCode = dnsmessage.RCodeServerFailure
+		return response
+	}
+	for i, ip := range s.targets {
+		target := dnsmessage.MustNewName(fmt.Sprintf("ws%d.%s", i, s.record))
+		if question.Name != target {
+			continue
+		}
+		if question.Type == dnsmessage.TypeA {
+			var a [4]byte
+			copy(a[:], ip)
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: target, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: s.ttl},
+				Body:   &dnsmessage.AResource{A: a},
+			})
+		}
+		return response
+	}
+	if question.Name.String() != s.record || question.Type != dnsmessage.TypeSRV {
+		response.RCode = dnsmessage.RCodeNameError
+		return response
+	}
+	for i := range s.targets {
+		target := dnsmessage.MustNewName(fmt.Sprintf("ws%d.%s", i, s.record))
+		header := dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: s.ttl}
+		response.Answers = append(response.Answers, dnsmessage.Resource{
+			Header: header,
+			Body:   &dnsmessage.SRVResource{Priority: 10, Weight: 0, Port: 3000, Target: target},
+		})
+	}
+	return response
+}
+
+func newTestRouter(t *testing.T, server *stubServer, config Config) *DnsRouter {
+	t.Helper()
+	loadbalancer, err := balancer.New(balancer.AlgorithmRendezvous, rendezvous.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Record = "ws-operator.test"
+	config.Server = server.conn.LocalAddr().String()
+	router := WithDns(loadbalancer, nil, config)
+	t.Cleanup(router.Stop)
+	return router
+}
+
+func TestInitializeHostsResolvesSRV(t *testing.T) {
+	server := newStubServer(t, "ws-operator.test", 60)
+	server.setTargets("10.0.0.1", "10.0.0.2")
+	router := newTestRouter(t, server, Config{})
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	hosts := router.GetAllUpstreamHosts()
+	if len(hosts) != 2 {
+		t.Fatalf("expected 2 hosts, got %v", hosts)
+	}
+	for _, host := range hosts {
+		if host != "10.0.0.1:3000" && host != "10.0.0.2:3000" {
+			t.Fatalf("unexpected host %s", host)
+		}
+	}
+}
+
+func TestRefreshRebalancesMovedRecipients(t *testing.T) {
+	server := newStubServer(t, "ws-operator.test", 1)
+	server.setTargets("10.0.0.1", "10.0.0.2")
+	router := newTestRouter(t, server, Config{Interval: time.Hour, MinInterval: 10 * time.Millisecond})
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	owners := make(map[string]target.Target)
+	for i := 0; i < 200; i++ {
+		recipient := fmt.Sprintf("user-%d", i)
+		owners[recipient] = router.Route(recipient)
+		router.Track(recipient, owners[recipient])
+	}
+
+	server.setTargets("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	var moves []target.RebalanceRequest
+	select {
+	case moves = <-router.RebalanceRequests():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a rebalance request, the TTL should trigger a refresh")
+	}
+	if len(moves) == 0 {
+		t.Fatal("expected recipients to move to the new host")
+	}
+	moved := make(map[string]target.Target)
+	for _, move := range moves {
+		if move.New.Address() != "10.0.0.3:3000" {
+			t.Fatalf("%s moved to %v, only the added host can win recipients", move.RecipientId, move.New)
+		}
+		if move.Old != owners[move.RecipientId] {
+			t.Fatalf("%s moved from %v, expected %v", move.RecipientId, move.Old, owners[move.RecipientId])
+		}
+		moved[move.RecipientId] = move.New
+	}
+	for recipient, owner := range owners {
+		expected := owner
+		if newOwner, ok := moved[recipient]; ok {
+			expected = newOwner
+		}
+		if got := router.Route(recipient); got.Address() != expected.Address() {
+			t.Fatalf("%s routes to %v, expected %v", recipient, got, expected)
+		}
+	}
+}
+
+func TestRefreshKeepsHostsOnFailure(t *testing.T) {
+	server := newStubServer(t, "ws-operator.test", 60)
+	server.setTargets("10.0.0.1")
+	router := newTestRouter(t, server, Config{})
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	server.conn.Close()
+	if _, err := router.refresh(); err == nil {
+		t.Fatal("expected the refresh to fail without a nameserver")
+	}
+	if hosts := router.GetAllUpstreamHosts(); len(hosts) != 1 {
+		t.Fatalf("expected the hosts to be kept, got %v", hosts)
+	}
+}
+
+func TestRefreshKeepsHostsWhileTheRecordIsMissing(t *testing.T) {
+	server := newStubServer(t, "ws-operator.test", 60)
+	server.setTargets("10.0.0.1")
+	router := newTestRouter(t, server, Config{NotFoundGrace: 100 * time.Millisecond})
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	server.setTargets()
+	if _, err := router.refresh(); !isNotFound(err) {
+		t.Fatalf("expected a missing record to fail the refresh, got %v", err)
+	}
+	if hosts := router.GetAllUpstreamHosts(); len(hosts) != 1 {
+		t.Fatalf("expected the hosts to be kept during the grace period, got %v", hosts)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := router.refresh(); err != nil {
+		t.Fatalf("expected the hosts to be dropped after the grace period, got %v", err)
+	}
+	if hosts := router.GetAllUpstreamHosts(); len(hosts) != 0 {
+		t.Fatalf("expected no hosts, got %v", hosts)
+	}
+
+	// Finding the record again restarts the grace period.
+	server.setTargets("10.0.0.2")
+	if _, err := router.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	server.setTargets()
+	if _, err := router.refresh(); !isNotFound(err) {
+		t.Fatalf("expected a new grace period, got %v", err)
+	}
+	if hosts := router.GetAllUpstreamHosts(); len(hosts) != 1 || hosts[0] != "10.0.0.2:3000" {
+		t.Fatalf("expected 10.0.0.2:3000 to be kept, got %v", hosts)
+	}
+}
+
+func TestNextRefreshHonorsTTL(t *testing.T) {
+	config := Config{Interval: 30 * time.Second, MinInterval: time.Second}
+	cases := map[time.Duration]time.Duration{
+		0:                      30 * time.Second,
+		10 * time.Second:       10 * time.Second,
+		time.Hour:              30 * time.Second,
+		100 * time.Millisecond: time.Second,
+	}
+	for ttl, expected := range cases {
+		if got := config.nextRefresh(ttl); got != expected {
+			t.Errorf("nextRefresh(%s) = %s, expected %s", ttl, got, expected)
+		}
+	}
+}
+
+func TestNextRetryBacksOff(t *testing.T) {
+	config := Config{Interval: 30 * time.Second, MinInterval: time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	var retry time.Duration
+	for _, wait := range expected {
+		retry = config.nextRetry(retry)
+		if retry != wait {
+			t.Fatalf("expected a retry in %s, got %s", wait, retry)
+		}
+	}
+}
+
+func TestInitializeHostsRetriesTheFirstLookup(t *testing.T) {
+	server := newStubServer(t, "ws-operator.test", 60)
+	server.setTargets("10.0.0.1")
+	server.setFailing(true)
+	router := newTestRouter(t, server, Config{MinInterval: 10 * time.Millisecond})
+	if err := router.InitializeHosts(); err == nil {
+		t.Fatal("expected the first lookup to fail")
+	}
+	if hosts := router.GetAllUpstreamHosts(); len(hosts) != 0 {
+		t.Fatalf("expected no hosts, got %v", hosts)
+	}
+	server.setFailing(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(router.GetAllUpstreamHosts()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the lookup to be retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hosts := router.GetAllUpstreamHosts(); hosts[0] != "10.0.0.1:3000" {
+		t.Fatalf("expected 10.0.0.1:3000, got %v", hosts)
+	}
+}
+
+func TestRefreshSkipsUnchangedRecords(t *testing.T) {
+	server := newStubServer(t, "ws-operator.test", 60)
+	server.setTargets("10.0.0.1", "10.0.0.2")
+	router := newTestRouter(t, server, Config{})
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	router.Track("user", router.Route("user"))
+	queries := server.queryCount()
+	if _, err := router.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case moves := <-router.RebalanceRequests():
+		t.Fatalf("unexpected rebalance %v", moves)
+	default:
+	}
+	if server.queryCount() != 2*queries {
+		t.Fatalf("expected the same queries on every refresh, got %d after %d", server.queryCount(), queries)
+	}
+}
+
+func TestStreamConnObservesSplitMessages(t *testing.T) {
+	message, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("ws0.ws-operator.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 7},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+		}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	observer := &ttlObserver{}
+	conn := &observedStreamConn{Conn: client, observer: observer}
+	framed := append(binary.BigEndian.AppendUint16(nil, uint16(len(message))), message...)
+	go func() {
+		// the length and the message arrive in separate reads
+		server.Write(framed[:1])
+		server.Write(framed[1:10])
+		server.Write(framed[10:])
+	}()
+	if _, err := io.ReadFull(conn, make([]byte, len(framed))); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := observer.lowest(); ttl != 7*time.Second {
+		t.Fatalf("expected the TTL of the answer, got %s", ttl)
+	}
+}
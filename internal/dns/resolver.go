@@ -0,0 +1,183 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolver looks records up with the Go resolver, so the nameservers, search domains and options of
+// resolv.conf apply. Its Dial reaches server instead when one is configured, and reads the TTL of the
+// answers, which net.Resolver doesn't report.
+type resolver struct {
+	server  string
+	timeout time.Duration
+	lookup  *net.Resolver
+}
+
+func newResolver(server string, timeout time.Duration) resolver {
+	r := resolver{server: server, timeout: timeout}
+	r.lookup = &net.Resolver{PreferGo: true, Dial: r.dial}
+	return r
+}
+
+// defaultServer is the nameserver used when none is configured, empty for the ones of resolv.conf.
+func defaultServer() string {
+	return os.Getenv("WS_OPERATOR_DNS_SERVER")
+}
+
+func (r resolver) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if r.server != "" {
+		address = r.server
+	}
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	observer, ok := ctx.Value(ttlKey{}).(*ttlObserver)
+	if !ok {
+		return conn, nil
+	}
+	// The Go resolver tells datagrams from streams by whether the conn is a net.PacketConn.
+	if udp, ok := conn.(*net.UDPConn); ok {
+		return &observedPacketConn{UDPConn: udp, observer: observer}, nil
+	}
+	return &observedStreamConn{Conn: conn, observer: observer}, nil
+}
+
+type ttlKey struct{}
+
+// ttlObserver keeps the lowest TTL of the answers read during a lookup.
+type ttlObserver struct {
+	mu  sync.Mutex
+	ttl time.Duration
+}
+
+// observe reads the TTLs of the answers of a DNS message.
+func (o *ttlObserver) observe(message []byte) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(message); err != nil {
+		return
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for {
+		header, err := parser.AnswerHeader()
+		if err != nil {
+			return
+		}
+		if ttl := time.Duration(header.TTL) * time.Second; o.ttl == 0 || ttl < o.ttl {
+			o.ttl = ttl
+		}
+		if err := parser.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+func (o *ttlObserver) lowest() time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.ttl
+}
+
+// observedPacketConn observes every datagram, each one a DNS message.
+type observedPacketConn struct {
+	*net.UDPConn
+	observer *ttlObserver
+}
+
+func (c *observedPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		c.observer.observe(b[:n])
+	}
+	return n, err
+}
+
+// observedStreamConn observes the length-prefixed DNS messages of a TCP stream.
+type observedStreamConn struct {
+	net.Conn
+	observer *ttlObserver
+	buf      []byte
+}
+
+func (c *observedStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		length := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+length {
+			break
+		}
+		c.observer.observe(c.buf[2 : 2+length])
+		c.buf = c.buf[2+length:]
+	}
+	return n, err
+}
+
+// lookupSRV resolves the SRV record into weighted host:port members.
+// ttl is the lowest TTL of the records used, 0 when there were none.
+// A name that doesn't exist, or lists no address, fails with a not found error, see isNotFound.
+func (r resolver) lookupSRV(ctx context.Context, record string) (members []rendezvous.WeightedMember, ttl time.Duration, err error) {
+	observer := &ttlObserver{}
+	ctx = context.WithValue(ctx, ttlKey{}, observer)
+	_, records, err := r.lookup.LookupSRV(ctx, "", "", record)
+	if err != nil {
+		return nil, 0, err
+	}
+	members = make([]rendezvous.WeightedMember, 0, len(records))
+	for _, srv := range records {
+		ip, err := r.lookupIP(ctx, srv.Target)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ip.IsValid() {
+			continue
+		}
+		members = append(members, rendezvous.NewWeightedMember(net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))), srvWeight(srv.Weight)))
+	}
+	if len(members) == 0 {
+		return nil, 0, &net.DNSError{Err: "no address for the SRV targets", Name: record, Server: r.server, IsNotFound: true}
+	}
+	return members, observer.lowest(), nil
+}
+
+// lookupIP returns the first address of host, preferring IPv4, or the zero address when it has none.
+func (r resolver) lookupIP(ctx context.Context, host string) (netip.Addr, error) {
+	addresses, err := r.lookup.LookupNetIP(ctx, "ip", strings.TrimSuffix(host, "."))
+	if err != nil {
+		if isNotFound(err) {
+			return netip.Addr{}, nil
+		}
+		return netip.Addr{}, err
+	}
+	for _, address := range addresses {
+		if address.Unmap().Is4() {
+			return address.Unmap(), nil
+		}
+	}
+	if len(addresses) == 0 {
+		return netip.Addr{}, nil
+	}
+	return addresses[0], nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,64 @@
+package epoch
+
+import (
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/zeebo/xxh3"
+)
+
+// Epoch is the version of the membership a router routes with. The version only increases, by one
+// for every change of the members, so a later membership always has a higher version. Zero means
+// there were never any members.
+//
+// Versions are counted by every component on its own, so they don't tell whether two components
+// route with the same members. The hash does: it is derived from the members alone, so components
+// seeing the same members agree on it whatever order they saw the changes in.
+type Epoch struct {
+	version atomic.Uint64
+	hash    atomic.Uint64
+}
+
+// Load returns the version.
+func (e *Epoch) Load() uint64 {
+	return e.version.Load()
+}
+
+// Hash returns the hash of the members, see Of.
+func (e *Epoch) Hash() uint64 {
+	return e.hash.Load()
+}
+
+// Set moves to the next version when members differ from the current ones. Concurrent calls must be
+// serialized by the caller.
+func (e *Epoch) Set(members []rendezvous.WeightedMember) {
+	hash := Of(members)
+	if hash == e.hash.Load() {
+		return
+	}
+	e.hash.Store(hash)
+	e.version.Add(1)
+}
+
+// Of returns the hash of members, derived from their names and weights. Zero means there are no members.
+func Of(members []rendezvous.WeightedMember) uint64 {
+	if len(members) == 0 {
+		return 0
+	}
+	entries := make([]string, len(members))
+	for i, member := range members {
+		entries[i] = member.Member() + "=" + strconv.FormatFloat(member.Weight(), 'g', -1, 64)
+	}
+	slices.Sort(entries)
+	hash := xxh3.New()
+	for _, entry := range entries {
+		hash.WriteString(entry)
+		hash.Write([]byte{0})
+	}
+	if sum := hash.Sum64(); sum != 0 {
+		return sum
+	}
+	return 1
+}
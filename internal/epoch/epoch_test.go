@@ -0,0 +1,42 @@
+package epoch
+
+import (
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	a := rendezvous.NewWeightedMember("10.0.0.1:3000", 1)
+	b := rendezvous.NewWeightedMember("10.0.0.2:3000", 1)
+	if Of(nil) != 0 {
+		t.Fatal("expected no members to be unversioned")
+	}
+	if Of([]rendezvous.WeightedMember{a, b}) != Of([]rendezvous.WeightedMember{b, a}) {
+		t.Fatal("expected the hash not to depend on the order of the members")
+	}
+	if Of([]rendezvous.WeightedMember{a, b}) == Of([]rendezvous.WeightedMember{a}) {
+		t.Fatal("expected a removed member to change the hash")
+	}
+	heavier := rendezvous.NewWeightedMember("10.0.0.2:3000", 2)
+	if Of([]rendezvous.WeightedMember{a, b}) == Of([]rendezvous.WeightedMember{a, heavier}) {
+		t.Fatal("expected a changed weight to change the hash")
+	}
+}
+
+func TestSetOnlyIncreasesTheVersion(t *testing.T) {
+	a := rendezvous.NewWeightedMember("10.0.0.1:3000", 1)
+	b := rendezvous.NewWeightedMember("10.0.0.2:3000", 1)
+	var e Epoch
+	e.Set(nil)
+	if e.Load() != 0 || e.Hash() != 0 {
+		t.Fatalf("expected no members to be unversioned, got %d", e.Load())
+	}
+	steps := [][]rendezvous.WeightedMember{{a, b}, {b, a}, {a}, {a, b}, {}}
+	versions := []uint64{1, 1, 2, 3, 4}
+	for i, members := range steps {
+		e.Set(members)
+		if e.Load() != versions[i] || e.Hash() != Of(members) {
+			t.Fatalf("step %d: expected version %d with the hash of %v, got %d and %d", i, versions[i], members, e.Load(), e.Hash())
+		}
+	}
+}
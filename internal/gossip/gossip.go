@@ -0,0 +1,197 @@
+package gossip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/membership"
+	"lukas8219/websocket-operator/internal/recipients"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"lukas8219/websocket-operator/internal/snapshot"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPort             = 7946
+	DefaultProbeInterval    = time.Second
+	DefaultProbeTimeout     = 500 * time.Millisecond
+	DefaultSuspicionTimeout = 5 * time.Second
+	DefaultIndirectChecks   = 3
+)
+
+// KeyEnv holds the gossip key, for keys injected from a Secret as an environment variable.
+const KeyEnv = "WS_OPERATOR_GOSSIP_KEY"
+
+// LoadKey reads the gossip key from keyFile, falling back to KeyEnv. It returns nil when neither is set.
+func LoadKey(keyFile string) ([]byte, error) {
+	raw := []byte(os.Getenv(KeyEnv))
+	if keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gossip key: %w", err)
+		}
+		raw = content
+	}
+	key := bytes.TrimSpace(raw)
+	if len(key) == 0 {
+		return nil, nil
+	}
+	if len(key) < 16 {
+		return nil, errors.New("gossip key must be at least 16 bytes")
+	}
+	return key, nil
+}
+
+// Config configures the gossip mode.
+type Config struct {
+	// Bind is the UDP address the gossip protocol listens on.
+	Bind string
+	// Address is the gossip address advertised to the other members. It defaults to Bind, or to the
+	// host of Host with the port of Bind when Bind listens on every interface.
+	Address string
+	// Host is the address users are routed to on this member. Members without a Host, like the load
+	// balancer, take part in the membership without receiving users.
+	Host string
+	// Weight is the rendezvous weight of this member.
+	Weight float64
+	// Seeds are the host:port gossip addresses contacted to join. Hostnames are resolved through DNS,
+	// every address they resolve to is a seed, so a headless service seeds every sidecar.
+	Seeds []string
+	// ProbeInterval is how often a member is probed, ProbeTimeout how long its ack is awaited before
+	// other members are asked to probe it.
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// SuspicionTimeout is how long a member that failed a probe stays suspect before it is declared dead.
+	SuspicionTimeout time.Duration
+	// IndirectChecks is how many members are asked to probe a member that didn't answer.
+	IndirectChecks int
+	// Key signs every message with HMAC-SHA256, messages not signed with it are dropped. Without a
+	// key anyone reaching the gossip port can join and route users to its own address.
+	Key []byte
+}
+
+func (c Config) withDefaults() Config {
+	if c.Bind == "" {
+		c.Bind = net.JoinHostPort("0.0.0.0", strconv.Itoa(DefaultPort))
+	}
+	if c.Weight <= 0 {
+		c.Weight = rendezvous.DefaultWeight
+	}
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = DefaultProbeInterval
+	}
+	if c.ProbeTimeout <= 0 || c.ProbeTimeout >= c.ProbeInterval {
+		c.ProbeTimeout = min(DefaultProbeTimeout, c.ProbeInterval/2)
+	}
+	if c.SuspicionTimeout <= 0 {
+		c.SuspicionTimeout = DefaultSuspicionTimeout
+	}
+	if c.IndirectChecks <= 0 {
+		c.IndirectChecks = DefaultIndirectChecks
+	}
+	return c
+}
+
+// address returns the gossip address of this member listening on bound.
+func (c Config) address(bound *net.UDPAddr) (string, error) {
+	if c.Address != "" {
+		return c.Address, nil
+	}
+	if !bound.IP.IsUnspecified() {
+		return bound.String(), nil
+	}
+	if host, _, err := net.SplitHostPort(c.Host); err == nil && host != "" {
+		return net.JoinHostPort(host, strconv.Itoa(bound.Port)), nil
+	}
+	return "", errors.New("gossip address unknown, set the address or bind to a specific interface")
+}
+
+// GossipRouter routes to the members discovered through the gossip protocol.
+type GossipRouter struct {
+	*membership.Membership
+	config    Config
+	members   *memberlist
+	changed   chan struct{}
+	leaveOnce sync.Once
+}
+
+// NewRouter creates a router joining the gossip of config. The recipients of tracked are rebalanced
+// when members join or fail, nil tracks them in a default store.
+func NewRouter(loadbalancer balancer.Balancer, tracked *recipients.Store, config Config) *GossipRouter {
+	return &GossipRouter{
+		Membership: membership.New("gossip", loadbalancer, tracked, nil),
+		config:     config.withDefaults(),
+		changed:    make(chan struct{}, 1),
+	}
+}
+
+// InitializeHosts starts the gossip and joins the seeds in the background. Until other members are
+// found only this member, when it has a Host, is routed to.
+func (r *GossipRouter) InitializeHosts() error {
+	members, err := newMemberlist(r.config, r.changed, func(err error) {
+		r.Debug("Gossip error", "error", err)
+		r.Sync.Failed(err)
+	})
+	if err != nil {
+		return err
+	}
+	r.members = members
+	r.Info("Joining gossip", "address", members.self, "host", r.config.Host, "seeds", r.config.Seeds)
+	if len(r.config.Key) == 0 {
+		r.Info("Gossip messages are not authenticated, set a key unless every peer of the network is trusted")
+	}
+	r.apply()
+	members.start()
+	go r.applyLoop()
+	return nil
+}
+
+// Stop leaves the gossip, telling other members so they don't have to detect our failure.
+func (r *GossipRouter) Stop() {
+	r.leaveOnce.Do(func() {
+		r.Membership.Stop()
+		if r.members != nil {
+			r.members.leave()
+		}
+	})
+}
+
+// Address is the gossip address of this member.
+func (r *GossipRouter) Address() string {
+	return r.members.self
+}
+
+func (r *GossipRouter) applyLoop() {
+	for {
+		select {
+		case <-r.Stopped():
+			return
+		case <-r.changed:
+			r.apply()
+		}
+	}
+}
+
+// apply updates the balancer to the routable members.
+func (r *GossipRouter) apply() {
+	routable := r.members.routable()
+	members := make([]rendezvous.WeightedMember, len(routable))
+	for i, m := range routable {
+		members[i] = rendezvous.NewWeightedMember(m.Host, m.Weight)
+	}
+	r.Apply(membership.Update{Members: members})
+}
+
+// Snapshot returns the routable members. LastSync is when a gossip message was last received.
+func (r *GossipRouter) Snapshot() snapshot.Snapshot {
+	current := r.Membership.Snapshot()
+	if r.members != nil {
+		current.LastSync = r.members.lastReceived()
+	}
+	return current
+}
@@ -0,0 +1,153 @@
+package gossip
+
+import (
+	"fmt"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestRouter(t *testing.T, host string, seeds ...string) *GossipRouter {
+	t.Helper()
+	return newTestRouterWith(t, Config{Host: host, Seeds: seeds})
+}
+
+func newTestRouterWith(t *testing.T, config Config) *GossipRouter {
+	t.Helper()
+	loadbalancer, err := balancer.New(balancer.AlgorithmRendezvous, rendezvous.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Bind = "127.0.0.1:0"
+	config.ProbeInterval = 50 * time.Millisecond
+	config.ProbeTimeout = 20 * time.Millisecond
+	config.SuspicionTimeout = 200 * time.Millisecond
+	router := NewRouter(loadbalancer, nil, config)
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.Stop)
+	return router
+}
+
+// waitForHosts waits until the router routes to exactly hosts, draining rebalance requests meanwhile.
+func waitForHosts(t *testing.T, router *GossipRouter, hosts ...string) {
+	t.Helper()
+	slices.Sort(hosts)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		current := router.GetAllUpstreamHosts()
+		slices.Sort(current)
+		if slices.Equal(current, hosts) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s expected hosts %v, got %v", router.Address(), hosts, current)
+		}
+		select {
+		case <-router.RebalanceRequests():
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestMembersDiscoverEachOther(t *testing.T) {
+	first := newTestRouter(t, "127.0.0.1:3001")
+	second := newTestRouter(t, "127.0.0.1:3002", first.Address())
+	third := newTestRouter(t, "127.0.0.1:3003", first.Address())
+	observer := newTestRouter(t, "", second.Address())
+	for _, router := range []*GossipRouter{first, second, third, observer} {
+		waitForHosts(t, router, "127.0.0.1:3001", "127.0.0.1:3002", "127.0.0.1:3003")
+	}
+
+	third.Stop()
+	for _, router := range []*GossipRouter{first, second, observer} {
+		waitForHosts(t, router, "127.0.0.1:3001", "127.0.0.1:3002")
+	}
+}
+
+func TestFailedMemberIsRemovedAndRebalanced(t *testing.T) {
+	first := newTestRouter(t, "127.0.0.1:3001")
+	second := newTestRouter(t, "127.0.0.1:3002", first.Address())
+	third := newTestRouter(t, "127.0.0.1:3003", first.Address())
+	waitForHosts(t, first, "127.0.0.1:3001", "127.0.0.1:3002", "127.0.0.1:3003")
+	waitForHosts(t, second, "127.0.0.1:3001", "127.0.0.1:3002", "127.0.0.1:3003")
+	waitForHosts(t, third, "127.0.0.1:3001", "127.0.0.1:3002", "127.0.0.1:3003")
+
+	failed := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		recipient := fmt.Sprintf("user-%d", i)
+		host := first.Route(recipient)
+		first.Track(recipient, host)
+		if host.Address() == "127.0.0.1:3003" {
+			failed[recipient] = true
+		}
+	}
+	// Crash without leaving, the others have to detect it.
+	third.members.shutdown()
+
+	moved := make(map[string]bool)
+	deadline := time.After(5 * time.Second)
+	for len(moved) < len(failed) {
+		select {
+		case moves := <-first.RebalanceRequests():
+			for _, move := range moves {
+				if !failed[move.RecipientId] || move.Old.Address() != "127.0.0.1:3003" || move.New.Address() == "127.0.0.1:3003" {
+					t.Fatalf("unexpected move %+v", move)
+				}
+				moved[move.RecipientId] = true
+			}
+		case <-deadline:
+			t.Fatalf("expected %d users of the failed member to move, got %d", len(failed), len(moved))
+		}
+	}
+	waitForHosts(t, second, "127.0.0.1:3001", "127.0.0.1:3002")
+	if snapshot := first.Snapshot(); snapshot.Mode != "gossip" || len(snapshot.Members) != 2 || snapshot.LastSync.IsZero() {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+}
+
+func TestRejoinAfterRestart(t *testing.T) {
+	first := newTestRouter(t, "127.0.0.1:3001")
+	second := newTestRouter(t, "127.0.0.1:3002", first.Address())
+	waitForHosts(t, first, "127.0.0.1:3001", "127.0.0.1:3002")
+	second.members.shutdown()
+	waitForHosts(t, first, "127.0.0.1:3001")
+
+	restarted := newTestRouter(t, "127.0.0.1:3002", first.Address())
+	waitForHosts(t, first, "127.0.0.1:3001", "127.0.0.1:3002")
+	waitForHosts(t, restarted, "127.0.0.1:3001", "127.0.0.1:3002")
+}
+
+func TestMembersWithoutTheKeyAreIgnored(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	first := newTestRouterWith(t, Config{Host: "127.0.0.1:3001", Key: key})
+	second := newTestRouterWith(t, Config{Host: "127.0.0.1:3002", Seeds: []string{first.Address()}, Key: key})
+	intruder := newTestRouterWith(t, Config{Host: "127.0.0.1:6666", Seeds: []string{first.Address()}, Key: []byte("fedcba9876543210")})
+	unsigned := newTestRouter(t, "127.0.0.1:6667", first.Address())
+	waitForHosts(t, first, "127.0.0.1:3001", "127.0.0.1:3002")
+	waitForHosts(t, second, "127.0.0.1:3001", "127.0.0.1:3002")
+
+	time.Sleep(10 * first.config.ProbeInterval)
+	waitForHosts(t, first, "127.0.0.1:3001", "127.0.0.1:3002")
+	waitForHosts(t, intruder, "127.0.0.1:6666")
+	waitForHosts(t, unsigned, "127.0.0.1:6667")
+}
+
+func TestPiggybackIsBounded(t *testing.T) {
+	l, err := newMemberlist(Config{Bind: "127.0.0.1:0"}.withDefaults(), make(chan struct{}, 1), func(error) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.shutdown)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i < 2*maxPiggyback; i++ {
+		l.merge(memberState{Name: fmt.Sprintf("127.0.0.1:%d", 8000+i), Incarnation: 1, State: stateAlive})
+	}
+	if updates := l.piggyback(false); len(updates) != maxPiggyback {
+		t.Fatalf("expected %d updates on a message, got %d", maxPiggyback, len(updates))
+	}
+}
@@ -0,0 +1,632 @@
+package gossip
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPiggyback bounds how many membership updates ride on every message.
+	maxPiggyback = 16
+	// maxPacketSize is the largest message read or written. Join acks carry as much state as fits.
+	maxPacketSize = 60 * 1024
+	// deadRetention is how many suspicion timeouts a dead member is remembered, so stale alive updates are ignored.
+	deadRetention = 30
+)
+
+type state string
+
+const (
+	stateAlive   state = "alive"
+	stateSuspect state = "suspect"
+	stateDead    state = "dead"
+)
+
+// rank orders the states of one incarnation: suspect overrides alive and dead overrides both.
+func (s state) rank() int {
+	switch s {
+	case stateSuspect:
+		return 1
+	case stateDead:
+		return 2
+	}
+	return 0
+}
+
+// memberState is what the members gossip about each other.
+type memberState struct {
+	// Name is the gossip address of the member.
+	Name string `json:"name"`
+	// Host is the address users are routed to, empty for members that only observe.
+	Host        string  `json:"host,omitempty"`
+	Weight      float64 `json:"weight,omitempty"`
+	Incarnation uint64  `json:"incarnation"`
+	State       state   `json:"state"`
+}
+
+// overrides reports whether u is newer than s, following the SWIM precedence rules.
+func (u memberState) overrides(s memberState) bool {
+	if u.Incarnation != s.Incarnation {
+		return u.Incarnation > s.Incarnation
+	}
+	return u.State.rank() > s.State.rank()
+}
+
+func (u memberState) routable() bool {
+	return u.Host != "" && u.State != stateDead
+}
+
+type member struct {
+	memberState
+	// changed is when the state last changed, used to time suspicions out.
+	changed time.Time
+}
+
+type messageType string
+
+const (
+	messagePing    messageType = "ping"
+	messagePingReq messageType = "ping-req"
+	messageAck     messageType = "ack"
+)
+
+type message struct {
+	Type messageType `json:"type"`
+	Seq  uint64      `json:"seq"`
+	// Target is the member a ping-req asks to probe.
+	Target string `json:"target,omitempty"`
+	// Join asks for the whole membership in the ack, and marks the ack of a join.
+	Join    bool          `json:"join,omitempty"`
+	Updates []memberState `json:"updates,omitempty"`
+}
+
+type broadcast struct {
+	update    memberState
+	transmits int
+}
+
+// forward is a ping-req being served: the ack of the probe is relayed to origin with seq.
+type forward struct {
+	origin *net.UDPAddr
+	seq    uint64
+}
+
+// memberlist runs the SWIM failure detector and disseminates membership updates by piggybacking
+// them on the probe messages.
+type memberlist struct {
+	config  Config
+	conn    *net.UDPConn
+	self    string
+	changed chan struct{}
+	onError func(error)
+
+	mu       sync.Mutex
+	members  map[string]*member
+	queue    map[string]*broadcast
+	seq      uint64
+	pending  map[uint64]chan struct{}
+	forwards map[uint64]forward
+	order    []string
+	received time.Time
+	// joined is whether a seed acked a join.
+	joined bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// newMemberlist listens on the bind address. changed is signaled, without blocking, whenever the
+// routable members change.
+func newMemberlist(config Config, changed chan struct{}, onError func(error)) (*memberlist, error) {
+	addr, err := net.ResolveUDPAddr("udp", config.Bind)
+	if err != nil {
+		return nil, fmt.Errorf("resolve gossip bind address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen for gossip: %w", err)
+	}
+	self, err := config.address(conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l := &memberlist{
+		config:   config,
+		conn:     conn,
+		self:     self,
+		changed:  changed,
+		onError:  onError,
+		members:  make(map[string]*member),
+		queue:    make(map[string]*broadcast),
+		pending:  make(map[uint64]chan struct{}),
+		forwards: make(map[uint64]forward),
+		stop:     make(chan struct{}),
+	}
+	// A restarted member must override the dead state others remember it with, so incarnations start at the clock.
+	l.members[self] = &member{
+		memberState: memberState{Name: self, Host: config.Host, Weight: config.Weight, Incarnation: uint64(time.Now().UnixNano()), State: stateAlive},
+		changed:     time.Now(),
+	}
+	l.enqueue(l.members[self].memberState)
+	return l, nil
+}
+
+func (l *memberlist) start() {
+	l.wg.Add(3)
+	go l.receiveLoop()
+	go l.probeLoop()
+	go l.joinLoop()
+}
+
+// leave tells some members we are gone and stops.
+func (l *memberlist) leave() {
+	l.mu.Lock()
+	self := l.members[l.self]
+	self.State = stateDead
+	self.Incarnation++
+	peers := l.peers(l.config.IndirectChecks, "")
+	l.mu.Unlock()
+	// Our own state rides on every message, so a ping is enough to spread the news.
+	for _, peer := range peers {
+		l.sendTo(peer, message{Type: messagePing, Seq: l.nextSeq()})
+	}
+	l.shutdown()
+}
+
+// shutdown stops without telling anyone, as if the member crashed.
+func (l *memberlist) shutdown() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		l.conn.Close()
+	})
+	l.wg.Wait()
+}
+
+// routable returns the members users can be routed to. Suspect members still are until they are declared dead.
+func (l *memberlist) routable() []memberState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	members := make([]memberState, 0, len(l.members))
+	for _, m := range l.members {
+		if m.routable() {
+			members = append(members, m.memberState)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members
+}
+
+// lastReceived is when a message was last received from another member.
+func (l *memberlist) lastReceived() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.received
+}
+
+func (l *memberlist) nextSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	return l.seq
+}
+
+func (l *memberlist) receiveLoop() {
+	defer l.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.stop:
+				return
+			default:
+			}
+			l.onError(fmt.Errorf("read gossip message: %w", err))
+			continue
+		}
+		data, ok := l.open(buf[:n])
+		if !ok {
+			l.onError(fmt.Errorf("drop gossip message from %s: not signed with the key", addr))
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			l.onError(fmt.Errorf("decode gossip message from %s: %w", addr, err))
+			continue
+		}
+		l.handle(msg, addr)
+	}
+}
+
+func (l *memberlist) handle(msg message, addr *net.UDPAddr) {
+	l.mu.Lock()
+	l.received = time.Now()
+	notify := false
+	for _, update := range msg.Updates {
+		notify = l.merge(update) || notify
+	}
+	l.mu.Unlock()
+	if notify {
+		l.notify()
+	}
+
+	switch msg.Type {
+	case messagePing:
+		l.send(addr, message{Type: messageAck, Seq: msg.Seq, Join: msg.Join}, msg.Join)
+	case messagePingReq:
+		seq := l.nextSeq()
+		l.mu.Lock()
+		l.forwards[seq] = forward{origin: addr, seq: msg.Seq}
+		l.mu.Unlock()
+		time.AfterFunc(l.config.ProbeInterval, func() {
+			l.mu.Lock()
+			delete(l.forwards, seq)
+			l.mu.Unlock()
+		})
+		l.sendTo(msg.Target, message{Type: messagePing, Seq: seq})
+	case messageAck:
+		l.mu.Lock()
+		l.joined = l.joined || msg.Join
+		acked, ok := l.pending[msg.Seq]
+		if ok {
+			delete(l.pending, msg.Seq)
+		}
+		relay, relayed := l.forwards[msg.Seq]
+		delete(l.forwards, msg.Seq)
+		l.mu.Unlock()
+		if ok {
+			close(acked)
+		}
+		if relayed {
+			l.send(relay.origin, message{Type: messageAck, Seq: relay.seq}, false)
+		}
+	}
+}
+
+// merge applies an update and queues it for dissemination when it is news. It returns whether the
+// routable members changed. The caller must hold the lock.
+func (l *memberlist) merge(update memberState) bool {
+	if update.Name == l.self {
+		self := l.members[l.self]
+		if update.State != stateAlive && update.Incarnation >= self.Incarnation && self.State == stateAlive {
+			// Refute the suspicion with a newer incarnation.
+			self.Incarnation = update.Incarnation + 1
+			l.enqueue(self.memberState)
+		}
+		return false
+	}
+	current, ok := l.members[update.Name]
+	if ok && !update.overrides(current.memberState) {
+		return false
+	}
+	wasRoutable := ok && current.routable()
+	var previous memberState
+	if ok {
+		previous = current.memberState
+	}
+	l.members[update.Name] = &member{memberState: update, changed: time.Now()}
+	l.enqueue(update)
+	if update.routable() != wasRoutable {
+		return true
+	}
+	return update.routable() && (update.Host != previous.Host || update.Weight != previous.Weight)
+}
+
+// enqueue replaces the pending broadcast of the member. The caller must hold the lock.
+func (l *memberlist) enqueue(update memberState) {
+	l.queue[update.Name] = &broadcast{update: update}
+}
+
+// notify signals that the routable members changed.
+func (l *memberlist) notify() {
+	select {
+	case l.changed <- struct{}{}:
+	default:
+	}
+}
+
+// piggyback picks the least transmitted updates and drops the ones sent often enough to have
+// reached everyone. Our own state always rides along. The caller must hold the lock.
+func (l *memberlist) piggyback(all bool) []memberState {
+	updates := []memberState{l.members[l.self].memberState}
+	if all {
+		for name, m := range l.members {
+			if name != l.self && m.State != stateDead {
+				updates = append(updates, m.memberState)
+			}
+		}
+		return updates
+	}
+	pending := make([]*broadcast, 0, len(l.queue))
+	for _, b := range l.queue {
+		if b.update.Name != l.self {
+			pending = append(pending, b)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].transmits < pending[j].transmits
+	})
+	limit := retransmitLimit(len(l.members))
+	for _, b := range pending {
+		if len(updates) >= maxPiggyback {
+			break
+		}
+		updates = append(updates, b.update)
+		b.transmits++
+		if b.transmits >= limit {
+			delete(l.queue, b.update.Name)
+		}
+	}
+	return updates
+}
+
+// retransmitLimit is how many times an update is sent, scaling with the log of the cluster size.
+func retransmitLimit(members int) int {
+	return 3 * int(math.Ceil(math.Log2(float64(members+1))+1))
+}
+
+func (l *memberlist) send(addr *net.UDPAddr, msg message, all bool) {
+	l.mu.Lock()
+	msg.Updates = l.piggyback(all)
+	l.mu.Unlock()
+	data, err := json.Marshal(msg)
+	for err == nil && len(data) > maxPacketSize-sha256.Size && len(msg.Updates) > 1 {
+		msg.Updates = msg.Updates[:len(msg.Updates)/2]
+		data, err = json.Marshal(msg)
+	}
+	if err != nil {
+		l.onError(fmt.Errorf("encode gossip message: %w", err))
+		return
+	}
+	data = l.seal(data)
+	if _, err := l.conn.WriteToUDP(data, addr); err != nil {
+		select {
+		case <-l.stop:
+		default:
+			l.onError(fmt.Errorf("send gossip message to %s: %w", addr, err))
+		}
+	}
+}
+
+// seal appends the HMAC-SHA256 of data under the key, when one is configured.
+func (l *memberlist) seal(data []byte) []byte {
+	if len(l.config.Key) == 0 {
+		return data
+	}
+	mac := hmac.New(sha256.New, l.config.Key)
+	mac.Write(data)
+	return mac.Sum(data)
+}
+
+// open returns the message of a packet, and false when it isn't sealed with the key.
+func (l *memberlist) open(packet []byte) ([]byte, bool) {
+	if len(l.config.Key) == 0 {
+		return packet, true
+	}
+	if len(packet) < sha256.Size {
+		return nil, false
+	}
+	data, sum := packet[:len(packet)-sha256.Size], packet[len(packet)-sha256.Size:]
+	mac := hmac.New(sha256.New, l.config.Key)
+	mac.Write(data)
+	return data, hmac.Equal(sum, mac.Sum(nil))
+}
+
+func (l *memberlist) sendTo(name string, msg message) {
+	addr, err := net.ResolveUDPAddr("udp", name)
+	if err != nil {
+		l.onError(fmt.Errorf("resolve gossip member %s: %w", name, err))
+		return
+	}
+	l.send(addr, msg, msg.Join)
+}
+
+// peers returns up to n random live members other than us and exclude. The caller must hold the lock.
+func (l *memberlist) peers(n int, exclude string) []string {
+	peers := make([]string, 0, len(l.members))
+	for name, m := range l.members {
+		if name != l.self && name != exclude && m.State != stateDead {
+			peers = append(peers, name)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// nextTarget returns the next member to probe, going round-robin over a shuffled order.
+func (l *memberlist) nextTarget() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.order) > 0 {
+		target := l.order[0]
+		l.order = l.order[1:]
+		if m, ok := l.members[target]; ok && m.State != stateDead {
+			return target
+		}
+	}
+	l.order = l.peers(len(l.members), "")
+	if len(l.order) == 0 {
+		return ""
+	}
+	target := l.order[0]
+	l.order = l.order[1:]
+	return target
+}
+
+func (l *memberlist) probeLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		if target := l.nextTarget(); target != "" {
+			l.probe(target)
+		}
+		l.expireSuspects()
+	}
+}
+
+// probe pings target, asks other members to ping it when it doesn't answer in time and suspects it
+// when nobody got an answer within the probe interval.
+func (l *memberlist) probe(target string) {
+	seq := l.nextSeq()
+	acked := make(chan struct{})
+	l.mu.Lock()
+	l.pending[seq] = acked
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.pending, seq)
+		l.mu.Unlock()
+	}()
+
+	l.sendTo(target, message{Type: messagePing, Seq: seq})
+	select {
+	case <-acked:
+		return
+	case <-l.stop:
+		return
+	case <-time.After(l.config.ProbeTimeout):
+	}
+	l.mu.Lock()
+	helpers := l.peers(l.config.IndirectChecks, target)
+	l.mu.Unlock()
+	for _, helper := range helpers {
+		l.sendTo(helper, message{Type: messagePingReq, Seq: seq, Target: target})
+	}
+	select {
+	case <-acked:
+		return
+	case <-l.stop:
+		return
+	case <-time.After(l.config.ProbeInterval - l.config.ProbeTimeout):
+	}
+
+	l.mu.Lock()
+	m, ok := l.members[target]
+	if ok && m.State == stateAlive {
+		l.merge(memberState{Name: target, Host: m.Host, Weight: m.Weight, Incarnation: m.Incarnation, State: stateSuspect})
+	}
+	l.mu.Unlock()
+}
+
+// expireSuspects declares the members suspected for longer than the suspicion timeout dead, and
+// forgets the members dead for long enough.
+func (l *memberlist) expireSuspects() {
+	l.mu.Lock()
+	notify := false
+	now := time.Now()
+	for name, m := range l.members {
+		switch {
+		case m.State == stateSuspect && now.Sub(m.changed) > l.config.SuspicionTimeout:
+			dead := m.memberState
+			dead.State = stateDead
+			notify = l.merge(dead) || notify
+		case m.State == stateDead && now.Sub(m.changed) > deadRetention*l.config.SuspicionTimeout:
+			delete(l.members, name)
+			delete(l.queue, name)
+		}
+	}
+	l.mu.Unlock()
+	if notify {
+		l.notify()
+	}
+}
+
+// needsJoin reports whether no seed acked a join yet, or we don't know any live member.
+func (l *memberlist) needsJoin() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.joined {
+		return true
+	}
+	for name, m := range l.members {
+		if name != l.self && m.State != stateDead {
+			return false
+		}
+	}
+	return true
+}
+
+// joinLoop contacts the seeds until one of them answers, and again whenever we know nobody after a
+// partition. Being found by another member doesn't count as joining, the two of them could be split
+// from the rest.
+func (l *memberlist) joinLoop() {
+	defer l.wg.Done()
+	for {
+		if l.needsJoin() {
+			if err := l.join(); err != nil {
+				l.onError(err)
+			}
+		}
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(l.config.ProbeInterval):
+		}
+	}
+}
+
+// join resolves the seeds and sends them a join ping, whose ack carries their membership.
+func (l *memberlist) join() error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.config.ProbeInterval)
+	defer cancel()
+	var errs []error
+	for _, seed := range l.config.Seeds {
+		addrs, err := resolveSeed(ctx, seed)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, addr := range addrs {
+			if addr == l.self {
+				continue
+			}
+			l.sendTo(addr, message{Type: messagePing, Seq: l.nextSeq(), Join: true})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveSeed returns the gossip address of every address a host:port seed resolves to.
+func resolveSeed(ctx context.Context, seed string) ([]string, error) {
+	host, port, err := net.SplitHostPort(seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gossip seed %q, expected host:port: %w", seed, err)
+	}
+	if net.ParseIP(host) != nil {
+		return []string{seed}, nil
+	}
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve gossip seed %s: %w", seed, err)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,170 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultHeader is the request header identity is read from when no source is configured.
+const DefaultHeader = "ws-user-id"
+
+// TrustedHeader carries the identity a hop resolved to the next one: from the load balancer to the
+// sidecar and from the sidecar to the application. Clients never reach the next hop with their own
+// headers, so it can be trusted there.
+const TrustedHeader = "x-ws-operator-user-id"
+
+// ErrNoIdentity is returned when a request doesn't carry an identity in the source.
+var ErrNoIdentity = errors.New("no identity in request")
+
+// Extractor resolves the user a websocket upgrade request belongs to.
+type Extractor interface {
+	Extract(r *http.Request) (string, error)
+}
+
+// ProtocolSelector is implemented by extractors reading Sec-WebSocket-Protocol. Browsers fail the
+// handshake unless the server echoes one of the offered subprotocols, so upgraders select the one it
+// accepts.
+type ProtocolSelector interface {
+	SelectProtocol(protocol string) bool
+}
+
+// Protocol returns the subprotocol select function of an upgrader for e, nil when e doesn't read
+// Sec-WebSocket-Protocol.
+func Protocol(e Extractor) func(string) bool {
+	if selector, ok := e.(ProtocolSelector); ok {
+		return selector.SelectProtocol
+	}
+	return nil
+}
+
+// Header reads the identity from a request header.
+type Header struct {
+	Name string
+}
+
+func (h Header) Extract(r *http.Request) (string, error) {
+	return nonEmpty(r.Header.Get(h.Name), h)
+}
+
+func (h Header) String() string {
+	return "header:" + h.Name
+}
+
+// Query reads the identity from a query parameter of the upgrade URL.
+type Query struct {
+	Name string
+}
+
+func (q Query) Extract(r *http.Request) (string, error) {
+	return nonEmpty(r.URL.Query().Get(q.Name), q)
+}
+
+func (q Query) String() string {
+	return "query:" + q.Name
+}
+
+// Cookie reads the identity from a cookie.
+type Cookie struct {
+	Name string
+}
+
+func (c Cookie) Extract(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(c.Name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrNoIdentity, c)
+	}
+	return nonEmpty(cookie.Value, c)
+}
+
+func (c Cookie) String() string {
+	return "cookie:" + c.Name
+}
+
+// Subprotocol reads the identity from the offered Sec-WebSocket-Protocol value starting with Prefix,
+// like user.alice for the prefix user., the one way a browser can send a value on the handshake
+// besides the URL and cookies.
+type Subprotocol struct {
+	Prefix string
+}
+
+func (s Subprotocol) Extract(r *http.Request) (string, error) {
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(protocol), s.Prefix); ok && value != "" {
+				return value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrNoIdentity, s)
+}
+
+// SelectProtocol accepts the subprotocol carrying the identity.
+func (s Subprotocol) SelectProtocol(protocol string) bool {
+	return strings.HasPrefix(protocol, s.Prefix) && len(protocol) > len(s.Prefix)
+}
+
+func (s Subprotocol) String() string {
+	return "subprotocol:" + s.Prefix
+}
+
+// Chain tries its extractors in order, returning the first identity found.
+type Chain []Extractor
+
+func (c Chain) Extract(r *http.Request) (string, error) {
+	errs := make([]error, 0, len(c))
+	for _, e := range c {
+		identity, err := e.Extract(r)
+		if err == nil {
+			return identity, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
+
+// SelectProtocol accepts the subprotocols of the extractors in the chain.
+func (c Chain) SelectProtocol(protocol string) bool {
+	for _, e := range c {
+		if selector, ok := e.(ProtocolSelector); ok && selector.SelectProtocol(protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Chain) String() string {
+	sources := make([]string, len(c))
+	for i, e := range c {
+		sources[i] = fmt.Sprint(e)
+	}
+	return strings.Join(sources, ",")
+}
+
+// Forwarded trusts the identity a previous hop resolved in TrustedHeader, and falls back to Next for
+// requests coming straight from clients.
+type Forwarded struct {
+	Next Extractor
+}
+
+func (f Forwarded) Extract(r *http.Request) (string, error) {
+	if identity := r.Header.Get(TrustedHeader); identity != "" {
+		return identity, nil
+	}
+	return f.Next.Extract(r)
+}
+
+func (f Forwarded) SelectProtocol(protocol string) bool {
+	if selector := Protocol(f.Next); selector != nil {
+		return selector(protocol)
+	}
+	return false
+}
+
+func nonEmpty(identity string, source fmt.Stringer) (string, error) {
+	if identity == "" {
+		return "", fmt.Errorf("%w: %s", ErrNoIdentity, source)
+	}
+	return identity, nil
+}
@@ -0,0 +1,107 @@
+package identity
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// unsignedToken builds a JWT with the claims, which Claim reads without verifying.
+func unsignedToken(claims string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"none"}`)) + "." + encode([]byte(claims)) + "."
+}
+
+func TestExtractors(t *testing.T) {
+	token := unsignedToken(`{"sub":"alice","tenant":42}`)
+	cases := []struct {
+		name    string
+		spec    string
+		request func(r *http.Request)
+	}{
+		{"default header", "", func(r *http.Request) { r.Header.Set(DefaultHeader, "alice") }},
+		{"header", "header:x-user", func(r *http.Request) { r.Header.Set("x-user", "alice") }},
+		{"query", "query:user", func(r *http.Request) { r.URL.RawQuery = "user=alice" }},
+		{"cookie", "cookie:session-user", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session-user", Value: "alice"}) }},
+		{"subprotocol", "subprotocol:user.", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "chat, user.alice") }},
+		{"jwt bearer", "jwt:sub", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }},
+		{"jwt query", "jwt:sub", func(r *http.Request) { r.URL.RawQuery = "access_token=" + token }},
+		{"jwt cookie", "jwt:sub:cookie:token", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "token", Value: token}) }},
+		{"chain", "header:x-user,query:user", func(r *http.Request) { r.URL.RawQuery = "user=alice" }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, err := Parse(c.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if _, err := e.Extract(r); !errors.Is(err, ErrNoIdentity) {
+				t.Fatalf("expected no identity without the source, got %v", err)
+			}
+			c.request(r)
+			identity, err := e.Extract(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity != "alice" {
+				t.Fatalf("expected alice, got %q", identity)
+			}
+		})
+	}
+}
+
+func TestClaim(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+unsignedToken(`{"sub":"alice","tenant":42}`))
+	if identity, err := (Claim{Name: "tenant"}).Extract(r); err != nil || identity != "42" {
+		t.Fatalf("expected a number claim to be formatted, got %q %v", identity, err)
+	}
+	if _, err := (Claim{Name: "email"}).Extract(r); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("expected a missing claim to have no identity, got %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer not-a-token")
+	if _, err := (Claim{Name: "sub"}).Extract(r); err == nil {
+		t.Fatal("expected a malformed token to be rejected")
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	if Protocol(Header{Name: DefaultHeader}) != nil {
+		t.Fatal("expected no subprotocol selection for a header")
+	}
+	e, err := Parse("header:x-user,subprotocol:user.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := Protocol(e)
+	if selector == nil || !selector("user.alice") || selector("chat") || selector("user.") {
+		t.Fatal("expected only the subprotocol carrying the identity to be selected")
+	}
+	if selector := Protocol(Claim{Name: "sub", Token: Subprotocol{Prefix: "token."}}); selector == nil || !selector("token.abc") {
+		t.Fatal("expected the subprotocol carrying the token to be selected")
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	e := Forwarded{Next: Query{Name: "user"}}
+	r := httptest.NewRequest(http.MethodGet, "/?user=mallory", nil)
+	r.Header.Set(TrustedHeader, "alice")
+	if identity, _ := e.Extract(r); identity != "alice" {
+		t.Fatalf("expected the forwarded identity, got %q", identity)
+	}
+	r.Header.Del(TrustedHeader)
+	if identity, _ := e.Extract(r); identity != "mallory" {
+		t.Fatalf("expected the client identity without a previous hop, got %q", identity)
+	}
+}
+
+func TestParseRejectsInvalidSources(t *testing.T) {
+	for _, spec := range []string{"header", "header:", "body:user", "jwt:sub:jwt:sub", "query:user,"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package identity
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultToken is where a Claim reads its token from when no source is configured: the Authorization
+// bearer header, or the access_token query parameter for browsers.
+var DefaultToken Extractor = Chain{Header{Name: "Authorization"}, Query{Name: "access_token"}}
+
+// Claim reads the identity from a claim of a JWT.
+type Claim struct {
+	// Name is the claim holding the identity, like sub.
+	Name string
+	// Token is where the token is read from, DefaultToken when nil. A Bearer prefix is dropped.
+	Token Extractor
+}
+
+func (c Claim) Extract(r *http.Request) (string, error) {
+	token, err := c.token(r)
+	if err != nil {
+		return "", err
+	}
+	claims, err := decodeClaims(token)
+	if err != nil {
+		return "", err
+	}
+	return claimString(claims, c.Name)
+}
+
+func (c Claim) token(r *http.Request) (string, error) {
+	source := c.Token
+	if source == nil {
+		source = DefaultToken
+	}
+	token, err := source.Extract(r)
+	if err != nil {
+		return "", err
+	}
+	if value, ok := strings.CutPrefix(token, "Bearer "); ok {
+		token = strings.TrimSpace(value)
+	}
+	return token, nil
+}
+
+// SelectProtocol accepts the subprotocol carrying the token.
+func (c Claim) SelectProtocol(protocol string) bool {
+	if selector := Protocol(c.Token); selector != nil {
+		return selector(protocol)
+	}
+	return false
+}
+
+func (c Claim) String() string {
+	if c.Token == nil {
+		return "jwt:" + c.Name
+	}
+	return fmt.Sprintf("jwt:%s:%s", c.Name, c.Token)
+}
+
+// decodeClaims returns the claims of a compact JWT, without verifying it.
+func decodeClaims(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	return claims, nil
+}
+
+// claimString returns a string or number claim as the identity.
+func claimString(claims map[string]any, name string) (string, error) {
+	switch value := claims[name].(type) {
+	case string:
+		if value != "" {
+			return value, nil
+		}
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("%w: token claim %s", ErrNoIdentity, name)
+}
@@ -0,0 +1,66 @@
+package identity
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parse builds an extractor from a comma-separated list of sources tried in order:
+//
+//	header:<name>          a request header
+//	query:<name>           a query parameter
+//	cookie:<name>          a cookie
+//	subprotocol:<prefix>   the Sec-WebSocket-Protocol value starting with prefix
+//	jwt:<claim>[:<source>] a claim of the JWT read from source, the Authorization header or the
+//	                       access_token query parameter by default
+//
+// An empty spec reads the DefaultHeader.
+func Parse(spec string) (Extractor, error) {
+	if strings.TrimSpace(spec) == "" {
+		return Header{Name: DefaultHeader}, nil
+	}
+	sources := strings.Split(spec, ",")
+	chain := make(Chain, 0, len(sources))
+	for _, source := range sources {
+		e, err := parseSource(strings.TrimSpace(source))
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, e)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+func parseSource(source string) (Extractor, error) {
+	kind, arg, _ := strings.Cut(source, ":")
+	if arg == "" {
+		return nil, fmt.Errorf("identity source %q needs a name", source)
+	}
+	switch kind {
+	case "header":
+		return Header{Name: arg}, nil
+	case "query":
+		return Query{Name: arg}, nil
+	case "cookie":
+		return Cookie{Name: arg}, nil
+	case "subprotocol":
+		return Subprotocol{Prefix: arg}, nil
+	case "jwt":
+		claim, tokenSource, ok := strings.Cut(arg, ":")
+		if !ok {
+			return Claim{Name: claim}, nil
+		}
+		if strings.HasPrefix(tokenSource, "jwt:") {
+			return nil, fmt.Errorf("identity source %q reads its token from another token", source)
+		}
+		token, err := parseSource(tokenSource)
+		if err != nil {
+			return nil, err
+		}
+		return Claim{Name: claim, Token: token}, nil
+	}
+	return nil, fmt.Errorf("unknown identity source %q, expected header, query, cookie, subprotocol or jwt", kind)
+}
@@ -0,0 +1,71 @@
+package jwt
+
+import (
+	"fmt"
+	"lukas8219/websocket-operator/internal/identity"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultUserClaim is the claim the user id is read from when none is configured.
+const DefaultUserClaim = "sub"
+
+// Session is the user a verified token authenticates, until the token expires.
+type Session struct {
+	User string
+	// Expires is when the token stops being accepted, its exp claim plus the leeway of the verifier.
+	Expires time.Time
+}
+
+// Authenticator authenticates websocket upgrade requests with the JWT they carry.
+type Authenticator struct {
+	Verifier *Verifier
+	// Claim holds the user id, DefaultUserClaim when empty.
+	Claim string
+	// Token is where the token is read from, identity.DefaultToken when nil. A Bearer prefix is dropped.
+	Token identity.Extractor
+}
+
+// Authenticate verifies the token of r and returns the user it authenticates.
+func (a *Authenticator) Authenticate(r *http.Request) (Session, error) {
+	source := a.Token
+	if source == nil {
+		source = identity.DefaultToken
+	}
+	token, err := source.Extract(r)
+	if err != nil {
+		return Session{}, err
+	}
+	if value, ok := strings.CutPrefix(token, "Bearer "); ok {
+		token = strings.TrimSpace(value)
+	}
+	claims, err := a.Verifier.Verify(token)
+	if err != nil {
+		return Session{}, err
+	}
+	claim := a.Claim
+	if claim == "" {
+		claim = DefaultUserClaim
+	}
+	user, ok := claims.String(claim)
+	if !ok {
+		return Session{}, fmt.Errorf("%w: token claim %s", identity.ErrNoIdentity, claim)
+	}
+	expires, _ := claims.Expiry()
+	return Session{User: user, Expires: expires.Add(a.Verifier.config.Leeway)}, nil
+}
+
+// Extract returns the user the token of r authenticates, making an Authenticator an identity source.
+func (a *Authenticator) Extract(r *http.Request) (string, error) {
+	session, err := a.Authenticate(r)
+	return session.User, err
+}
+
+// SelectProtocol accepts the subprotocol carrying the token.
+func (a *Authenticator) SelectProtocol(protocol string) bool {
+	if selector := identity.Protocol(a.Token); selector != nil {
+		return selector(protocol)
+	}
+	return false
+}
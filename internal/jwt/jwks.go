@@ -0,0 +1,279 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRefreshInterval is how often the key set is reloaded to pick up rotated keys.
+	DefaultRefreshInterval = 5 * time.Minute
+	// DefaultMinRefreshInterval bounds how often a token signed by an unknown key reloads the key set,
+	// so tokens with made-up key ids can't hammer the JWKS endpoint.
+	DefaultMinRefreshInterval = 30 * time.Second
+	fetchTimeout              = 10 * time.Second
+)
+
+// KeySet holds the public keys of a JWKS read from a local file or an http(s) URL. Keys are cached and
+// the set is reloaded every refresh interval and when a token names a key it doesn't know, which is
+// how a rotated signing key is picked up. It is safe for concurrent use.
+type KeySet struct {
+	source             string
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	client             *http.Client
+
+	mu      sync.RWMutex
+	keys    []key
+	fetched time.Time
+	// refreshMu serializes reloads so concurrent misses fetch the set once.
+	refreshMu sync.Mutex
+	logger    *slog.Logger
+}
+
+type key struct {
+	id        string
+	algorithm string
+	public    crypto.PublicKey
+}
+
+// NewKeySet loads the JWKS at source, a file path or an http(s) URL.
+func NewKeySet(source string, refreshInterval time.Duration) (*KeySet, error) {
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultRefreshInterval
+	}
+	s := &KeySet{
+		source:             source,
+		refreshInterval:    refreshInterval,
+		minRefreshInterval: min(DefaultMinRefreshInterval, refreshInterval),
+		client:             &http.Client{Timeout: fetchTimeout},
+		logger:             slog.With("component", "jwks", "source", source),
+	}
+	if err := s.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run reloads the key set every refresh interval until ctx is done. A failed reload keeps the cached
+// keys.
+func (s *KeySet) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Refresh(ctx); err != nil {
+				s.logger.Error("Failed to refresh key set, keeping the cached keys", "error", err)
+			}
+		}
+	}
+}
+
+// Refresh reloads the key set.
+func (s *KeySet) Refresh(ctx context.Context) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	return s.refresh(ctx)
+}
+
+func (s *KeySet) refresh(ctx context.Context) error {
+	data, err := s.read(ctx)
+	if err != nil {
+		return err
+	}
+	keys, skipped, err := parseKeySet(data)
+	if err != nil {
+		return err
+	}
+	for _, err := range skipped {
+		s.logger.Info("Skipped a key of the key set", "error", err)
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.fetched = time.Now()
+	s.mu.Unlock()
+	s.logger.Debug("Loaded key set", "keys", len(keys))
+	return nil
+}
+
+func (s *KeySet) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		return os.ReadFile(s.source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", s.source, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// lookup returns the keys a token signed with algorithm under the key id may be verified with, every
+// key of the algorithm when the token names none.
+func (s *KeySet) lookup(id, algorithm string) []crypto.PublicKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]crypto.PublicKey, 0, 1)
+	for _, k := range s.keys {
+		if (id == "" || k.id == id) && (k.algorithm == "" || k.algorithm == algorithm) {
+			keys = append(keys, k.public)
+		}
+	}
+	return keys
+}
+
+// keysFor returns the keys for a token, reloading the set once when the key id is unknown and the set
+// wasn't reloaded in the last minimum refresh interval.
+func (s *KeySet) keysFor(id, algorithm string) []crypto.PublicKey {
+	if keys := s.lookup(id, algorithm); len(keys) > 0 || id == "" {
+		return keys
+	}
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	s.mu.RLock()
+	stale := time.Since(s.fetched) >= s.minRefreshInterval
+	s.mu.RUnlock()
+	if stale {
+		s.logger.Info("Token signed by an unknown key, reloading key set", "kid", id)
+		if err := s.refresh(context.Background()); err != nil {
+			s.logger.Error("Failed to refresh key set", "error", err)
+		}
+	}
+	return s.lookup(id, algorithm)
+}
+
+// jsonWebKey is a JWK as defined in RFC 7517, with the members of the supported key types.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseKeySet parses the signing keys of a JWKS document. Encryption keys and key types other than
+// RSA, EC and Ed25519 are skipped, and so are the keys that can't be parsed, like ones on an unsupported
+// curve, which are returned in skipped. The document is only rejected when no signing key is left.
+func parseKeySet(data []byte) (keys []key, skipped []error, err error) {
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, nil, fmt.Errorf("invalid key set: %w", err)
+	}
+	keys = make([]key, 0, len(document.Keys))
+	for _, jwk := range document.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		public, err := jwk.publicKey()
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("invalid key %q: %w", jwk.Kid, err))
+			continue
+		}
+		if public == nil {
+			continue
+		}
+		keys = append(keys, key{id: jwk.Kid, algorithm: jwk.Alg, public: public})
+	}
+	if len(keys) == 0 {
+		return nil, skipped, errors.Join(append([]error{errors.New("key set has no signing keys")}, skipped...)...)
+	}
+	return keys, skipped, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	if value == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,218 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrUnknownKey       = errors.New("token signed by an unknown key")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrExpired          = errors.New("token is expired")
+	ErrNotYetValid      = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("invalid token issuer")
+	ErrInvalidAudience  = errors.New("invalid token audience")
+)
+
+// algorithms maps the supported JWS algorithms to their hash, Ed25519 signing the message itself.
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// Claims are the claims of a verified token.
+type Claims map[string]any
+
+// String returns a string or number claim.
+func (c Claims) String(name string) (string, bool) {
+	switch value := c[name].(type) {
+	case string:
+		return value, value != ""
+	case json.Number:
+		return value.String(), true
+	}
+	return "", false
+}
+
+// Expiry returns the exp claim.
+func (c Claims) Expiry() (time.Time, bool) {
+	return c.time("exp")
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	number, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// audience returns the aud claim, a string or a list of strings.
+func (c Claims) audience() []string {
+	switch value := c["aud"].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		audience := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+		return audience
+	}
+	return nil
+}
+
+// Config configures a Verifier.
+type Config struct {
+	// Issuer must match the iss claim when set.
+	Issuer string
+	// Audience must be one of the aud claim when set.
+	Audience string
+	// Leeway tolerates clock skew on the exp and nbf claims.
+	Leeway time.Duration
+}
+
+// Verifier verifies the signature of tokens against a KeySet and their registered claims. Tokens
+// without an exp claim are rejected, a connection must not outlive its token.
+type Verifier struct {
+	keys   *KeySet
+	config Config
+	now    func() time.Time
+}
+
+func NewVerifier(keys *KeySet, config Config) *Verifier {
+	return &Verifier{keys: keys, config: config, now: time.Now}
+}
+
+// Verify returns the claims of a compact JWS token once its signature, expiry, issuer and audience are
+// checked.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if _, ok := algorithms[header.Alg]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlg, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	keys := v.keys.keysFor(header.Kid, header.Alg)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, header.Kid)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !slices.ContainsFunc(keys, func(key crypto.PublicKey) bool { return verify(header.Alg, key, signed, signature) }) {
+		return nil, ErrInvalidSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) validate(claims Claims) error {
+	now := v.now()
+	expiry, ok := claims.Expiry()
+	if !ok {
+		return fmt.Errorf("%w: no exp claim", ErrExpired)
+	}
+	if !now.Before(expiry.Add(v.config.Leeway)) {
+		return ErrExpired
+	}
+	if notBefore, ok := claims.time("nbf"); ok && now.Add(v.config.Leeway).Before(notBefore) {
+		return ErrNotYetValid
+	}
+	if v.config.Issuer != "" {
+		if issuer, _ := claims.String("iss"); issuer != v.config.Issuer {
+			return fmt.Errorf("%w: %q", ErrInvalidIssuer, issuer)
+		}
+	}
+	if v.config.Audience != "" && !slices.Contains(claims.audience(), v.config.Audience) {
+		return fmt.Errorf("%w: %v", ErrInvalidAudience, claims["aud"])
+	}
+	return nil
+}
+
+// verify checks the signature of signed with key. A key of another type than the algorithm fails.
+func verify(algorithm string, key crypto.PublicKey, signed, signature []byte) bool {
+	hash := algorithms[algorithm]
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch algorithm[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		// ES signatures are r and s concatenated, each the size of the curve.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if algorithm[:2] != "ES" || key.Curve.Params().BitSize != ecdsaBits[algorithm] || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	case ed25519.PublicKey:
+		return algorithm == "EdDSA" && ed25519.Verify(key, signed, signature)
+	}
+	return false
+}
+
+// ecdsaBits is the curve size each ES algorithm is defined for.
+var ecdsaBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
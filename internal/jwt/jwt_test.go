@@ -0,0 +1,313 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var encode = base64.RawURLEncoding.EncodeToString
+
+// signer signs test tokens with a private key published under kid.
+type signer struct {
+	kid       string
+	algorithm string
+	key       crypto.Signer
+}
+
+func newRSASigner(t *testing.T, kid, algorithm string) signer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer{kid: kid, algorithm: algorithm, key: key}
+}
+
+func (s signer) jwk() map[string]string {
+	switch public := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "n": encode(public.N.Bytes()), "e": encode(big.NewInt(int64(public.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": encode(public.X.FillBytes(make([]byte, 32))), "y": encode(public.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": encode(public)}
+	}
+	panic("unsupported key")
+}
+
+func (s signer) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": s.algorithm, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := encode(header) + "." + encode(payload)
+	hash := algorithms[s.algorithm]
+	digest := []byte(signed)
+	if hash != 0 {
+		h := hash.New()
+		h.Write(digest)
+		digest = h.Sum(nil)
+	}
+	var signature []byte
+	var err error
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		if s.algorithm[:2] == "PS" {
+			signature, err = rsa.SignPSS(rand.Reader, key, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, key, digest)
+		signature = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, digest)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + encode(signature)
+}
+
+func keySetJSON(signers ...signer) []byte {
+	keys := make([]map[string]string, len(signers))
+	for i, s := range signers {
+		keys[i] = s.jwk()
+	}
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+	return data
+}
+
+func writeKeySet(t *testing.T, signers ...signer) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keySetJSON(signers...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func validClaims() map[string]any {
+	return map[string]any{"sub": "alice", "iss": "https://issuer", "aud": []string{"websocket", "api"}, "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func TestVerifyAlgorithms(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := []signer{
+		newRSASigner(t, "rs", "RS256"),
+		newRSASigner(t, "ps", "PS384"),
+		{kid: "es", algorithm: "ES256", key: ecKey},
+		{kid: "ed", algorithm: "EdDSA", key: edKey},
+	}
+	keys, err := NewKeySet(writeKeySet(t, signers...), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifier(keys, Config{Issuer: "https://issuer", Audience: "websocket"})
+	for _, s := range signers {
+		t.Run(s.algorithm, func(t *testing.T) {
+			claims, err := verifier.Verify(s.sign(t, validClaims()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user, _ := claims.String("sub"); user != "alice" {
+				t.Fatalf("expected alice, got %q", user)
+			}
+		})
+	}
+
+	// A token claiming another key's algorithm, or signed by a key outside the set, is rejected.
+	forged := signers[0]
+	forged.kid = "es"
+	if _, err := verifier.Verify(forged.sign(t, validClaims())); err == nil {
+		t.Fatal("expected a token verified with a key of another type to be rejected")
+	}
+	impostor := newRSASigner(t, "rs", "RS256")
+	if _, err := verifier.Verify(impostor.sign(t, validClaims())); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected an invalid signature, got %v", err)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	s := newRSASigner(t, "key", "RS256")
+	keys, err := NewKeySet(writeKeySet(t, s), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifier(keys, Config{Issuer: "https://issuer", Audience: "websocket", Leeway: time.Minute})
+	cases := []struct {
+		name  string
+		claim func(claims map[string]any)
+		err   error
+	}{
+		{"expired", func(c map[string]any) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, ErrExpired},
+		{"without expiry", func(c map[string]any) { delete(c, "exp") }, ErrExpired},
+		{"not yet valid", func(c map[string]any) { c["nbf"] = time.Now().Add(2 * time.Minute).Unix() }, ErrNotYetValid},
+		{"other issuer", func(c map[string]any) { c["iss"] = "https://other" }, ErrInvalidIssuer},
+		{"other audience", func(c map[string]any) { c["aud"] = "api" }, ErrInvalidAudience},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims := validClaims()
+			c.claim(claims)
+			if _, err := verifier.Verify(s.sign(t, claims)); !errors.Is(err, c.err) {
+				t.Fatalf("expected %v, got %v", c.err, err)
+			}
+		})
+	}
+
+	t.Run("within leeway", func(t *testing.T) {
+		claims := validClaims()
+		claims["exp"] = time.Now().Add(-30 * time.Second).Unix()
+		if _, err := verifier.Verify(s.sign(t, claims)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		payload, _ := json.Marshal(validClaims())
+		token := encode([]byte(`{"alg":"none"}`)) + "." + encode(payload) + "."
+		if _, err := verifier.Verify(token); !errors.Is(err, ErrUnsupportedAlg) {
+			t.Fatalf("expected alg none to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestKeySetSkipsUnsupportedKeys(t *testing.T) {
+	s := newRSASigner(t, "key", "RS256")
+	unsupported := []map[string]string{
+		{"kty": "EC", "kid": "secp256k1", "crv": "secp256k1", "x": "AA", "y": "AA"},
+		{"kty": "OKP", "kid": "x25519", "crv": "X25519", "x": "AA"},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "AA", "e": "AQAB"},
+		{"kty": "oct", "kid": "symmetric", "k": "AA"},
+		s.jwk(),
+	}
+	data, _ := json.Marshal(map[string]any{"keys": unsupported})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeySet(path, 0)
+	if err != nil {
+		t.Fatalf("expected the unsupported keys to be skipped, got %v", err)
+	}
+	if _, err := NewVerifier(keys, Config{}).Verify(s.sign(t, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ = json.Marshal(map[string]any{"keys": unsupported[:4]})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeySet(path, 0); err == nil {
+		t.Fatal("expected a key set without a supported signing key to be rejected")
+	}
+}
+
+func TestKeySetPicksUpRotatedKeys(t *testing.T) {
+	previous := newRSASigner(t, "2025", "RS256")
+	next := newRSASigner(t, "2026", "RS256")
+	var mu sync.Mutex
+	published, fetches := keySetJSON(previous), 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		w.Write(published)
+	}))
+	t.Cleanup(server.Close)
+
+	keys, err := NewKeySet(server.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.minRefreshInterval = 0
+	verifier := NewVerifier(keys, Config{})
+	if _, err := verifier.Verify(previous.sign(t, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(previous.sign(t, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 {
+		t.Fatalf("expected the key set to be cached, fetched %d times", fetches)
+	}
+
+	mu.Lock()
+	published = keySetJSON(previous, next)
+	mu.Unlock()
+	if _, err := verifier.Verify(next.sign(t, validClaims())); err != nil {
+		t.Fatalf("expected the rotated key to be loaded, got %v", err)
+	}
+
+	// Unknown key ids don't reload the set more than once per minimum refresh interval.
+	keys.minRefreshInterval = time.Hour
+	unknown := newRSASigner(t, "unknown", "RS256")
+	for i := 0; i < 3; i++ {
+		if _, err := verifier.Verify(unknown.sign(t, validClaims())); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("expected an unknown key, got %v", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 2 {
+		t.Fatalf("expected a single reload for the rotated key, fetched %d times", fetches)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	s := newRSASigner(t, "key", "RS256")
+	keys, err := NewKeySet(writeKeySet(t, s), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := validClaims()
+	claims["email"] = "alice@example.com"
+	token := s.sign(t, claims)
+	authenticator := &Authenticator{Verifier: NewVerifier(keys, Config{}), Claim: "email"}
+
+	r := httptest.NewRequest(http.MethodGet, "/?access_token="+token, nil)
+	session, err := authenticator.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.User != "alice@example.com" {
+		t.Fatalf("expected the user from the configured claim, got %q", session.User)
+	}
+	if expires := time.Unix(claims["exp"].(int64), 0); !session.Expires.Equal(expires) {
+		t.Fatalf("expected the session to expire with the token at %v, got %v", expires, session.Expires)
+	}
+
+	lenient := &Authenticator{Verifier: NewVerifier(keys, Config{Leeway: time.Minute}), Claim: "email"}
+	if session, err := lenient.Authenticate(r); err != nil || !session.Expires.Equal(time.Unix(claims["exp"].(int64), 0).Add(time.Minute)) {
+		t.Fatalf("expected the session to last as long as the token is accepted, got %v %v", session.Expires, err)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token[:len(token)-4]+"AAAA")
+	if _, err := authenticator.Authenticate(r); err == nil {
+		t.Fatal("expected a tampered token to be rejected")
+	}
+}
@@ -0,0 +1,48 @@
+package kubernetes
+
+import (
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+const (
+	DefaultNamespace = "default"
+	DefaultService   = "ws-proxy-headless"
+	DefaultPortName  = "ws"
+	// DefaultPort is used for slices listing no ports at all.
+	DefaultPort = 3000
+)
+
+// Config selects the service whose EndpointSlices list the sidecars.
+type Config struct {
+	Namespace string
+	Service   string
+	// PortName is the name of the EndpointPort the sidecars listen on.
+	// Slices with a single port use it whatever its name.
+	PortName string
+}
+
+func (c Config) withDefaults() Config {
+	if c.Namespace == "" {
+		c.Namespace = DefaultNamespace
+	}
+	if c.Service == "" {
+		c.Service = DefaultService
+	}
+	if c.PortName == "" {
+		c.PortName = DefaultPortName
+	}
+	return c
+}
+
+// slicePort returns the port of the sidecars listed in slice.
+func (c Config) slicePort(slice *discoveryv1.EndpointSlice) int32 {
+	for _, port := range slice.Ports {
+		if port.Name != nil && *port.Name == c.PortName && port.Port != nil {
+			return *port.Port
+		}
+	}
+	if len(slice.Ports) == 1 && slice.Ports[0].Port != nil {
+		return *slice.Ports[0].Port
+	}
+	return DefaultPort
+}
@@ -0,0 +1,272 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"lukas8219/websocket-operator/internal/membership"
+	"lukas8219/websocket-operator/internal/rendezvous"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// endpoint is a sidecar listed in an EndpointSlice.
+type endpoint struct {
+	member rendezvous.WeightedMember
+	// ready endpoints receive new users.
+	ready bool
+	// draining endpoints are serving but terminating. They keep their users until they are gone.
+	draining bool
+	port     int32
+	// pod is the name of the pod the endpoint references, if any.
+	pod string
+}
+
+// sliceEndpoints returns the endpoints of a slice, skipping the ones neither ready nor draining.
+func (k *KubernetesRouter) sliceEndpoints(slice *discoveryv1.EndpointSlice) []endpoint {
+	endpoints := make([]endpoint, 0, len(slice.Endpoints))
+	port := k.config.slicePort(slice)
+	for _, e := range slice.Endpoints {
+		if len(e.Addresses) == 0 {
+			continue
+		}
+		conditions := e.Conditions
+		// A nil condition is unknown, which the API asks to treat as ready (and serving) but not terminating.
+		ready := conditions.Ready == nil || *conditions.Ready
+		serving := conditions.Serving == nil || *conditions.Serving
+		terminating := conditions.Terminating != nil && *conditions.Terminating
+		draining := terminating && serving
+		if !ready && !draining {
+			continue
+		}
+		member := rendezvous.NewWeightedMember(e.Addresses[0], k.targetWeight(e.TargetRef))
+		if e.Zone != nil {
+			member = member.WithZone(*e.Zone)
+		} else if e.NodeName != nil {
+			member = member.WithZone(k.nodeZone(*e.NodeName))
+		}
+		pod := ""
+		if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+			pod = e.TargetRef.Name
+		}
+		endpoints = append(endpoints, endpoint{member: member, ready: ready && !terminating, draining: draining, port: port, pod: pod})
+	}
+	return endpoints
+}
+
+// membership merges the endpoints of every slice. An address ready in any slice is ready.
+// The caller must hold the lock.
+func (k *KubernetesRouter) membership() (members, draining []rendezvous.WeightedMember, ports map[string]int32, pods map[string]string) {
+	ready := make(map[string]rendezvous.WeightedMember)
+	terminating := make(map[string]rendezvous.WeightedMember)
+	ports = make(map[string]int32)
+	pods = make(map[string]string)
+	for _, endpoints := range k.slices {
+		for _, e := range endpoints {
+			ports[e.member.Member()] = e.port
+			if e.pod != "" {
+				pods[e.member.Member()] = e.pod
+			}
+			if e.ready {
+				ready[e.member.Member()] = e.member
+			} else if e.draining {
+				terminating[e.member.Member()] = e.member
+			}
+		}
+	}
+	members = make([]rendezvous.WeightedMember, 0, len(ready))
+	for host, member := range ready {
+		members = append(members, member)
+		delete(terminating, host)
+	}
+	draining = make([]rendezvous.WeightedMember, 0, len(terminating))
+	for _, member := range terminating {
+		draining = append(draining, member)
+	}
+	return members, draining, ports, pods
+}
+
+// EndpointEventType is the kind of change of an EndpointEvent.
+type EndpointEventType string
+
+const (
+	// EndpointAdded is sent when a host becomes ready.
+	EndpointAdded EndpointEventType = "added"
+	// EndpointDraining is sent when a host starts terminating. It keeps its users but takes no new ones.
+	EndpointDraining EndpointEventType = "draining"
+	// EndpointRemoved is sent when a host is neither ready nor draining anymore.
+	EndpointRemoved EndpointEventType = "removed"
+)
+
+// EndpointEvent is a membership change of one host.
+type EndpointEvent struct {
+	Type EndpointEventType
+	// Host is the host with its port.
+	Host string
+	// Epoch is the membership epoch the change was observed at.
+	Epoch uint64
+}
+
+// Subscribe calls handler with every endpoint change, in order, from the informer goroutine.
+// handler must not block.
+func (k *KubernetesRouter) Subscribe(handler func(EndpointEvent)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.subscribers = append(k.subscribers, handler)
+}
+
+// publish sends events to the subscribers. It must be called without the lock.
+func (k *KubernetesRouter) publish(events []EndpointEvent) {
+	if len(events) == 0 {
+		return
+	}
+	k.mu.Lock()
+	subscribers := k.subscribers
+	k.mu.Unlock()
+	for _, event := range events {
+		k.Info("Endpoint changed", "event", event.Type, "host", event.Host, "epoch", event.Epoch)
+		for _, handler := range subscribers {
+			handler(event)
+		}
+	}
+}
+
+// applyEndpoints applies the ready and draining endpoints of every slice, rebalancing the recipients
+// whose owner changed, and returns the endpoint events. The caller must hold the lock.
+func (k *KubernetesRouter) applyEndpoints() []EndpointEvent {
+	members, draining, ports, pods := k.membership()
+	oldMembers, oldDraining := k.Members()
+	oldPorts := k.addressing.ports
+	k.Apply(membership.Update{
+		Members:  members,
+		Draining: draining,
+		Swap: func() {
+			k.addressing.ports = ports
+			k.addressing.pods = pods
+		},
+	})
+	return endpointEvents(oldMembers, members, hostSet(oldDraining), hostSet(draining), oldPorts, ports, k.Epoch())
+}
+
+// updateWeight sets the weight of the endpoints of host. It returns false when host has no endpoint,
+// or they already have weight. The caller must hold the lock.
+func (k *KubernetesRouter) updateWeight(host string, weight float64) bool {
+	changed := false
+	for _, endpoints := range k.slices {
+		for i, e := range endpoints {
+			if e.member.Member() == host && e.member.Weight() != weight {
+				endpoints[i].member = rendezvous.NewWeightedMember(host, weight).WithZone(e.member.Zone())
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func hostSet(members []rendezvous.WeightedMember) map[string]bool {
+	hosts := make(map[string]bool, len(members))
+	for _, member := range members {
+		hosts[member.Member()] = true
+	}
+	return hosts
+}
+
+// endpointEvents compares the previous membership with the next one, observed at epoch.
+func endpointEvents(oldMembers, members []rendezvous.WeightedMember, oldDraining, draining map[string]bool, oldPorts, ports map[string]int32, epoch uint64) []EndpointEvent {
+	ready := hostSet(members)
+	wasReady := hostSet(oldMembers)
+	events := make([]EndpointEvent, 0)
+	for _, member := range members {
+		if !wasReady[member.Member()] {
+			events = append(events, EndpointEvent{Type: EndpointAdded, Host: joinHostPort(member.Member(), ports), Epoch: epoch})
+		}
+	}
+	for host := range draining {
+		if !oldDraining[host] {
+			events = append(events, EndpointEvent{Type: EndpointDraining, Host: joinHostPort(host, ports), Epoch: epoch})
+		}
+	}
+	for host := range wasReady {
+		if !ready[host] && !draining[host] {
+			events = append(events, EndpointEvent{Type: EndpointRemoved, Host: joinHostPort(host, oldPorts), Epoch: epoch})
+		}
+	}
+	for host := range oldDraining {
+		if !ready[host] && !draining[host] && !wasReady[host] {
+			events = append(events, EndpointEvent{Type: EndpointRemoved, Host: joinHostPort(host, oldPorts), Epoch: epoch})
+		}
+	}
+	return events
+}
+
+func (k *KubernetesRouter) initializeEndpointSlices(stop <-chan struct{}) (cache.Store, error) {
+	slices := k.k8sClient.DiscoveryV1().EndpointSlices(k.config.Namespace)
+	selector := discoveryv1.LabelServiceName + "=" + k.config.Service
+	watchList := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			list, err := slices.List(context.Background(), options)
+			if err != nil {
+				k.Sync.Failed(fmt.Errorf("list endpointslices: %w", err))
+			}
+			return list, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			watcher, err := slices.Watch(context.Background(), options)
+			if err != nil {
+				k.Sync.Failed(fmt.Errorf("watch endpointslices: %w", err))
+			}
+			return watcher, err
+		},
+	}
+
+	update := func(obj interface{}) {
+		slice := obj.(*discoveryv1.EndpointSlice)
+		// Resolving node zones may call the API, so it is done before taking the lock.
+		endpoints := k.sliceEndpoints(slice)
+		k.mu.Lock()
+		k.slices[slice.Namespace+"/"+slice.Name] = endpoints
+		events := k.applyEndpoints()
+		k.mu.Unlock()
+		k.Sync.Succeeded()
+		k.publish(events)
+	}
+	store, controller := cache.NewInformerWithOptions(cache.InformerOptions{
+		ListerWatcher: watchList,
+		ObjectType:    &discoveryv1.EndpointSlice{},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: update,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				update(newObj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				slice, ok := obj.(*discoveryv1.EndpointSlice)
+				if !ok {
+					return
+				}
+				k.mu.Lock()
+				delete(k.slices, slice.Namespace+"/"+slice.Name)
+				events := k.applyEndpoints()
+				k.mu.Unlock()
+				k.Sync.Succeeded()
+				k.publish(events)
+			},
+		},
+	})
+	go controller.Run(stop)
+	if !cache.WaitForCacheSync(stop, controller.HasSynced) {
+		k.Error("Timed out waiting for caches to sync")
+		return nil, fmt.Errorf("timed out waiting for caches to sync")
+	}
+	// An empty service has no events, the initial list is the sync.
+	k.Sync.Succeeded()
+	return store, nil
+}
@@ -1,59 +1,102 @@
 package kubernetes
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/membership"
+	"lukas8219/websocket-operator/internal/recipients"
 	"lukas8219/websocket-operator/internal/rendezvous"
+	"lukas8219/websocket-operator/internal/target"
 
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	clientcmd "k8s.io/client-go/tools/clientcmd"
 )
 
+// WeightAnnotation is the pod annotation used to set the rendezvous weight of a pod.
+const WeightAnnotation = "ws.operator/weight"
+
+// ZoneLabel is the well-known node label holding the node's zone.
+const ZoneLabel = "topology.kubernetes.io/zone"
+
 type KubernetesRouter struct {
-	k8sClient                   *kubernetes.Clientset
-	cacheStore                  cache.Store
-	loadbalancer                *rendezvous.Rendezvous
-	alreadyCalculatedRecipients map[string]string
-	handleUpdatedEndpoints      func([]string)
-	handleCreatedEnpoints       func([]string)
-	handleDeletedEnpoints       func([]string)
-	rebalanceRequest            chan [][2]string
+	*membership.Membership
+	k8sClient  kubernetes.Interface
+	config     Config
+	cacheStore cache.Store
+	podStore   cache.Store
+	addressing *endpointAddressing
+	// mu serializes the membership updates of the informers and guards slices and subscribers.
+	mu sync.Mutex
+	// slices holds the endpoints of each EndpointSlice of the service, keyed by namespace/name.
+	slices map[string][]endpoint
+	// subscribers receive the endpoint events, see Subscribe.
+	subscribers []func(EndpointEvent)
+	nodeZones   sync.Map
 }
 
-func (k *KubernetesRouter) Info(msg string, args ...any) {
-	slog.With("component", "router").With("mode", "kubernetes").Info(msg, args...)
+// endpointAddressing maps the hosts of the endpoints, which have no port, to their targets. It is
+// swapped along with the members, so lookups see the ports of the members they rank.
+type endpointAddressing struct {
+	// ports holds the port of every ready or draining host, discovered from its EndpointSlice.
+	ports map[string]int32
+	// pods holds the name of the pod of every ready or draining host, when its endpoint references one.
+	pods map[string]string
 }
 
-func (k *KubernetesRouter) Debug(msg string, args ...any) {
-	slog.With("component", "router").With("mode", "kubernetes").Debug(msg, args...)
+// Target returns the target of host with its discovered port and pod.
+func (a *endpointAddressing) Target(host string) target.Target {
+	port, ok := a.ports[host]
+	if !ok {
+		port = DefaultPort
+	}
+	return target.Target{Host: host, Port: int(port), Pod: a.pods[host]}
 }
 
-func (k *KubernetesRouter) Error(msg string, args ...any) {
-	slog.With("component", "router").With("mode", "kubernetes").Error(msg, args...)
+// Member returns the host of t, members have no port.
+func (a *endpointAddressing) Member(t target.Target) string {
+	return t.Host
 }
 
-func (k *KubernetesRouter) GetAllUpstreamHosts() []string {
-	return k.loadbalancer.GetAllHosts()
+// joinHostPort joins a host with its port in ports, DefaultPort when unknown.
+func joinHostPort(host string, ports map[string]int32) string {
+	port, ok := ports[host]
+	if !ok {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
 }
 
-var (
-	addedHosts = make(map[string]bool)
-)
+// NewRouter creates a router discovering the sidecars of the service of config. The recipients of
+// tracked are rebalanced when the endpoints change, nil tracks them in a default store.
+func NewRouter(loadbalancer balancer.Balancer, tracked *recipients.Store, config Config) *KubernetesRouter {
+	return NewRouterWithClient(createClient(), loadbalancer, tracked, config)
+}
 
-func NewRouter(loadbalancer *rendezvous.Rendezvous) *KubernetesRouter {
-	client := createClient()
+// NewRouterWithClient creates a router discovering the sidecars through client.
+func NewRouterWithClient(client kubernetes.Interface, loadbalancer balancer.Balancer, tracked *recipients.Store, config Config) *KubernetesRouter {
+	addressing := &endpointAddressing{ports: make(map[string]int32), pods: make(map[string]string)}
 	return &KubernetesRouter{
-		k8sClient:                   client,
-		alreadyCalculatedRecipients: make(map[string]string),
-		loadbalancer:                loadbalancer,
-		rebalanceRequest:            make(chan [][2]string, 1),
+		Membership: membership.New("kubernetes", loadbalancer, tracked, addressing),
+		k8sClient:  client,
+		config:     config.withDefaults(),
+		addressing: addressing,
+		slices:     make(map[string][]endpoint),
 	}
 }
 
@@ -70,108 +113,156 @@ func createClient() *kubernetes.Clientset {
 	return kubernetes.NewForConfigOrDie(config)
 }
 
-func (k *KubernetesRouter) Route(recipientId string) string {
-	k.Debug("Lookup", "recipientId", recipientId, "nodes", k.loadbalancer.GetNodes())
-	host := k.loadbalancer.Lookup(recipientId)
-	if host == "" {
-		k.Debug("No host found", "recipientId", recipientId, "nodes", k.loadbalancer.GetNodes())
-		return ""
+// podWeight reads the weight annotation from a pod, falling back to the default weight.
+func (k *KubernetesRouter) podWeight(pod *v1.Pod) float64 {
+	value, ok := pod.Annotations[WeightAnnotation]
+	if !ok {
+		return rendezvous.DefaultWeight
+	}
+	weight, err := strconv.ParseFloat(value, 64)
+	if err != nil || weight <= 0 {
+		k.Error("Invalid weight annotation, using default", "pod", pod.Name, "value", value)
+		return rendezvous.DefaultWeight
 	}
-	k.alreadyCalculatedRecipients[recipientId] = host
-	k.Debug("Host found", "recipientId", recipientId, "host", host)
-	host = fmt.Sprintf("%s:3000", host)
-	return host
+	return weight
 }
 
-func (k *KubernetesRouter) Add(host []string) {
-	return
+// targetWeight resolves the weight of an endpoint through the pod it targets.
+func (k *KubernetesRouter) targetWeight(targetRef *v1.ObjectReference) float64 {
+	if k.podStore == nil || targetRef == nil || targetRef.Kind != "Pod" {
+		return rendezvous.DefaultWeight
+	}
+	namespace := targetRef.Namespace
+	if namespace == "" {
+		namespace = k.config.Namespace
+	}
+	obj, exists, err := k.podStore.GetByKey(namespace + "/" + targetRef.Name)
+	if err != nil || !exists {
+		return rendezvous.DefaultWeight
+	}
+	return k.podWeight(obj.(*v1.Pod))
 }
 
-func (k *KubernetesRouter) InitializeHosts() error {
-	watchList := cache.NewListWatchFromClient(k.k8sClient.CoreV1().RESTClient(), "endpoints", "default",
-		fields.OneTermEqualSelector("metadata.name", "ws-proxy-headless"),
-	)
+// podSelector returns the label selector of the pods of the service, so only the sidecars are watched.
+func (k *KubernetesRouter) podSelector() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	service, err := k.k8sClient.CoreV1().Services(k.config.Namespace).Get(ctx, k.config.Service, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("get service %s: %w", k.config.Service, err)
+	}
+	if len(service.Spec.Selector) == 0 {
+		return "", fmt.Errorf("service %s has no selector", k.config.Service)
+	}
+	return labels.SelectorFromSet(service.Spec.Selector).String(), nil
+}
 
+// initializePodWeights watches the pods of the service, so a change of their weight annotation
+// rebalances their recipients like an endpoint change does.
+func (k *KubernetesRouter) initializePodWeights(stop <-chan struct{}) error {
+	selector, err := k.podSelector()
+	if err != nil {
+		return err
+	}
+	pods := k.k8sClient.CoreV1().Pods(k.config.Namespace)
+	watchList := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return pods.List(context.Background(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return pods.Watch(context.Background(), options)
+		},
+	}
+	update := func(obj interface{}) {
+		pod := obj.(*v1.Pod)
+		if pod.Status.PodIP == "" {
+			return
+		}
+		weight := k.podWeight(pod)
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if !k.updateWeight(pod.Status.PodIP, weight) {
+			return
+		}
+		k.Info("Updated weight", "pod", pod.Name, "host", pod.Status.PodIP, "weight", weight)
+		k.applyEndpoints()
+	}
 	store, controller := cache.NewInformerWithOptions(cache.InformerOptions{
 		ListerWatcher: watchList,
-		ObjectType:    &v1.Endpoints{},
+		ObjectType:    &v1.Pod{},
 		Handler: cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				hosts := make([]string, 0)
-				for _, address := range obj.(*v1.Endpoints).Subsets {
-					for _, address := range address.Addresses {
-						if address.IP != "" {
-							hosts = append(hosts, address.IP)
-						}
-					}
-				}
-				for _, host := range hosts {
-					k.loadbalancer.Add(host)
-					addedHosts[host] = true
-				}
-				k.Info("Added addresses", "hosts", hosts)
-			},
+			// A pod may be listed by its EndpointSlice before the informer sees it, with the default weight.
+			AddFunc: update,
 			UpdateFunc: func(oldObj, newObj interface{}) {
-				hosts := make([]string, 0)
-				//This is nuts, yes. But i'll look into re-writing the Rendezvous to be customized for this use case
-				for _, subset := range oldObj.(*v1.Endpoints).Subsets {
-					for _, address := range subset.Addresses {
-						k.loadbalancer.Remove(address.IP)
-						delete(addedHosts, address.IP)
-					}
-				}
-				for _, subset := range newObj.(*v1.Endpoints).Subsets {
-					for _, address := range subset.Addresses {
-						hosts = append(hosts, address.IP)
-						k.loadbalancer.Add(address.IP)
-					}
-				}
-				k.Info("Updated addresses", "hosts", hosts)
-				rebalanceHosts := make([][2]string, 0)
-				//re-calculate computed recipients to check re-balancing
-				for recipientId, host := range k.alreadyCalculatedRecipients {
-					newlyCalculatedHost := k.loadbalancer.Lookup(recipientId)
-					k.Debug("Checking rebalance", "recipientId", recipientId, "oldHost", host, "newHost", newlyCalculatedHost)
-					if newlyCalculatedHost == host {
-						continue
-					}
-					newlyCalculatedHostWithPort := fmt.Sprintf("%s:3000", newlyCalculatedHost)
-					rebalanceHosts = append(rebalanceHosts, [2]string{recipientId, newlyCalculatedHostWithPort})
-				}
-				if len(rebalanceHosts) > 0 {
-					k.Info("Rebalancing hosts", "hosts", rebalanceHosts)
-					k.triggerRebalance(rebalanceHosts)
-				} else {
-					k.Debug("No rebalancing hosts found")
-				}
-			},
-			DeleteFunc: func(obj interface{}) {
-				hosts := make([]string, 1)
-				for _, address := range obj.(*v1.Endpoints).Subsets[0].Addresses {
-					hosts = append(hosts, address.IP)
-				}
-				for _, host := range hosts {
-					k.loadbalancer.Remove(host)
-				}
-				k.Info("Deleted addresses", "hosts", hosts)
+				update(newObj)
 			},
 		},
 	})
-	stop := make(chan struct{})
 	go controller.Run(stop)
 	if !cache.WaitForCacheSync(stop, controller.HasSynced) {
-		k.Error("Timed out waiting for caches to sync")
-		return fmt.Errorf("timed out waiting for caches to sync")
+		return fmt.Errorf("timed out waiting for pod caches to sync")
 	}
-	k.cacheStore = store
+	k.podStore = store
 	return nil
 }
 
-func (k *KubernetesRouter) triggerRebalance(hosts [][2]string) {
-	k.Debug("Sending rebalance request", "hosts", hosts)
-	k.rebalanceRequest <- hosts
+// nodeZone returns the zone label of a node, caching it as node zones don't change.
+func (k *KubernetesRouter) nodeZone(nodeName string) string {
+	if zone, ok := k.nodeZones.Load(nodeName); ok {
+		return zone.(string)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	node, err := k.k8sClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		k.Error("Failed to get node zone", "node", nodeName, "error", err)
+		k.Sync.Failed(fmt.Errorf("get node %s: %w", nodeName, err))
+		return ""
+	}
+	zone := node.Labels[ZoneLabel]
+	k.nodeZones.Store(nodeName, zone)
+	return zone
+}
+
+// initializeLocalZone resolves our own zone from NODE_NAME unless it was configured.
+func (k *KubernetesRouter) initializeLocalZone() {
+	if balancer.LocalZone(k.Balancer()) != "" {
+		return
+	}
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return
+	}
+	zone := k.nodeZone(nodeName)
+	k.Info("Resolved local zone", "node", nodeName, "zone", zone)
+	balancer.SetLocalZone(k.Balancer(), zone)
+}
+
+func (k *KubernetesRouter) LocalZone() string {
+	return balancer.LocalZone(k.Balancer())
+}
+
+// Zone returns the zone of an upstream host, with or without its port.
+func (k *KubernetesRouter) Zone(host string) string {
+	if member, _, err := net.SplitHostPort(host); err == nil {
+		host = member
+	}
+	return balancer.Zone(k.Balancer(), host)
 }
 
-func (k *KubernetesRouter) RebalanceRequests() <-chan [][2]string {
-	return k.rebalanceRequest
+// InitializeHosts watches the endpoints of the service until Stop.
+func (k *KubernetesRouter) InitializeHosts() error {
+	k.initializeLocalZone()
+	if err := k.initializePodWeights(k.Stopped()); err != nil {
+		k.Error("Failed to watch pod weights, using default weights", "error", err)
+		k.Sync.Failed(err)
+	}
+	store, err := k.initializeEndpointSlices(k.Stopped())
+	if err != nil {
+		return err
+	}
+	k.cacheStore = store
+	return nil
 }
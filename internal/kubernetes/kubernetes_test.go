@@ -0,0 +1,357 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"lukas8219/websocket-operator/internal/target"
+	"slices"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type endpointState int
+
+const (
+	ready endpointState = iota
+	notReady
+	draining
+)
+
+func newSlice(name string, endpoints map[string]endpointState) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: DefaultNamespace,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: DefaultService},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for address, state := range endpoints {
+		isReady, isServing, isTerminating := true, true, false
+		switch state {
+		case notReady:
+			isReady, isServing = false, false
+		case draining:
+			isReady, isTerminating = false, true
+		}
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses: []string{address},
+			TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "ws-proxy-" + address},
+			Conditions: discoveryv1.EndpointConditions{
+				Ready:       &isReady,
+				Serving:     &isServing,
+				Terminating: &isTerminating,
+			},
+		})
+	}
+	return slice
+}
+
+// newService returns the service of the sidecars, selecting the pods labeled app=ws-proxy.
+func newService() *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: DefaultService, Namespace: DefaultNamespace},
+		Spec:       v1.ServiceSpec{Selector: map[string]string{"app": "ws-proxy"}},
+	}
+}
+
+// newPod returns the pod of the endpoint of address, as listed by newSlice, with a weight annotation unless empty.
+func newPod(address, weight string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ws-proxy-" + address,
+			Namespace: DefaultNamespace,
+			Labels:    map[string]string{"app": "ws-proxy"},
+		},
+		Status: v1.PodStatus{PodIP: address},
+	}
+	if weight != "" {
+		pod.Annotations = map[string]string{WeightAnnotation: weight}
+	}
+	return pod
+}
+
+func newTestRouter(t *testing.T, client *fake.Clientset, config Config) *KubernetesRouter {
+	t.Helper()
+	loadbalancer, err := balancer.New(balancer.AlgorithmRendezvous, rendezvous.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouterWithClient(client, loadbalancer, nil, config)
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+func updateSlice(t *testing.T, client *fake.Clientset, slice *discoveryv1.EndpointSlice) {
+	t.Helper()
+	_, err := client.DiscoveryV1().EndpointSlices(DefaultNamespace).Update(context.Background(), slice, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForHosts waits until the router routes to exactly hosts.
+func waitForHosts(t *testing.T, router *KubernetesRouter, hosts ...string) {
+	t.Helper()
+	slices.Sort(hosts)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		current := router.GetAllUpstreamHosts()
+		slices.Sort(current)
+		if slices.Equal(current, hosts) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected hosts %v, got %v", hosts, current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEndpointSlicesOnlyRouteToReadyEndpoints(t *testing.T) {
+	client := fake.NewClientset(
+		newSlice("ws-proxy-headless-a", map[string]endpointState{"10.0.0.1": ready, "10.0.0.2": notReady}),
+		newSlice("ws-proxy-headless-b", map[string]endpointState{"10.0.0.3": ready, "10.0.0.4": draining}),
+	)
+	router := newTestRouter(t, client, Config{})
+	waitForHosts(t, router, "10.0.0.1:3000", "10.0.0.3:3000")
+
+	err := client.DiscoveryV1().EndpointSlices(DefaultNamespace).Delete(context.Background(), "ws-proxy-headless-b", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHosts(t, router, "10.0.0.1:3000")
+}
+
+func TestTerminatingEndpointKeepsUsersWhileDraining(t *testing.T) {
+	hosts := map[string]endpointState{"10.0.0.1": ready, "10.0.0.2": ready, "10.0.0.3": ready}
+	client := fake.NewClientset(newSlice("ws-proxy-headless-a", hosts))
+	router := newTestRouter(t, client, Config{})
+	waitForHosts(t, router, "10.0.0.1:3000", "10.0.0.2:3000", "10.0.0.3:3000")
+
+	drained := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		recipient := fmt.Sprintf("user-%d", i)
+		host := router.Route(recipient)
+		router.Track(recipient, host)
+		if host.Address() == "10.0.0.3:3000" {
+			drained[recipient] = true
+		}
+	}
+	if len(drained) == 0 {
+		t.Fatal("expected recipients on the host about to drain")
+	}
+
+	hosts["10.0.0.3"] = draining
+	updateSlice(t, client, newSlice("ws-proxy-headless-a", hosts))
+	waitForHosts(t, router, "10.0.0.1:3000", "10.0.0.2:3000")
+	select {
+	case moves := <-router.RebalanceRequests():
+		t.Fatalf("draining must not move users, got %v", moves)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for i := 300; i < 600; i++ {
+		if host := router.Route(fmt.Sprintf("user-%d", i)); host.Address() == "10.0.0.3:3000" {
+			t.Fatal("new users must not be routed to a draining host")
+		}
+	}
+	if hosts := router.RouteN("user-0", 1); hosts[len(hosts)-1].Address() != "10.0.0.3:3000" {
+		t.Fatalf("expected the draining host to be ranked last for messages, got %v", hosts)
+	}
+	if members := router.Snapshot().Members; len(members) != 3 || !members[2].Draining || members[2].Host != "10.0.0.3:3000" {
+		t.Fatalf("expected the draining host last in the snapshot, got %+v", members)
+	}
+
+	delete(hosts, "10.0.0.3")
+	updateSlice(t, client, newSlice("ws-proxy-headless-a", hosts))
+	var moves []target.RebalanceRequest
+	select {
+	case moves = <-router.RebalanceRequests():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the drained users to be rebalanced")
+	}
+	if len(moves) != len(drained) {
+		t.Fatalf("expected %d drained users to move, got %d", len(drained), len(moves))
+	}
+	for _, move := range moves {
+		if !drained[move.RecipientId] || move.Old.Address() != "10.0.0.3:3000" || move.New.Address() == "10.0.0.3:3000" {
+			t.Fatalf("unexpected move %+v", move)
+		}
+	}
+}
+
+func TestConfiguredServiceAndNamedPort(t *testing.T) {
+	slice := newSlice("chat-a", map[string]endpointState{"10.0.0.1": ready})
+	slice.Namespace = "apps"
+	slice.Labels[discoveryv1.LabelServiceName] = "chat"
+	metricsName, metricsPort := "metrics", int32(9090)
+	wsName, wsPort := "ws", int32(8080)
+	slice.Ports = []discoveryv1.EndpointPort{
+		{Name: &metricsName, Port: &metricsPort},
+		{Name: &wsName, Port: &wsPort},
+	}
+	other := newSlice("ws-proxy-headless-a", map[string]endpointState{"10.0.0.2": ready})
+	client := fake.NewClientset(slice, other)
+	router := newTestRouter(t, client, Config{Namespace: "apps", Service: "chat"})
+	waitForHosts(t, router, "10.0.0.1:8080")
+	host := router.Route("user")
+	if host.Address() != "10.0.0.1:8080" {
+		t.Fatalf("expected the named port to be used, got %v", host)
+	}
+	if host.Pod != "ws-proxy-10.0.0.1" {
+		t.Fatalf("expected the pod of the endpoint, got %+v", host)
+	}
+}
+
+func TestOnlyTrackedRecipientsAreRebalanced(t *testing.T) {
+	hosts := map[string]endpointState{"10.0.0.1": ready}
+	client := fake.NewClientset(newSlice("ws-proxy-headless-a", hosts))
+	router := newTestRouter(t, client, Config{})
+	waitForHosts(t, router, "10.0.0.1:3000")
+	for i := 0; i < 100; i++ {
+		recipient := fmt.Sprintf("user-%d", i)
+		router.Route(recipient)
+		if i < 50 {
+			router.Track(recipient, router.Route(recipient))
+		}
+		if i < 10 {
+			router.Forget(recipient)
+		}
+	}
+
+	hosts["10.0.0.2"] = ready
+	updateSlice(t, client, newSlice("ws-proxy-headless-a", hosts))
+	select {
+	case moves := <-router.RebalanceRequests():
+		for _, move := range moves {
+			var i int
+			fmt.Sscanf(move.RecipientId, "user-%d", &i)
+			if i < 10 || i >= 50 {
+				t.Fatalf("%s is not connected and must not be rebalanced", move.RecipientId)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connected users to be rebalanced")
+	}
+}
+
+func TestEndpointEvents(t *testing.T) {
+	hosts := map[string]endpointState{"10.0.0.1": ready, "10.0.0.2": ready}
+	client := fake.NewClientset(newSlice("ws-proxy-headless-a", hosts))
+	router := newTestRouter(t, client, Config{})
+	waitForHosts(t, router, "10.0.0.1:3000", "10.0.0.2:3000")
+	events := make(chan EndpointEvent, 10)
+	router.Subscribe(func(event EndpointEvent) {
+		events <- event
+	})
+	expect := func(expected EndpointEvent) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Type != expected.Type || event.Host != expected.Host {
+				t.Fatalf("expected %v, got %v", expected, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %v", expected)
+		}
+	}
+
+	hosts["10.0.0.3"] = ready
+	updateSlice(t, client, newSlice("ws-proxy-headless-a", hosts))
+	expect(EndpointEvent{Type: EndpointAdded, Host: "10.0.0.3:3000"})
+	hosts["10.0.0.1"] = draining
+	updateSlice(t, client, newSlice("ws-proxy-headless-a", hosts))
+	expect(EndpointEvent{Type: EndpointDraining, Host: "10.0.0.1:3000"})
+	delete(hosts, "10.0.0.1")
+	updateSlice(t, client, newSlice("ws-proxy-headless-a", hosts))
+	expect(EndpointEvent{Type: EndpointRemoved, Host: "10.0.0.1:3000"})
+	hosts["10.0.0.2"] = notReady
+	updateSlice(t, client, newSlice("ws-proxy-headless-a", hosts))
+	expect(EndpointEvent{Type: EndpointRemoved, Host: "10.0.0.2:3000"})
+	if hosts := router.GetAllUpstreamHosts(); len(hosts) != 1 || hosts[0] != "10.0.0.3:3000" {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+}
+
+// waitForWeight waits until the snapshot of the router reports weight for host.
+func waitForWeight(t *testing.T, router *KubernetesRouter, host string, weight float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, member := range router.Snapshot().Members {
+			if member.Host == host && member.Weight == weight {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to weigh %v, got %+v", host, weight, router.Snapshot().Members)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWeightsFromPodAnnotations(t *testing.T) {
+	other := newPod("10.0.0.9", "5")
+	other.Name, other.Labels = "other", map[string]string{"app": "other"}
+	client := fake.NewClientset(
+		newService(),
+		newPod("10.0.0.1", "3"),
+		newPod("10.0.0.2", "invalid"),
+		newPod("10.0.0.3", ""),
+		other,
+		newSlice("ws-proxy-headless-a", map[string]endpointState{"10.0.0.1": ready, "10.0.0.2": ready, "10.0.0.3": ready}),
+	)
+	router := newTestRouter(t, client, Config{})
+	waitForHosts(t, router, "10.0.0.1:3000", "10.0.0.2:3000", "10.0.0.3:3000")
+	waitForWeight(t, router, "10.0.0.1:3000", 3)
+	waitForWeight(t, router, "10.0.0.2:3000", rendezvous.DefaultWeight)
+	waitForWeight(t, router, "10.0.0.3:3000", rendezvous.DefaultWeight)
+	for _, key := range router.podStore.ListKeys() {
+		if key == DefaultNamespace+"/other" {
+			t.Fatal("expected only the pods of the service to be watched")
+		}
+	}
+}
+
+func TestWeightAnnotationUpdateRebalances(t *testing.T) {
+	client := fake.NewClientset(
+		newService(),
+		newPod("10.0.0.1", ""),
+		newPod("10.0.0.2", ""),
+		newSlice("ws-proxy-headless-a", map[string]endpointState{"10.0.0.1": ready, "10.0.0.2": ready}),
+	)
+	router := newTestRouter(t, client, Config{})
+	waitForHosts(t, router, "10.0.0.1:3000", "10.0.0.2:3000")
+	for i := 0; i < 200; i++ {
+		recipient := fmt.Sprintf("user-%d", i)
+		router.Track(recipient, router.Route(recipient))
+	}
+
+	_, err := client.CoreV1().Pods(DefaultNamespace).Update(context.Background(), newPod("10.0.0.2", "10"), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case moves := <-router.RebalanceRequests():
+		if len(moves) == 0 {
+			t.Fatal("expected recipients to move to the heavier host")
+		}
+		for _, move := range moves {
+			if move.Old.Address() != "10.0.0.1:3000" || move.New.Address() != "10.0.0.2:3000" {
+				t.Fatalf("unexpected move %+v", move)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the weight update to rebalance")
+	}
+	waitForWeight(t, router, "10.0.0.2:3000", 10)
+}
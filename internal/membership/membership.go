@@ -0,0 +1,314 @@
+// Package membership holds what every router mode shares: the members recipients are ranked across,
+// the connected recipients to rebalance when they change, and the epoch. Modes only discover members.
+package membership
+
+import (
+	"log/slog"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/epoch"
+	"lukas8219/websocket-operator/internal/recipients"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"lukas8219/websocket-operator/internal/snapshot"
+	"lukas8219/websocket-operator/internal/target"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Addressing maps the members of the balancer to the targets users are routed to, and back. Modes whose
+// members are host:port addresses use the default, others like the kubernetes mode bring their own.
+type Addressing interface {
+	// Target returns the target of member, without its zone and epoch. It is called with the lock held.
+	Target(member string) target.Target
+	// Member returns the member t is routed to.
+	Member(t target.Target) string
+}
+
+// addresses is the Addressing of members that are host:port addresses.
+type addresses struct{}
+
+func (addresses) Target(member string) target.Target {
+	return target.FromAddress(member)
+}
+
+func (addresses) Member(t target.Target) string {
+	return t.Address()
+}
+
+// Update is a change of the members.
+type Update struct {
+	// Members receive new recipients.
+	Members []rendezvous.WeightedMember
+	// Draining members keep the recipients they own but take no new ones. They are routed to last.
+	Draining []rendezvous.WeightedMember
+	// Swap, when set, changes the state the Addressing reads along with the members. It runs with the
+	// lock held, once the targets the moved recipients leave are built.
+	Swap func()
+}
+
+// Membership is embedded by the routers. It ranks recipients across the members, tracks the connected
+// ones and emits a rebalance request for the ones whose owner changes.
+type Membership struct {
+	mode         string
+	loadbalancer balancer.Balancer
+	addressing   Addressing
+	tracked      *recipients.Store
+
+	// mu keeps lookups, which share it, from seeing a half-applied membership update.
+	mu sync.RWMutex
+	// draining holds the draining members, sorted.
+	draining []rendezvous.WeightedMember
+	epoch    epoch.Epoch
+
+	rebalanceRequest chan []target.RebalanceRequest
+	stop             chan struct{}
+	stopOnce         sync.Once
+	// Sync records the outcome of the reads of the discovery source, reported by Snapshot.
+	Sync snapshot.Sync
+}
+
+// New creates the membership of a router of mode. The recipients of tracked are rebalanced when the
+// members change, nil tracks them in a default store. Nil addressing takes members as host:port.
+func New(mode string, loadbalancer balancer.Balancer, tracked *recipients.Store, addressing Addressing) *Membership {
+	if tracked == nil {
+		tracked = recipients.NewStore(recipients.Config{})
+	}
+	if addressing == nil {
+		addressing = addresses{}
+	}
+	return &Membership{
+		mode:             mode,
+		loadbalancer:     loadbalancer,
+		addressing:       addressing,
+		tracked:          tracked,
+		rebalanceRequest: make(chan []target.RebalanceRequest, 1),
+		stop:             make(chan struct{}),
+	}
+}
+
+func (m *Membership) Info(msg string, args ...any) {
+	slog.With("component", "router").With("mode", m.mode).Info(msg, args...)
+}
+
+func (m *Membership) Debug(msg string, args ...any) {
+	slog.With("component", "router").With("mode", m.mode).Debug(msg, args...)
+}
+
+func (m *Membership) Error(msg string, args ...any) {
+	slog.With("component", "router").With("mode", m.mode).Error(msg, args...)
+}
+
+// Balancer returns the balancer ranking the members.
+func (m *Membership) Balancer() balancer.Balancer {
+	return m.loadbalancer
+}
+
+// Stop ends the discovery of the router, see Stopped.
+func (m *Membership) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// Stopped is closed by Stop.
+func (m *Membership) Stopped() <-chan struct{} {
+	return m.stop
+}
+
+// Apply changes the members and emits a rebalance request for the tracked recipients whose owner
+// changed. The recipients of draining members stay where they are.
+func (m *Membership) Apply(update Update) {
+	m.mu.Lock()
+	oldMembers := balancer.Nodes(m.loadbalancer)
+	if balancer.SameMembers(oldMembers, update.Members) && balancer.SameMembers(m.draining, update.Draining) {
+		if update.Swap != nil {
+			update.Swap()
+		}
+		m.mu.Unlock()
+		return
+	}
+	draining := make(map[string]bool, len(update.Draining))
+	for _, member := range update.Draining {
+		draining[member.Member()] = true
+	}
+	owners := m.tracked.Owners()
+	for recipient, owner := range owners {
+		if draining[owner] {
+			delete(owners, recipient)
+		}
+	}
+	//only recipients owned by removed hosts or won by added hosts are re-calculated
+	moves := balancer.Diff(m.loadbalancer, oldMembers, update.Members, owners)
+	requests := make([]target.RebalanceRequest, 0, len(moves))
+	newOwners := make([]string, 0, len(moves))
+	for _, move := range moves {
+		m.Debug("Checking rebalance", "recipientId", move.Key, "oldHost", move.OldOwner, "newHost", move.NewOwner)
+		if move.NewOwner == "" {
+			continue
+		}
+		// the old target is the one the recipient was routed to, built before the old owner is removed
+		requests = append(requests, target.RebalanceRequest{RecipientId: move.Key, Old: m.target(move.OldOwner)})
+		newOwners = append(newOwners, move.NewOwner)
+	}
+
+	if update.Swap != nil {
+		update.Swap()
+	}
+	balancer.SetMembers(m.loadbalancer, update.Members)
+	m.draining = slices.Clone(update.Draining)
+	sort.Slice(m.draining, func(i, j int) bool {
+		return m.draining[i].Member() < m.draining[j].Member()
+	})
+	m.epoch.Set(update.Members)
+	// The recipients stay on their old owner until Move, once their connections were migrated.
+	for i, owner := range newOwners {
+		requests[i].New = m.target(owner)
+	}
+	hosts, drainingHosts := m.hosts(), m.drainingHosts()
+	m.mu.Unlock()
+
+	m.Info("Updated addresses", "hosts", hosts, "draining", drainingHosts, "epoch", m.epoch.Load())
+	if len(requests) == 0 {
+		m.Debug("No rebalancing hosts found")
+		return
+	}
+	m.Info("Rebalancing recipients", "requests", requests)
+	select {
+	case m.rebalanceRequest <- requests:
+	case <-m.stop:
+	}
+}
+
+// Members returns the members, and the draining ones. It is meant for the writers of the members.
+func (m *Membership) Members() (members, draining []rendezvous.WeightedMember) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return balancer.Nodes(m.loadbalancer), slices.Clone(m.draining)
+}
+
+// target returns the target of a member. The caller must hold the lock.
+func (m *Membership) target(member string) target.Target {
+	if member == "" {
+		return target.Target{}
+	}
+	t := m.addressing.Target(member)
+	t.Zone = balancer.Zone(m.loadbalancer, member)
+	t.Epoch = m.epoch.Load()
+	return t
+}
+
+// hosts returns the address of every member. The caller must hold the lock.
+func (m *Membership) hosts() []string {
+	hosts := m.loadbalancer.Members()
+	for i, member := range hosts {
+		hosts[i] = m.addressing.Target(member).Address()
+	}
+	return hosts
+}
+
+// drainingHosts returns the address of every draining member. The caller must hold the lock.
+func (m *Membership) drainingHosts() []string {
+	hosts := make([]string, len(m.draining))
+	for i, member := range m.draining {
+		hosts[i] = m.addressing.Target(member.Member()).Address()
+	}
+	return hosts
+}
+
+func (m *Membership) Route(recipientId string) target.Target {
+	targets := m.RouteN(recipientId, 1)
+	if len(targets) == 0 {
+		return target.Target{}
+	}
+	return targets[0]
+}
+
+// RouteN returns up to n targets ranked for the recipient, followed by the draining members which may
+// still hold the recipient.
+func (m *Membership) RouteN(recipientId string, n int) []target.Target {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	hosts := balancer.PlaceN(m.loadbalancer, recipientId, n)
+	if len(hosts) == 0 {
+		m.Debug("No host found", "recipientId", recipientId, "nodes", balancer.Nodes(m.loadbalancer))
+		return nil
+	}
+	targets := make([]target.Target, 0, len(hosts)+len(m.draining))
+	for _, host := range hosts {
+		targets = append(targets, m.target(host))
+	}
+	for _, member := range m.draining {
+		targets = append(targets, m.target(member.Member()))
+	}
+	m.Debug("Hosts found", "recipientId", recipientId, "targets", targets)
+	return targets
+}
+
+// Track records a connection of recipientId on t so it is rebalanced when t leaves.
+func (m *Membership) Track(recipientId string, t target.Target) {
+	m.tracked.Track(recipientId, m.addressing.Member(t))
+}
+
+// Move records that the connections of recipientId were migrated to t.
+func (m *Membership) Move(recipientId string, t target.Target) {
+	m.tracked.Move(recipientId, m.addressing.Member(t))
+}
+
+// Forget releases a connection of recipientId tracked with Track.
+func (m *Membership) Forget(recipientId string) {
+	m.tracked.Forget(recipientId)
+}
+
+// ReportLoads takes loads keyed by upstream host, as seen by the load balancer.
+func (m *Membership) ReportLoads(loads map[string]int) {
+	byMember := make(map[string]int, len(loads))
+	for host, load := range loads {
+		byMember[m.addressing.Member(target.FromAddress(host))] += load
+	}
+	balancer.SetLoads(m.loadbalancer, byMember)
+}
+
+func (m *Membership) GetAllUpstreamHosts() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.hosts()
+}
+
+// Snapshot returns the members, then the draining ones.
+func (m *Membership) Snapshot() snapshot.Snapshot {
+	m.mu.RLock()
+	current := snapshot.Snapshot{
+		Mode: m.mode,
+		Members: snapshot.Members(m.loadbalancer, func(member string) string {
+			return m.addressing.Target(member).Address()
+		}),
+		Epoch:     m.epoch.Load(),
+		EpochHash: m.epoch.Hash(),
+	}
+	for _, member := range m.draining {
+		current.Members = append(current.Members, snapshot.Member{
+			Host:     m.addressing.Target(member.Member()).Address(),
+			Weight:   member.Weight(),
+			Zone:     member.Zone(),
+			Draining: true,
+		})
+	}
+	m.mu.RUnlock()
+	current.Tracked = m.tracked.Len()
+	m.Sync.Fill(&current)
+	return current
+}
+
+// Epoch is the version of the members, see epoch.Epoch.
+func (m *Membership) Epoch() uint64 {
+	return m.epoch.Load()
+}
+
+// EpochHash is the hash of the members, see epoch.Epoch.
+func (m *Membership) EpochHash() uint64 {
+	return m.epoch.Hash()
+}
+
+func (m *Membership) RebalanceRequests() <-chan []target.RebalanceRequest {
+	return m.rebalanceRequest
+}
@@ -0,0 +1,116 @@
+package membership
+
+import (
+	"fmt"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"testing"
+)
+
+func newTestMembership(t *testing.T) *Membership {
+	t.Helper()
+	loadbalancer, err := balancer.New(balancer.AlgorithmRendezvous, rendezvous.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New("test", loadbalancer, nil, nil)
+	t.Cleanup(m.Stop)
+	return m
+}
+
+func members(hosts ...string) []rendezvous.WeightedMember {
+	members := make([]rendezvous.WeightedMember, len(hosts))
+	for i, host := range hosts {
+		members[i] = rendezvous.NewWeightedMember(host, rendezvous.DefaultWeight).WithZone("zone-" + host)
+	}
+	return members
+}
+
+func TestApplyRebalancesTrackedRecipients(t *testing.T) {
+	m := newTestMembership(t)
+	m.Apply(Update{Members: members("10.0.0.1:3000", "10.0.0.2:3000")})
+	owners := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		recipient := fmt.Sprintf("user-%d", i)
+		owner := m.Route(recipient)
+		m.Track(recipient, owner)
+		owners[recipient] = owner.Address()
+	}
+	previous := m.Epoch()
+
+	m.Apply(Update{Members: members("10.0.0.1:3000")})
+	requests := <-m.RebalanceRequests()
+	if len(requests) == 0 {
+		t.Fatal("expected the recipients of the removed host to move")
+	}
+	for _, request := range requests {
+		if owners[request.RecipientId] != "10.0.0.2:3000" || request.New.Address() != "10.0.0.1:3000" {
+			t.Fatalf("unexpected move %+v", request)
+		}
+		// The old target keeps the zone and epoch it was routed with, though its member is gone.
+		if request.Old.Zone != "zone-10.0.0.2:3000" || request.Old.Epoch != previous || request.New.Epoch != m.Epoch() {
+			t.Fatalf("unexpected targets %+v", request)
+		}
+	}
+}
+
+func TestDrainingMembersKeepTheirRecipients(t *testing.T) {
+	m := newTestMembership(t)
+	m.Apply(Update{Members: members("10.0.0.1:3000", "10.0.0.2:3000")})
+	for i := 0; i < 200; i++ {
+		recipient := fmt.Sprintf("user-%d", i)
+		m.Track(recipient, m.Route(recipient))
+	}
+
+	m.Apply(Update{Members: members("10.0.0.1:3000"), Draining: members("10.0.0.2:3000")})
+	select {
+	case requests := <-m.RebalanceRequests():
+		t.Fatalf("draining must not move recipients, got %v", requests)
+	default:
+	}
+	targets := m.RouteN("user-0", 1)
+	if len(targets) != 2 || targets[1].Address() != "10.0.0.2:3000" {
+		t.Fatalf("expected the draining member last, got %v", targets)
+	}
+	if hosts := m.GetAllUpstreamHosts(); len(hosts) != 1 || hosts[0] != "10.0.0.1:3000" {
+		t.Fatalf("expected the draining member to be left out of the hosts, got %v", hosts)
+	}
+	current := m.Snapshot()
+	if len(current.Members) != 2 || !current.Members[1].Draining || current.Members[1].Zone != "zone-10.0.0.2:3000" {
+		t.Fatalf("expected the draining member last in the snapshot, got %+v", current.Members)
+	}
+}
+
+func TestRecipientsMoveOnceMigrated(t *testing.T) {
+	m := newTestMembership(t)
+	m.Apply(Update{Members: members("10.0.0.1:3000", "10.0.0.2:3000")})
+	for i := 0; i < 200; i++ {
+		recipient := fmt.Sprintf("user-%d", i)
+		m.Track(recipient, m.Route(recipient))
+	}
+	m.Apply(Update{Members: members("10.0.0.1:3000")})
+	requests := <-m.RebalanceRequests()
+	// Half of the migrations fail, their recipients stay on the removed host.
+	failed := make(map[string]bool)
+	for i, request := range requests {
+		if i%2 == 0 {
+			failed[request.RecipientId] = true
+			continue
+		}
+		m.Move(request.RecipientId, request.New)
+	}
+
+	m.Apply(Update{Members: members("10.0.0.1:3000", "10.0.0.3:3000")})
+	retried := make(map[string]bool)
+	for _, request := range <-m.RebalanceRequests() {
+		retried[request.RecipientId] = true
+		if request.Old.Address() == "10.0.0.1:3000" && failed[request.RecipientId] {
+			t.Fatalf("%s failed to migrate and must still be on the removed host, got %+v", request.RecipientId, request)
+		}
+	}
+	for recipient := range failed {
+		if !retried[recipient] {
+			t.Fatalf("%s failed to migrate and must be rebalanced again", recipient)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Path is where both binaries serve their metrics in the Prometheus text format.
+const Path = "/metrics"
+
+type metric interface {
+	header() (name, help, kind string)
+	sample() string
+}
+
+var (
+	mu       sync.Mutex
+	registry = make(map[string]metric)
+)
+
+func register(key string, m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[key] = m
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a monotonically increasing metric.
+type Counter struct {
+	name   string
+	help   string
+	labels string
+	value  atomic.Uint64
+}
+
+// NewCounter registers a counter. labels are key/value pairs.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: formatLabels(labels)}
+	register(name+c.labels, c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) header() (string, string, string) {
+	return c.name, c.help, "counter"
+}
+
+func (c *Counter) sample() string {
+	return fmt.Sprintf("%s%s %d\n", c.name, c.labels, c.value.Load())
+}
+
+// GaugeFunc is a metric whose value is read when metrics are collected.
+type GaugeFunc struct {
+	name   string
+	help   string
+	labels string
+	value  func() float64
+}
+
+// NewGaugeFunc registers a gauge read from value. labels are key/value pairs.
+func NewGaugeFunc(name, help string, value func() float64, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: formatLabels(labels), value: value}
+	register(name+g.labels, g)
+	return g
+}
+
+func (g *GaugeFunc) header() (string, string, string) {
+	return g.name, g.help, "gauge"
+}
+
+func (g *GaugeFunc) sample() string {
+	return fmt.Sprintf("%s%s %g\n", g.name, g.labels, g.value())
+}
+
+// Handler serves every registered metric.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys := make([]string, 0, len(registry))
+		for key := range registry {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var sb strings.Builder
+		lastName := ""
+		for _, key := range keys {
+			m := registry[key]
+			// HELP and TYPE are written once for every series of the same metric.
+			if name, help, kind := m.header(); name != lastName {
+				fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+				lastName = name
+			}
+			sb.WriteString(m.sample())
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(sb.String()))
+	})
+}
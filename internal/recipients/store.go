@@ -0,0 +1,162 @@
+package recipients
+
+import (
+	"container/list"
+	"lukas8219/websocket-operator/internal/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxSize bounds how many recipients a store tracks when Config.MaxSize is not set.
+const DefaultMaxSize = 1_000_000
+
+var (
+	trackedTotal atomic.Int64
+	_            = metrics.NewGaugeFunc("ws_operator_tracked_recipients", "Recipients tracked for rebalancing", func() float64 {
+		return float64(trackedTotal.Load())
+	})
+	lruEvictions = metrics.NewCounter("ws_operator_tracked_recipients_evicted_total", "Tracked recipients evicted before being forgotten", "reason", "lru")
+	ttlEvictions = metrics.NewCounter("ws_operator_tracked_recipients_evicted_total", "Tracked recipients evicted before being forgotten", "reason", "ttl")
+)
+
+// Config bounds the owners a Store keeps. The connections of a recipient are counted apart from its
+// owner and never evicted, so an evicted recipient tracked again is forgotten with its last connection.
+type Config struct {
+	// MaxSize is how many recipients are tracked before the least recently tracked one is evicted.
+	MaxSize int
+	// TTL evicts recipients not tracked again for that long. Zero keeps them until they are forgotten.
+	TTL time.Duration
+}
+
+type entry struct {
+	recipient string
+	owner     string
+	tracked   time.Time
+}
+
+// Store holds the owner of the recipients with a live connection, which are the only ones worth
+// rebalancing. A recipient is tracked once per connection and kept until every connection forgot it.
+// It is safe for concurrent use.
+type Store struct {
+	config Config
+	now    func() time.Time
+
+	mu sync.Mutex
+	// refs counts the connections of every recipient, evicted or not.
+	refs    map[string]int
+	entries map[string]*list.Element
+	// lru holds the entries, most recently tracked first.
+	lru *list.List
+}
+
+func NewStore(config Config) *Store {
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultMaxSize
+	}
+	return &Store{
+		config:  config,
+		now:     time.Now,
+		refs:    make(map[string]int),
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Track records a connection of recipient on owner.
+func (s *Store) Track(recipient, owner string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	s.refs[recipient]++
+	if element, ok := s.entries[recipient]; ok {
+		e := element.Value.(*entry)
+		e.owner, e.tracked = owner, s.now()
+		s.lru.MoveToFront(element)
+		return
+	}
+	s.entries[recipient] = s.lru.PushFront(&entry{recipient: recipient, owner: owner, tracked: s.now()})
+	trackedTotal.Add(1)
+	for s.lru.Len() > s.config.MaxSize {
+		s.remove(s.lru.Back())
+		lruEvictions.Inc()
+	}
+}
+
+// Forget releases a connection of recipient. The recipient is removed once all its connections are released.
+func (s *Store) Forget(recipient string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs, ok := s.refs[recipient]
+	if !ok {
+		return
+	}
+	if refs > 1 {
+		s.refs[recipient] = refs - 1
+		return
+	}
+	delete(s.refs, recipient)
+	if element, ok := s.entries[recipient]; ok {
+		s.remove(element)
+	}
+}
+
+// Move changes the owner of a tracked recipient. Untracked recipients are left untracked.
+func (s *Store) Move(recipient, owner string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.entries[recipient]; ok {
+		element.Value.(*entry).owner = owner
+	}
+}
+
+// Owner returns the owner of recipient and whether it is tracked.
+func (s *Store) Owner(recipient string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	element, ok := s.entries[recipient]
+	if !ok {
+		return "", false
+	}
+	return element.Value.(*entry).owner, true
+}
+
+// Owners returns a copy of the tracked recipients and their owner.
+func (s *Store) Owners() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	owners := make(map[string]string, len(s.entries))
+	for recipient, element := range s.entries {
+		owners[recipient] = element.Value.(*entry).owner
+	}
+	return owners
+}
+
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	return s.lru.Len()
+}
+
+// expire evicts the entries older than the TTL. They sit at the back since the list is ordered by
+// tracking time. The caller must hold the lock.
+func (s *Store) expire() {
+	if s.config.TTL <= 0 {
+		return
+	}
+	deadline := s.now().Add(-s.config.TTL)
+	for element := s.lru.Back(); element != nil && element.Value.(*entry).tracked.Before(deadline); element = s.lru.Back() {
+		s.remove(element)
+		ttlEvictions.Inc()
+	}
+}
+
+// remove drops an entry. The caller must hold the lock.
+func (s *Store) remove(element *list.Element) {
+	delete(s.entries, element.Value.(*entry).recipient)
+	s.lru.Remove(element)
+	trackedTotal.Add(-1)
+}
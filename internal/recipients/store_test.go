@@ -0,0 +1,96 @@
+package recipients
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTrackAndForgetAreRefCounted(t *testing.T) {
+	store := NewStore(Config{})
+	store.Track("user", "10.0.0.1:3000")
+	store.Track("user", "10.0.0.1:3000")
+	store.Forget("user")
+	if owner, ok := store.Owner("user"); !ok || owner != "10.0.0.1:3000" {
+		t.Fatalf("expected the user to stay tracked while a connection is left, got %q %v", owner, ok)
+	}
+	store.Forget("user")
+	if _, ok := store.Owner("user"); ok {
+		t.Fatal("expected the user to be forgotten with its last connection")
+	}
+	store.Move("user", "10.0.0.2:3000")
+	if store.Len() != 0 {
+		t.Fatal("expected Move not to track a forgotten user")
+	}
+}
+
+func TestEvictsLeastRecentlyTracked(t *testing.T) {
+	store := NewStore(Config{MaxSize: 2})
+	store.Track("a", "host")
+	store.Track("b", "host")
+	store.Track("a", "host")
+	store.Track("c", "host")
+	owners := store.Owners()
+	if len(owners) != 2 || owners["b"] != "" {
+		t.Fatalf("expected b to be evicted, got %v", owners)
+	}
+}
+
+func TestEvictionKeepsTheConnectionCount(t *testing.T) {
+	store := NewStore(Config{MaxSize: 1})
+	store.Track("a", "host")
+	store.Track("b", "host")
+	// a reconnects while its first connection is still open
+	store.Track("a", "other")
+	store.Forget("a")
+	if owner, ok := store.Owner("a"); !ok || owner != "other" {
+		t.Fatalf("expected a to stay tracked while a connection is left, got %q %v", owner, ok)
+	}
+	store.Forget("a")
+	if _, ok := store.Owner("a"); ok {
+		t.Fatal("expected a to be forgotten with its last connection")
+	}
+	store.Forget("b")
+	store.Track("b", "host")
+	store.Forget("b")
+	if store.Len() != 0 {
+		t.Fatal("expected b to be forgotten with its last connection")
+	}
+}
+
+func TestExpiresAfterTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := NewStore(Config{TTL: time.Minute})
+	store.now = func() time.Time { return now }
+	store.Track("a", "host")
+	now = now.Add(30 * time.Second)
+	store.Track("b", "host")
+	now = now.Add(45 * time.Second)
+	owners := store.Owners()
+	if len(owners) != 1 || owners["b"] != "host" {
+		t.Fatalf("expected only b to be left, got %v", owners)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	store := NewStore(Config{MaxSize: 100})
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				recipient := fmt.Sprintf("user-%d", i%150)
+				store.Track(recipient, "host")
+				store.Move(recipient, "other")
+				store.Owners()
+				store.Forget(recipient)
+			}
+		}()
+	}
+	wg.Wait()
+	if store.Len() > 100 {
+		t.Fatalf("expected at most 100 tracked recipients, got %d", store.Len())
+	}
+}
@@ -0,0 +1,53 @@
+package rendezvous
+
+import (
+	"math"
+)
+
+// DefaultMaxSpill is how many lower-ranked members a key may spill to when MaxSpill is unset.
+const DefaultMaxSpill = 2
+
+// BoundedLoadConfig enables rendezvous with bounded loads. Every member has a capacity of
+// ceil(LoadFactor * average load) and a key placed on a full member spills over to the next-ranked one.
+//
+// Spilling is limited to the first MaxSpill+1 ranked members, so a component without load
+// information (like the sidecar) still finds the owner by asking those candidates.
+type BoundedLoadConfig struct {
+	LoadFactor float64
+	MaxSpill   int
+}
+
+func (c BoundedLoadConfig) Enabled() bool {
+	return c.LoadFactor >= 1
+}
+
+// Candidates is the number of ranked members a key can be placed on.
+func (c BoundedLoadConfig) Candidates() int {
+	if !c.Enabled() {
+		return 1
+	}
+	if c.MaxSpill <= 0 {
+		return DefaultMaxSpill + 1
+	}
+	return c.MaxSpill + 1
+}
+
+// SetLoads replaces the live load of every member. Loads of unknown members are ignored.
+func (r *Rendezvous) SetLoads(loads map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loads = make(map[string]int, len(loads))
+	for member, load := range loads {
+		r.loads[member] = load
+	}
+}
+
+// capacity returns ceil(c * average load), counting the key about to be placed.
+func (r *Rendezvous) capacity() int {
+	total := 0
+	for member := range r.members {
+		total += r.loads[member]
+	}
+	average := float64(total+1) / float64(len(r.members))
+	return int(math.Ceil(r.config.BoundedLoad.LoadFactor * average))
+}
@@ -0,0 +1,96 @@
+package rendezvous
+
+// KeyMove describes a key whose owner changed between two member sets.
+type KeyMove struct {
+	Key      string
+	OldOwner string
+	NewOwner string
+}
+
+// Diff returns the keys of owners whose owner changes when going from oldMembers to newMembers.
+// owners maps each key to its owner under oldMembers.
+//
+// Only keys owned by a removed (or lighter) member, or won by an added (or heavier) member, can move,
+// so for every other key only the added members are scored instead of the whole set.
+func (r *Rendezvous) Diff(oldMembers, newMembers []WeightedMember, owners map[string]string) []KeyMove {
+	moves := make([]KeyMove, 0)
+	if len(owners) == 0 {
+		return moves
+	}
+	if r.skeleton != nil {
+		// Cluster weights change with membership, so any key can move in the skeleton.
+		return r.diffAll(newMembers, owners)
+	}
+
+	previous := make(map[string]WeightedMember, len(oldMembers))
+	for _, member := range oldMembers {
+		previous[member.member] = member
+	}
+	next := make(map[string]*WeightedMember, len(newMembers))
+	candidates := make([]*WeightedMember, 0, len(newMembers))
+	gainers := make([]*WeightedMember, 0)
+	for i := range newMembers {
+		member := newMembers[i]
+		member.hash = r.hasher.Sum64(keyBytes(member.member))
+		next[member.member] = &member
+		candidates = append(candidates, &member)
+		if old, ok := previous[member.member]; !ok || member.weight > old.weight {
+			gainers = append(gainers, &member)
+		}
+	}
+
+	for key, owner := range owners {
+		scorer := r.scorer(keyBytes(key))
+		current, stillMember := next[owner]
+		old, wasMember := previous[owner]
+		var newOwner *WeightedMember
+		if !stillMember || !wasMember || current.weight < old.weight {
+			// The owner left or lost weight: the key may land anywhere.
+			newOwner = bestOf(candidates, &scorer)
+		} else {
+			newOwner = current
+			if gainer := bestOf(gainers, &scorer); gainer != nil && beats(gainer, current, &scorer) {
+				newOwner = gainer
+			}
+		}
+		scorer.release()
+		newOwnerName := ""
+		if newOwner != nil {
+			newOwnerName = newOwner.member
+		}
+		if newOwnerName != owner {
+			moves = append(moves, KeyMove{Key: key, OldOwner: owner, NewOwner: newOwnerName})
+		}
+	}
+	return moves
+}
+
+func (r *Rendezvous) diffAll(newMembers []WeightedMember, owners map[string]string) []KeyMove {
+	moves := make([]KeyMove, 0)
+	next := New(newMembers, r.config)
+	for key, owner := range owners {
+		if newOwner := next.Lookup(key); newOwner != owner {
+			moves = append(moves, KeyMove{Key: key, OldOwner: owner, NewOwner: newOwner})
+		}
+	}
+	return moves
+}
+
+// bestOf returns the member with the lowest score for the key, breaking ties by name like LocateKey.
+func bestOf(members []*WeightedMember, scorer *scorer) (best *WeightedMember) {
+	for _, member := range members {
+		if best == nil || beats(member, best, scorer) {
+			best = member
+		}
+	}
+	return best
+}
+
+func beats(a, b *WeightedMember, scorer *scorer) bool {
+	scoreA := scorer.score(a)
+	scoreB := scorer.score(b)
+	if scoreA == scoreB {
+		return a.member < b.member
+	}
+	return scoreA < scoreB
+}
@@ -0,0 +1,168 @@
+package rendezvous
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"strings"
+
+	"github.com/zeebo/xxh3"
+)
+
+const (
+	HasherXXH3    = "xxh3"
+	HasherSipHash = "siphash"
+	HasherFNV     = "fnv"
+)
+
+// HasherKeyEnv holds a hex encoded SipHash key, for keys injected from a Secret as an environment variable.
+const HasherKeyEnv = "WS_OPERATOR_HASH_KEY"
+
+// fingerprintProbe is hashed to compare hashers between components without exposing their key.
+var fingerprintProbe = []byte("ws-operator/hasher-fingerprint")
+
+// HasherConfig selects and configures the hash function used for routing.
+// Every sidecar and load balancer of an app must use the same configuration.
+type HasherConfig struct {
+	Name string
+	// Seed is used by xxh3.
+	Seed uint64
+	// KeyFile holds the 16 byte SipHash key, raw or hex encoded. Usually a mounted Secret.
+	KeyFile string
+}
+
+// NewHasher creates the hasher described by config. An empty name means unseeded xxh3.
+func NewHasher(config HasherConfig) (Hasher, error) {
+	switch config.Name {
+	case "", HasherXXH3:
+		if config.Seed == 0 {
+			return &DefaultHasher{}, nil
+		}
+		return &SeededHasher{Seed: config.Seed}, nil
+	case HasherSipHash:
+		key, err := loadSipHashKey(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewSipHasher(key), nil
+	case HasherFNV:
+		return &FNVHasher{}, nil
+	default:
+		return nil, fmt.Errorf("unknown hasher %q, expected one of %s, %s, %s", config.Name, HasherXXH3, HasherSipHash, HasherFNV)
+	}
+}
+
+func loadSipHashKey(keyFile string) ([]byte, error) {
+	var raw []byte
+	if keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read siphash key: %w", err)
+		}
+		raw = content
+	} else if value := os.Getenv(HasherKeyEnv); value != "" {
+		raw = []byte(value)
+	} else {
+		return nil, errors.New("siphash requires a key file or " + HasherKeyEnv)
+	}
+	if len(raw) == 16 {
+		return raw, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(key) != 16 {
+		return nil, errors.New("siphash key must be 16 raw bytes or 32 hex characters")
+	}
+	return key, nil
+}
+
+// Fingerprint identifies a hasher by its output, so components can check they agree on routing.
+func Fingerprint(h Hasher) string {
+	return fmt.Sprintf("%016x", h.Sum64(fingerprintProbe))
+}
+
+// SeededHasher is xxh3 with a seed, so user IDs can't be chosen to land on a given member.
+type SeededHasher struct {
+	Seed uint64
+}
+
+func (h *SeededHasher) Sum64(b []byte) uint64 {
+	return xxh3.HashSeed(b, h.Seed)
+}
+
+// FNVHasher is 64-bit FNV-1a, for compatibility with routing done elsewhere.
+type FNVHasher struct {
+}
+
+func (h *FNVHasher) Sum64(b []byte) uint64 {
+	hash := uint64(14695981039346656037)
+	for _, c := range b {
+		hash ^= uint64(c)
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+// SipHasher is SipHash-2-4 keyed with a secret.
+type SipHasher struct {
+	k0, k1 uint64
+}
+
+// NewSipHasher creates a SipHasher from a 16 byte key.
+func NewSipHasher(key []byte) *SipHasher {
+	return &SipHasher{
+		k0: binary.LittleEndian.Uint64(key[:8]),
+		k1: binary.LittleEndian.Uint64(key[8:16]),
+	}
+}
+
+func (h *SipHasher) Sum64(b []byte) uint64 {
+	v0 := h.k0 ^ 0x736f6d6570736575
+	v1 := h.k1 ^ 0x646f72616e646f6d
+	v2 := h.k0 ^ 0x6c7967656e657261
+	v3 := h.k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(b)
+	for len(b) >= 8 {
+		m := binary.LittleEndian.Uint64(b)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		b = b[8:]
+	}
+	last := uint64(length) << 56
+	for i, c := range b {
+		last |= uint64(c) << (8 * i)
+	}
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
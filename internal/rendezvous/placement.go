@@ -0,0 +1,67 @@
+package rendezvous
+
+// Candidates is the number of ranked members a key can be placed on with the configured
+// bounded load and zone preference. Components without load or zone information must
+// consider all of them to find the owner of a key.
+func (c Config) Candidates() int {
+	return max(c.BoundedLoad.Candidates(), c.Zone.Candidates())
+}
+
+// PlaceN returns up to n ranked members for a new key with the member it should be placed on first.
+// Without bounded load or zone preference this is LookupN. Otherwise the placement candidates come
+// first, in order of preference, followed by the rest of the ranking. Asking for Candidates members
+// returns all of them.
+//
+// Candidates are preferred by their zone biased score. With bounded load the first preferred
+// candidate under capacity is placed, or the least loaded one when all are full.
+func (r *Rendezvous) PlaceN(key string, n int) []string {
+	window := r.config.Candidates()
+	if window == 1 {
+		return r.LookupN(key, n)
+	}
+	ranked := r.LookupN(key, max(n, window))
+	if len(ranked) == 0 {
+		return ranked
+	}
+	candidates := ranked[:min(len(ranked), window)]
+	r.mu.RLock()
+	order := r.preferLocalZone(key, candidates)
+	placed := 0
+	if r.config.BoundedLoad.Enabled() {
+		capacity := r.capacity()
+		placed = -1
+		leastLoaded := 0
+		for position, i := range order {
+			if r.loads[candidates[i]] < capacity {
+				placed = position
+				break
+			}
+			if r.loads[candidates[i]] < r.loads[candidates[order[leastLoaded]]] {
+				leastLoaded = position
+			}
+		}
+		if placed < 0 {
+			placed = leastLoaded
+		}
+	}
+	r.mu.RUnlock()
+
+	preferred := make([]string, 0, len(ranked))
+	preferred = append(preferred, candidates[order[placed]])
+	for position, i := range order {
+		if position != placed {
+			preferred = append(preferred, candidates[i])
+		}
+	}
+	preferred = append(preferred, ranked[len(candidates):]...)
+	return preferred[:min(n, len(preferred))]
+}
+
+// Place returns the member a new key should be placed on.
+func (r *Rendezvous) Place(key string) string {
+	placed := r.PlaceN(key, 1)
+	if len(placed) == 0 {
+		return ""
+	}
+	return placed[0]
+}
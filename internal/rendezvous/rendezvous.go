@@ -1,8 +1,11 @@
 package rendezvous
 
 import (
+	"encoding/json"
 	"math"
+	"sort"
 	"sync"
+	"unsafe"
 
 	"github.com/buraksezer/consistent"
 	"github.com/zeebo/xxh3"
@@ -22,32 +25,92 @@ func (h *DefaultHasher) Sum64(b []byte) uint64 {
 	return xxh3.Hash(b)
 }
 
+// DefaultWeight is the weight given to members added without an explicit one.
+const DefaultWeight = 1.0
+
+// WeightedMember is a member of the rendezvous set along with its relative weight.
 type WeightedMember struct {
 	member string
 	weight float64
+	// zone is the topology zone of the member, empty when unknown.
+	zone string
+	// hash is the pre-computed hash of member, set when the member joins a Rendezvous.
+	hash uint64
+}
+
+// NewWeightedMember creates a WeightedMember. Non-positive weights fall back to DefaultWeight
+// since a zero or negative weight would keep the member from ever winning a key.
+func NewWeightedMember(member string, weight float64) WeightedMember {
+	if weight <= 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		weight = DefaultWeight
+	}
+	return WeightedMember{
+		member: member,
+		weight: weight,
+	}
+}
+
+func (m WeightedMember) Member() string {
+	return m.member
+}
+
+func (m WeightedMember) Weight() float64 {
+	return m.weight
+}
+
+// WithZone returns a copy of the member located in zone.
+func (m WeightedMember) WithZone(zone string) WeightedMember {
+	m.zone = zone
+	return m
+}
+
+func (m WeightedMember) Zone() string {
+	return m.zone
+}
+
+func (m WeightedMember) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Member string  `json:"member"`
+		Weight float64 `json:"weight"`
+		Zone   string  `json:"zone,omitempty"`
+	}{m.member, m.weight, m.zone})
 }
 
 // Config represents a structure to control the rendezvous package.
 type Config struct {
 	Hasher Hasher
+	// Scoring is how members are scored for a key, ScoringConcat when empty.
+	Scoring Scoring
+	// Skeleton enables the hierarchical lookup. The zero value keeps the flat O(members) lookup.
+	// It always scores with ScoringMixed.
+	Skeleton SkeletonConfig
+	// BoundedLoad enables load-aware placement through Place and PlaceN.
+	BoundedLoad BoundedLoadConfig
+	// Zone enables zone-local placement through Place and PlaceN.
+	Zone ZoneConfig
 }
 
 // Rendezvous holds the information about the members of the consistent hash circle.
 type Rendezvous struct {
 	mu sync.RWMutex
 
-	config  Config
-	hasher  Hasher
-	members map[string]*WeightedMember
-	ring    map[uint64]*WeightedMember
+	config    Config
+	hasher    Hasher
+	members   map[string]*WeightedMember
+	ring      map[uint64]*WeightedMember
+	skeleton  *skeleton
+	loads     map[string]int
+	localZone string
 }
 
 // New creates and returns a new Rendezvous object
 func New(members []WeightedMember, config Config) *Rendezvous {
 	r := &Rendezvous{
-		config:  config,
-		members: make(map[string]*WeightedMember),
-		ring:    make(map[uint64]*WeightedMember),
+		config:    config,
+		members:   make(map[string]*WeightedMember),
+		ring:      make(map[uint64]*WeightedMember),
+		loads:     make(map[string]int),
+		localZone: config.Zone.LocalZone,
 	}
 
 	if config.Hasher == nil {
@@ -56,6 +119,9 @@ func New(members []WeightedMember, config Config) *Rendezvous {
 	} else {
 		r.hasher = config.Hasher
 	}
+	if config.Skeleton.enabled() {
+		r.skeleton = newSkeleton(config.Skeleton)
+	}
 	for _, member := range members {
 		r.add(member)
 	}
@@ -72,20 +138,57 @@ func IntToFloat(value uint64) (float_value float64) {
 	return float64((value & FiftyThreeOnes)) / FiftyThreeZeros
 }
 
-func (r *Rendezvous) ComputeWeightedScore(m WeightedMember, key []byte) (score float64) {
-	hash := r.hasher.Sum64(append([]byte(m.member), key...))
-	score = 1.0 / math.Log(IntToFloat(hash))
-	return m.weight * score
+// mix64 is the murmur3 64-bit finalizer. It spreads the combined member and key hashes
+// so scores can be computed without hashing the concatenated member and key.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// score is the weighted rendezvous score of a member for a key with ScoringMixed. Lower is better.
+func score(memberHash, keyHash uint64, weight float64) float64 {
+	return weight / math.Log(IntToFloat(mix64(memberHash^keyHash)))
+}
+
+// keyBytes views a string as bytes without copying. Hashers must not modify their input.
+func keyBytes(key string) []byte {
+	return unsafe.Slice(unsafe.StringData(key), len(key))
+}
+
+func (r *Rendezvous) memberHash(m WeightedMember) uint64 {
+	if m.hash != 0 {
+		return m.hash
+	}
+	return r.hasher.Sum64(keyBytes(m.member))
+}
+
+func (r *Rendezvous) ComputeWeightedScore(m WeightedMember, key []byte) float64 {
+	m.hash = r.memberHash(m)
+	scorer := r.scorer(key)
+	defer scorer.release()
+	return scorer.score(&m)
 }
 
 func (r *Rendezvous) LocateKey(key []byte) (member WeightedMember) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	scorer := r.scorer(key)
+	defer scorer.release()
+	if r.skeleton != nil {
+		if found := r.skeleton.locate(scorer.keyHash); found != nil {
+			member = *found
+		}
+		return member
+	}
 	lowest_score := 1.0
 	for _, _member := range r.members {
-		score := r.ComputeWeightedScore(*_member, key)
-		if score < lowest_score {
-			lowest_score = score
+		memberScore := scorer.score(_member)
+		if memberScore < lowest_score || (memberScore == lowest_score && _member.member < member.member) {
+			lowest_score = memberScore
 			member = *_member
 		}
 	}
@@ -93,10 +196,51 @@ func (r *Rendezvous) LocateKey(key []byte) (member WeightedMember) {
 }
 
 func (r *Rendezvous) Lookup(node string) string {
-	foundNode := r.LocateKey([]byte(node))
+	foundNode := r.LocateKey(keyBytes(node))
 	return foundNode.member
 }
 
+// LocateKeyN returns up to n members ranked by their score for the key, best first.
+func (r *Rendezvous) LocateKeyN(key []byte, n int) (members []WeightedMember) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n <= 0 || len(r.members) == 0 {
+		return []WeightedMember{}
+	}
+	scorer := r.scorer(key)
+	defer scorer.release()
+	if r.skeleton != nil {
+		return r.skeleton.rank(scorer.keyHash, n)
+	}
+	scores := make(byScore, 0, len(r.members))
+	for _, _member := range r.members {
+		scores = append(scores, struct {
+			string
+			float64
+		}{_member.member, scorer.score(_member)})
+	}
+	sort.Sort(scores)
+	if n > len(scores) {
+		n = len(scores)
+	}
+	members = make([]WeightedMember, n)
+	for i := 0; i < n; i++ {
+		members[i] = *r.members[scores[i].string]
+	}
+	return members
+}
+
+// LookupN returns up to n member names ranked by their score for the key, best first.
+// The first entry is always the same member returned by Lookup.
+func (r *Rendezvous) LookupN(node string, n int) []string {
+	found := r.LocateKeyN(keyBytes(node), n)
+	hosts := make([]string, len(found))
+	for i, member := range found {
+		hosts[i] = member.member
+	}
+	return hosts
+}
+
 type byScore []struct {
 	string
 	float64
@@ -111,11 +255,18 @@ func (scores byScore) Swap(i, j int) {
 }
 
 func (scores byScore) Less(i, j int) bool {
+	if scores[i].float64 == scores[j].float64 {
+		return scores[i].string < scores[j].string
+	}
 	return scores[i].float64 < scores[j].float64
 }
 
 func (r *Rendezvous) add(member WeightedMember) {
+	member.hash = r.hasher.Sum64(keyBytes(member.member))
 	r.members[member.member] = &member
+	if r.skeleton != nil {
+		r.skeleton.add(&member)
+	}
 }
 
 func (r *Rendezvous) AddMember(member WeightedMember) {
@@ -129,22 +280,49 @@ func (r *Rendezvous) AddMember(member WeightedMember) {
 }
 
 func (r *Rendezvous) Add(node string) {
-	r.AddMember(WeightedMember{
-		member: node,
-		weight: 1.0,
-	})
+	r.AddMember(NewWeightedMember(node, DefaultWeight))
+}
+
+func (r *Rendezvous) AddWeighted(node string, weight float64) {
+	r.AddMember(NewWeightedMember(node, weight))
+}
+
+// UpdateWeight changes the weight of an existing member.
+// It returns true only when the member exists and its weight actually changed.
+func (r *Rendezvous) UpdateWeight(name string, weight float64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	member, ok := r.members[name]
+	if !ok {
+		return false
+	}
+	updated := NewWeightedMember(name, weight).WithZone(member.zone)
+	if member.weight == updated.weight {
+		return false
+	}
+	updated.hash = member.hash
+	r.members[name] = &updated
+	if r.skeleton != nil {
+		r.skeleton.remove(member)
+		r.skeleton.add(&updated)
+	}
+	return true
 }
 
 func (r *Rendezvous) Remove(name string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, ok := r.members[name]; !ok {
+	member, ok := r.members[name]
+	if !ok {
 		// There is no member with that name. Quit immediately.
 		return
 	}
 
 	delete(r.members, name)
+	if r.skeleton != nil {
+		r.skeleton.remove(member)
+	}
 }
 
 // GetMembers returns a thread-safe copy of members.
@@ -161,9 +339,16 @@ func (r *Rendezvous) GetNodes() (members []WeightedMember) {
 }
 
 func (r *Rendezvous) GetAllHosts() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	hosts := make([]string, 0)
 	for _, member := range r.members {
 		hosts = append(hosts, member.member)
 	}
 	return hosts
 }
+
+// Members returns the member names, so a Rendezvous can be used as a balancer.Balancer.
+func (r *Rendezvous) Members() []string {
+	return r.GetAllHosts()
+}
@@ -0,0 +1,376 @@
+package rendezvous
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/zeebo/xxh3"
+)
+
+var benchmarkSizes = []int{10, 100, 1000, 10000}
+
+func newMembers(count int) []WeightedMember {
+	members := make([]WeightedMember, count)
+	for i := range members {
+		members[i] = NewWeightedMember(fmt.Sprintf("10.0.%d.%d:3000", i/256, i%256), DefaultWeight)
+	}
+	return members
+}
+
+func implementations(members []WeightedMember) map[string]*Rendezvous {
+	return map[string]*Rendezvous{
+		"flat":     New(members, Config{}),
+		"mixed":    New(members, Config{Scoring: ScoringMixed}),
+		"skeleton": New(members, Config{Skeleton: DefaultSkeletonConfig}),
+	}
+}
+
+// legacyLocateKey is the original implementation, hashing member+key for every member.
+func legacyLocateKey(members []WeightedMember, key []byte) (member WeightedMember) {
+	lowest_score := 1.0
+	for _, m := range members {
+		hash := xxh3.Hash(append([]byte(m.member), key...))
+		score := m.weight * (1.0 / math.Log(IntToFloat(hash)))
+		if score < lowest_score {
+			lowest_score = score
+			member = m
+		}
+	}
+	return member
+}
+
+func TestConcatScoringKeepsTheOriginalOwners(t *testing.T) {
+	members := newMembers(50)
+	for i := range members {
+		members[i] = NewWeightedMember(members[i].Member(), float64(1+i%3))
+	}
+	r := New(members, Config{})
+	mixed := New(members, Config{Scoring: ScoringMixed})
+	moved := 0
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		original := legacyLocateKey(members, []byte(key)).Member()
+		if owner := r.Lookup(key); owner != original {
+			t.Fatalf("expected %s on %s like the original scoring, got %s", key, original, owner)
+		}
+		if mixed.Lookup(key) != original {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("expected the mixed scoring to rank members differently")
+	}
+	if _, err := ParseScoring("xor"); err == nil {
+		t.Fatal("expected an unknown scoring to be rejected")
+	}
+}
+
+func TestLookupNStartsWithLookup(t *testing.T) {
+	for name, r := range implementations(newMembers(500)) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("user-%d", i)
+				ranked := r.LookupN(key, 3)
+				if len(ranked) != 3 {
+					t.Fatalf("expected 3 ranked members, got %d", len(ranked))
+				}
+				if ranked[0] != r.Lookup(key) {
+					t.Fatalf("expected first ranked member %s to match lookup %s", ranked[0], r.Lookup(key))
+				}
+				if ranked[0] == ranked[1] || ranked[1] == ranked[2] || ranked[0] == ranked[2] {
+					t.Fatalf("expected distinct ranked members, got %v", ranked)
+				}
+			}
+		})
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	const members = 50
+	const keys = 100000
+	for name, r := range implementations(newMembers(members)) {
+		t.Run(name, func(t *testing.T) {
+			counts := make(map[string]int)
+			for i := 0; i < keys; i++ {
+				counts[r.Lookup(fmt.Sprintf("user-%d", i))]++
+			}
+			if len(counts) != members {
+				t.Fatalf("expected keys on all %d members, got %d", members, len(counts))
+			}
+			mean := float64(keys) / members
+			for member, count := range counts {
+				if math.Abs(float64(count)-mean)/mean > 0.5 {
+					t.Errorf("member %s owns %d keys, mean is %.0f", member, count, mean)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveMovesFewKeys(t *testing.T) {
+	for name, r := range implementations(newMembers(100)) {
+		t.Run(name, func(t *testing.T) {
+			before := make(map[string]string)
+			for i := 0; i < 10000; i++ {
+				key := fmt.Sprintf("user-%d", i)
+				before[key] = r.Lookup(key)
+			}
+			removed := newMembers(100)[42].Member()
+			r.Remove(removed)
+			orphaned, moved := 0, 0
+			for key, owner := range before {
+				after := r.Lookup(key)
+				if after == removed {
+					t.Fatalf("key %s still routed to removed member", key)
+				}
+				if owner == removed {
+					orphaned++
+				}
+				if after != owner {
+					moved++
+				}
+			}
+			// Flat rendezvous is minimally disruptive. The skeleton also shifts some keys between
+			// sibling clusters when a cluster gets lighter, so it is only bounded.
+			limit := orphaned
+			if name == "skeleton" {
+				limit = 3 * orphaned
+			}
+			if moved > limit {
+				t.Errorf("expected at most %d moved keys, got %d", limit, moved)
+			}
+		})
+	}
+}
+
+func TestUpdateWeight(t *testing.T) {
+	for name, r := range implementations(newMembers(10)) {
+		t.Run(name, func(t *testing.T) {
+			heavy := newMembers(10)[0].Member()
+			if r.UpdateWeight(heavy, DefaultWeight) {
+				t.Fatal("expected no change when the weight is the same")
+			}
+			if r.UpdateWeight("missing", 2) {
+				t.Fatal("expected no change for unknown member")
+			}
+			countOwned := func() int {
+				owned := 0
+				for i := 0; i < 20000; i++ {
+					if r.Lookup(fmt.Sprintf("user-%d", i)) == heavy {
+						owned++
+					}
+				}
+				return owned
+			}
+			before := countOwned()
+			if !r.UpdateWeight(heavy, 4) {
+				t.Fatal("expected weight to be updated")
+			}
+			after := countOwned()
+			if after < before*2 {
+				t.Errorf("expected heavier member to own many more keys, before %d after %d", before, after)
+			}
+		})
+	}
+}
+
+func TestLookupDoesNotAllocate(t *testing.T) {
+	for name, r := range implementations(newMembers(100)) {
+		t.Run(name, func(t *testing.T) {
+			allocs := testing.AllocsPerRun(100, func() {
+				r.Lookup("user-1")
+			})
+			if allocs != 0 {
+				t.Errorf("expected no allocations, got %.1f", allocs)
+			}
+		})
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		members := newMembers(size)
+		b.Run(fmt.Sprintf("legacy/members=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			key := []byte("user-123")
+			for i := 0; i < b.N; i++ {
+				legacyLocateKey(members, key)
+			}
+		})
+		for name, r := range implementations(members) {
+			b.Run(fmt.Sprintf("%s/members=%d", name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					r.Lookup("user-123")
+				}
+			})
+		}
+	}
+}
+
+func TestDiffMatchesFullLookup(t *testing.T) {
+	all := newMembers(60)
+	oldMembers := all[:50]
+	newMembers := append(append([]WeightedMember{}, all[5:50]...), all[50:]...)
+	newMembers[0] = NewWeightedMember(newMembers[0].Member(), 3)
+	newMembers[1] = NewWeightedMember(newMembers[1].Member(), 0.5)
+	for name, r := range implementations(oldMembers) {
+		t.Run(name, func(t *testing.T) {
+			owners := make(map[string]string)
+			for i := 0; i < 5000; i++ {
+				key := fmt.Sprintf("user-%d", i)
+				owners[key] = r.Lookup(key)
+			}
+			expected := New(newMembers, r.config)
+			moves := r.Diff(oldMembers, newMembers, owners)
+			moved := make(map[string]KeyMove, len(moves))
+			for _, move := range moves {
+				moved[move.Key] = move
+			}
+			for key, owner := range owners {
+				newOwner := expected.Lookup(key)
+				move, ok := moved[key]
+				if newOwner == owner && ok {
+					t.Fatalf("key %s reported as moved but stays on %s", key, owner)
+				}
+				if newOwner != owner && (!ok || move.NewOwner != newOwner || move.OldOwner != owner) {
+					t.Fatalf("key %s expected to move from %s to %s, got %+v", key, owner, newOwner, move)
+				}
+			}
+		})
+	}
+}
+
+func TestPlaceSpillsOverWhenFull(t *testing.T) {
+	members := newMembers(10)
+	r := New(members, Config{BoundedLoad: BoundedLoadConfig{LoadFactor: 1.25, MaxSpill: 2}})
+	ranked := r.LookupN("user-1", 3)
+	if r.Place("user-1") != ranked[0] {
+		t.Fatalf("expected placement on the winner without load, got %s", r.Place("user-1"))
+	}
+	r.SetLoads(map[string]int{ranked[0]: 100})
+	if placed := r.PlaceN("user-1", 1); len(placed) != 1 || placed[0] != ranked[1] {
+		t.Fatalf("expected spill over to %s alone, got %v", ranked[1], placed)
+	}
+	placed := r.PlaceN("user-1", r.config.Candidates())
+	if len(placed) != 3 || placed[0] != ranked[1] || !slices.Contains(placed, ranked[0]) || !slices.Contains(placed, ranked[2]) {
+		t.Fatalf("expected every candidate with the placed one first, got %v", placed)
+	}
+	if placed := r.PlaceN("user-1", 5); len(placed) != 5 || !slices.Equal(placed[3:], r.LookupN("user-1", 5)[3:]) {
+		t.Fatalf("expected the rest of the ranking after the candidates, got %v", placed)
+	}
+	r.SetLoads(map[string]int{ranked[0]: 100, ranked[1]: 100, ranked[2]: 50})
+	if r.Place("user-1") != ranked[2] {
+		t.Fatalf("expected the least loaded candidate when all are full, got %s", r.Place("user-1"))
+	}
+}
+
+func TestPlaceBoundsLoad(t *testing.T) {
+	const keys = 10000
+	members := newMembers(20)
+	r := New(members, Config{BoundedLoad: BoundedLoadConfig{LoadFactor: 1.25, MaxSpill: 5}})
+	loads := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		r.SetLoads(loads)
+		loads[r.Place(fmt.Sprintf("user-%d", i))]++
+	}
+	limit := int(math.Ceil(1.25*keys/20)) + 1
+	for member, load := range loads {
+		if load > limit {
+			t.Errorf("member %s has load %d above the bound %d", member, load, limit)
+		}
+	}
+}
+
+func TestSipHasherVectors(t *testing.T) {
+	key := make([]byte, 16)
+	message := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range message {
+		message[i] = byte(i)
+	}
+	h := NewSipHasher(key)
+	if sum := h.Sum64(nil); sum != 0x726fdb47dd0e0e31 {
+		t.Errorf("unexpected siphash of empty message: %x", sum)
+	}
+	if sum := h.Sum64(message); sum != 0xa129ca6149be45e5 {
+		t.Errorf("unexpected siphash of 15 byte message: %x", sum)
+	}
+}
+
+func TestNewHasher(t *testing.T) {
+	unseeded, _ := NewHasher(HasherConfig{})
+	seeded, _ := NewHasher(HasherConfig{Name: HasherXXH3, Seed: 42})
+	fnv, _ := NewHasher(HasherConfig{Name: HasherFNV})
+	if Fingerprint(unseeded) == Fingerprint(seeded) || Fingerprint(unseeded) == Fingerprint(fnv) {
+		t.Error("expected different hashers to have different fingerprints")
+	}
+	if _, err := NewHasher(HasherConfig{Name: HasherSipHash, KeyFile: "/does/not/exist"}); err == nil {
+		t.Error("expected missing siphash key file to fail")
+	}
+	if _, err := NewHasher(HasherConfig{Name: "md5"}); err == nil {
+		t.Error("expected unknown hasher to fail")
+	}
+}
+
+func TestPlacePrefersLocalZone(t *testing.T) {
+	members := newMembers(30)
+	for i := range members {
+		members[i] = members[i].WithZone(fmt.Sprintf("zone-%d", i%3))
+	}
+	r := New(members, Config{Zone: ZoneConfig{LocalZone: "zone-0", Bias: 1000, MaxSpill: 4}})
+	plain := New(members, Config{})
+	local, ranked := 0, 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		placed := r.PlaceN(key, r.config.Candidates())
+		candidates := plain.LookupN(key, 5)
+		if len(placed) != len(candidates) {
+			t.Fatalf("expected every candidate to be returned, got %v", placed)
+		}
+		found := false
+		for _, candidate := range candidates {
+			found = found || candidate == placed[0]
+		}
+		if !found {
+			t.Fatalf("placement %s left the ranked candidates %v", placed[0], candidates)
+		}
+		if r.Zone(placed[0]) == "zone-0" {
+			local++
+		}
+		if plain.Zone(candidates[0]) == "zone-0" {
+			ranked++
+		}
+	}
+	if local <= ranked {
+		t.Errorf("expected zone preference to keep more keys local, got %d local vs %d without preference", local, ranked)
+	}
+}
+
+func TestRankOnlyIgnoresTheLocalZone(t *testing.T) {
+	members := newMembers(30)
+	for i := range members {
+		members[i] = members[i].WithZone(fmt.Sprintf("zone-%d", i%3))
+	}
+	// Sidecars in different zones agree on the order the candidates are tried in.
+	config := ZoneConfig{Bias: 1000, MaxSpill: 4, RankOnly: true}
+	zones := make([]*Rendezvous, 3)
+	for i := range zones {
+		config.LocalZone = fmt.Sprintf("zone-%d", i)
+		zones[i] = New(members, Config{Zone: config})
+	}
+	plain := New(members, Config{})
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		ranked := plain.LookupN(key, 5)
+		for _, r := range zones {
+			if placed := r.PlaceN(key, r.config.Candidates()); !slices.Equal(placed, ranked) {
+				t.Fatalf("expected %s in %s to be tried in ranking order %v, got %v", key, r.LocalZone(), ranked, placed)
+			}
+		}
+	}
+}
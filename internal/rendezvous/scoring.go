@@ -0,0 +1,79 @@
+package rendezvous
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Scoring selects how the score of a member for a key is computed. Every component routing the same
+// keys must use the same scoring, see Fingerprint.
+type Scoring string
+
+const (
+	// ScoringConcat hashes the member name followed by the key, the original scoring. It is the
+	// default so upgraded components agree on the owners with the ones they replace.
+	ScoringConcat Scoring = "concat"
+	// ScoringMixed mixes the hash of the member, computed once, with the hash of the key, so a lookup
+	// hashes the key alone. It moves nearly every key compared to ScoringConcat, so switching requires
+	// restarting every component together.
+	ScoringMixed Scoring = "mixed"
+)
+
+// Scorings lists the supported scorings.
+var Scorings = []Scoring{ScoringConcat, ScoringMixed}
+
+// ParseScoring validates a scoring name. Empty means ScoringConcat.
+func ParseScoring(name string) (Scoring, error) {
+	switch Scoring(name) {
+	case "", ScoringConcat:
+		return ScoringConcat, nil
+	case ScoringMixed:
+		return ScoringMixed, nil
+	}
+	return "", fmt.Errorf("unknown scoring %q, expected one of %v", name, Scorings)
+}
+
+// scorer computes the scores of members for a single key.
+type scorer struct {
+	mixed   bool
+	hasher  Hasher
+	key     []byte
+	keyHash uint64
+	// buf holds the member name followed by the key with ScoringConcat, reused across members.
+	buf *[]byte
+}
+
+var scoreBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// scorer returns the scorer of key, which must be released once the lookup is done.
+func (r *Rendezvous) scorer(key []byte) scorer {
+	s := scorer{mixed: r.config.Scoring == ScoringMixed, hasher: r.hasher, key: key}
+	if s.mixed || r.skeleton != nil {
+		s.keyHash = r.hasher.Sum64(key)
+	} else {
+		s.buf = scoreBuffers.Get().(*[]byte)
+	}
+	return s
+}
+
+func (s *scorer) release() {
+	if s.buf != nil {
+		scoreBuffers.Put(s.buf)
+		s.buf = nil
+	}
+}
+
+// score is the weighted rendezvous score of m for the key. Lower is better.
+func (s *scorer) score(m *WeightedMember) float64 {
+	return s.weighted(m, m.weight)
+}
+
+// weighted scores m as if it had weight.
+func (s *scorer) weighted(m *WeightedMember, weight float64) float64 {
+	if s.mixed {
+		return score(m.hash, s.keyHash, weight)
+	}
+	*s.buf = append(append((*s.buf)[:0], m.member...), s.key...)
+	return weight * (1.0 / math.Log(IntToFloat(s.hasher.Sum64(*s.buf))))
+}
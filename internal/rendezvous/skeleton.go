@@ -0,0 +1,205 @@
+package rendezvous
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SkeletonConfig controls the hierarchical (skeleton-based) rendezvous lookup.
+// Members are spread over Fanout^Depth virtual leaf clusters. A lookup runs rendezvous
+// over the Fanout children of each level and then over the members of a single leaf,
+// costing O(Fanout*Depth + members/leaves) instead of O(members).
+type SkeletonConfig struct {
+	Fanout int
+	Depth  int
+}
+
+// DefaultSkeletonConfig gives 256 leaf clusters, which keeps lookups in the tens of
+// score computations for up to ~10k members.
+var DefaultSkeletonConfig = SkeletonConfig{Fanout: 16, Depth: 2}
+
+func (c SkeletonConfig) enabled() bool {
+	return c.Fanout > 1 && c.Depth > 0
+}
+
+// String describes the skeleton for comparing it between components, empty when it is disabled.
+func (c SkeletonConfig) String() string {
+	if !c.enabled() {
+		return ""
+	}
+	return fmt.Sprintf("fanout=%d,depth=%d", c.Fanout, c.Depth)
+}
+
+// leafSalt decorrelates leaf placement from the member's own scores.
+const leafSalt = 0x9e3779b97f4a7c15
+
+type skeleton struct {
+	fanout int
+	depth  int
+	// seeds and weights are indexed by level then node. Level l has Fanout^(l+1) nodes.
+	// weights holds the total member weight under each node.
+	seeds   [][]uint64
+	weights [][]float64
+	// leaves holds the members of each node on the last level, sorted by name.
+	leaves [][]*WeightedMember
+}
+
+func newSkeleton(config SkeletonConfig) *skeleton {
+	s := &skeleton{
+		fanout:  config.Fanout,
+		depth:   config.Depth,
+		seeds:   make([][]uint64, config.Depth),
+		weights: make([][]float64, config.Depth),
+	}
+	nodes := 1
+	for level := 0; level < config.Depth; level++ {
+		nodes *= config.Fanout
+		s.seeds[level] = make([]uint64, nodes)
+		s.weights[level] = make([]float64, nodes)
+		for node := range s.seeds[level] {
+			s.seeds[level][node] = mix64(uint64(level+1)<<32 | uint64(node))
+		}
+	}
+	s.leaves = make([][]*WeightedMember, nodes)
+	return s
+}
+
+func (s *skeleton) leafFor(member *WeightedMember) int {
+	return int(mix64(member.hash^leafSalt) % uint64(len(s.leaves)))
+}
+
+func (s *skeleton) add(member *WeightedMember) {
+	leaf := s.leafFor(member)
+	members := s.leaves[leaf]
+	i := sort.Search(len(members), func(i int) bool { return members[i].member >= member.member })
+	members = append(members, nil)
+	copy(members[i+1:], members[i:])
+	members[i] = member
+	s.leaves[leaf] = members
+	s.recomputeWeights(leaf)
+}
+
+func (s *skeleton) remove(member *WeightedMember) {
+	leaf := s.leafFor(member)
+	members := s.leaves[leaf]
+	for i, m := range members {
+		if m.member == member.member {
+			s.leaves[leaf] = append(members[:i], members[i+1:]...)
+			break
+		}
+	}
+	s.recomputeWeights(leaf)
+}
+
+// recomputeWeights rebuilds the weights on the path from a leaf to the root.
+// Sums are always taken in the same order so every process with the same members
+// ends up with bit-identical weights and therefore the same placement.
+func (s *skeleton) recomputeWeights(leaf int) {
+	total := 0.0
+	for _, m := range s.leaves[leaf] {
+		total += m.weight
+	}
+	s.weights[s.depth-1][leaf] = total
+	node := leaf
+	for level := s.depth - 2; level >= 0; level-- {
+		node /= s.fanout
+		total = 0.0
+		for _, weight := range s.children(level+1, node) {
+			total += weight
+		}
+		s.weights[level][node] = total
+	}
+}
+
+// children returns the weights of the children of node, which live on the given level.
+func (s *skeleton) children(level, node int) []float64 {
+	first := node * s.fanout
+	return s.weights[level][first : first+s.fanout]
+}
+
+func (s *skeleton) locate(keyHash uint64) *WeightedMember {
+	node := 0
+	for level := 0; level < s.depth; level++ {
+		best := -1
+		lowestScore := 1.0
+		first := node * s.fanout
+		for child, weight := range s.children(level, node) {
+			if weight == 0 {
+				continue
+			}
+			childScore := score(s.seeds[level][first+child], keyHash, weight)
+			if childScore < lowestScore {
+				lowestScore = childScore
+				best = first + child
+			}
+		}
+		if best < 0 {
+			return nil
+		}
+		node = best
+	}
+	var found *WeightedMember
+	lowestScore := 1.0
+	for _, m := range s.leaves[node] {
+		memberScore := score(m.hash, keyHash, m.weight)
+		if memberScore < lowestScore {
+			lowestScore = memberScore
+			found = m
+		}
+	}
+	return found
+}
+
+// rank returns up to n members in hierarchical rendezvous order: every member of the
+// best subtree ranks ahead of the members of the next best one.
+func (s *skeleton) rank(keyHash uint64, n int) []WeightedMember {
+	ranked := make([]WeightedMember, 0, n)
+	return s.rankNode(0, 0, keyHash, n, ranked)
+}
+
+func (s *skeleton) rankNode(level, node int, keyHash uint64, n int, ranked []WeightedMember) []WeightedMember {
+	scores := make(byScore, 0, s.fanout)
+	if level == s.depth {
+		for _, m := range s.leaves[node] {
+			scores = append(scores, struct {
+				string
+				float64
+			}{m.member, score(m.hash, keyHash, m.weight)})
+		}
+		sort.Sort(scores)
+		byName := make(map[string]*WeightedMember, len(s.leaves[node]))
+		for _, m := range s.leaves[node] {
+			byName[m.member] = m
+		}
+		for _, scored := range scores {
+			if len(ranked) == n {
+				break
+			}
+			ranked = append(ranked, *byName[scored.string])
+		}
+		return ranked
+	}
+	first := node * s.fanout
+	order := make([]int, 0, s.fanout)
+	childScores := make([]float64, s.fanout)
+	for child, weight := range s.children(level, node) {
+		if weight == 0 {
+			continue
+		}
+		childScores[child] = score(s.seeds[level][first+child], keyHash, weight)
+		order = append(order, child)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if childScores[order[i]] == childScores[order[j]] {
+			return order[i] < order[j]
+		}
+		return childScores[order[i]] < childScores[order[j]]
+	})
+	for _, child := range order {
+		if len(ranked) == n {
+			break
+		}
+		ranked = s.rankNode(level+1, first+child, keyHash, n, ranked)
+	}
+	return ranked
+}
@@ -0,0 +1,93 @@
+package rendezvous
+
+import (
+	"sort"
+)
+
+// ZoneConfig enables zone-aware placement. Members in the local zone have their weight
+// multiplied by 1+Bias when choosing among the first MaxSpill+1 ranked members, so a key
+// stays in its local zone unless that costs more than Bias of imbalance.
+//
+// Like bounded load, placement never leaves the ranked candidates, so components in other
+// zones still find the owner by asking them.
+//
+// Only the component placing connections, the load balancer, should prefer its zone. The owner
+// depends on the zone of the load balancer the user came through, which the sidecars can't know,
+// so they route with RankOnly and try the candidates in ranking order.
+type ZoneConfig struct {
+	LocalZone string
+	Bias      float64
+	MaxSpill  int
+	// RankOnly keeps the candidates of zone-aware placement without preferring the local zone.
+	RankOnly bool
+}
+
+func (c ZoneConfig) Enabled() bool {
+	return c.Bias > 0
+}
+
+// Candidates is the number of ranked members a key can be placed on.
+func (c ZoneConfig) Candidates() int {
+	if !c.Enabled() {
+		return 1
+	}
+	if c.MaxSpill <= 0 {
+		return DefaultMaxSpill + 1
+	}
+	return c.MaxSpill + 1
+}
+
+// SetLocalZone sets the zone placement prefers, for when it is only known after discovery.
+func (r *Rendezvous) SetLocalZone(zone string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.localZone = zone
+}
+
+func (r *Rendezvous) LocalZone() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.localZone
+}
+
+// Zone returns the zone of a member, empty when unknown.
+func (r *Rendezvous) Zone(member string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if m, ok := r.members[member]; ok {
+		return m.zone
+	}
+	return ""
+}
+
+// preferLocalZone orders the candidates by their score with the local zone bias applied.
+// The caller must hold the read lock.
+func (r *Rendezvous) preferLocalZone(key string, candidates []string) []int {
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	zone := r.config.Zone
+	if !zone.Enabled() || zone.RankOnly || r.localZone == "" {
+		return order
+	}
+	scorer := r.scorer(keyBytes(key))
+	defer scorer.release()
+	scores := make([]float64, len(candidates))
+	for i, name := range candidates {
+		member, ok := r.members[name]
+		if !ok {
+			scores[i] = 0
+			continue
+		}
+		weight := member.weight
+		if member.zone == r.localZone {
+			weight *= 1 + zone.Bias
+		}
+		scores[i] = scorer.weighted(member, weight)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] < scores[order[j]]
+	})
+	return order
+}
@@ -0,0 +1,17 @@
+package route
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// ConnectionIdHeader carries the id the load balancer gave a client connection on its upgrade to the
+// sidecar, so both sides tell the devices of a user apart by the same id.
+const ConnectionIdHeader = "x-ws-operator-connection-id"
+
+// NewConnectionId returns a random connection id.
+func NewConnectionId() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
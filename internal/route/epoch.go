@@ -0,0 +1,45 @@
+package route
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// EpochHeader carries the epoch hash of the sender on proxied messages and upgrades, see RouterImpl.EpochHash.
+// Versions are local to each component, the hash is what tells whether both sides route with the same members.
+const EpochHeader = "x-ws-operator-epoch"
+
+// RequestEpoch reads the epoch hash sent by the caller. It returns 0 when there is none.
+func RequestEpoch(r *http.Request) uint64 {
+	version, err := strconv.ParseUint(r.Header.Get(EpochHeader), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+func FormatEpoch(epoch uint64) string {
+	return strconv.FormatUint(epoch, 10)
+}
+
+// OwnerRedirect decides whether a request for a recipient that isn't connected here should be redirected.
+// It only redirects when the caller routed with a different membership epoch and, by our own membership,
+// the host the caller reached (r.Host) isn't one of the recipient's owners, the first candidates ranked
+// targets. It returns the owner to redirect to.
+func OwnerRedirect(router RouterImpl, r *http.Request, recipientId string, candidates int) (Target, bool) {
+	remoteEpoch := RequestEpoch(r)
+	localEpoch := router.EpochHash()
+	if remoteEpoch == 0 || localEpoch == 0 || remoteEpoch == localEpoch {
+		return Target{}, false
+	}
+	owners := router.RouteN(recipientId, max(candidates, 1))
+	if len(owners) == 0 || owners[0].IsZero() {
+		return Target{}, false
+	}
+	for _, owner := range owners {
+		if owner.Address() == r.Host {
+			return Target{}, false
+		}
+	}
+	return owners[0], true
+}
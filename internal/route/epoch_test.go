@@ -0,0 +1,106 @@
+package route
+
+import (
+	"lukas8219/websocket-operator/internal/static"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newStaticRouter(t *testing.T, hosts ...string) RouterImpl {
+	t.Helper()
+	router, err := NewRouter(RouterConfig{Mode: RouterConfigModeStatic, ConfigMeta: RouterMeta{Static: static.Config{Hosts: hosts}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+func TestEpochFollowsTheMembers(t *testing.T) {
+	a := newStaticRouter(t, "10.0.0.1:3000", "10.0.0.2:3000")
+	b := newStaticRouter(t, "10.0.0.2:3000", "10.0.0.1:3000")
+	c := newStaticRouter(t, "10.0.0.1:3000", "10.0.0.2:3000", "10.0.0.3:3000")
+	if a.EpochHash() == 0 || a.EpochHash() != b.EpochHash() {
+		t.Fatalf("expected routers with the same members to agree on a non zero hash, got %d and %d", a.EpochHash(), b.EpochHash())
+	}
+	if a.EpochHash() == c.EpochHash() {
+		t.Fatal("expected another membership to have another hash")
+	}
+	if target := c.Route("user"); target.Epoch != c.Epoch() || c.Epoch() == 0 {
+		t.Fatalf("expected targets to carry the version they were routed with, got %d", target.Epoch)
+	}
+}
+
+func TestEpochVersionOnlyIncreases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("hosts:\n  - host: 10.0.0.1:3000\n  - host: 10.0.0.2:3000\n")
+	router, err := NewRouter(RouterConfig{Mode: RouterConfigModeFile, ConfigMeta: RouterMeta{Static: static.Config{File: path, Interval: 10 * time.Millisecond}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.(*static.StaticRouter).Stop)
+	initial, initialHash := router.Epoch(), router.EpochHash()
+	// Going back to the first members comes back to their hash, but not to their version.
+	for _, content := range []string{"hosts:\n  - host: 10.0.0.1:3000\n", "hosts:\n  - host: 10.0.0.2:3000\n  - host: 10.0.0.1:3000\n"} {
+		previous := router.Epoch()
+		write(content)
+		deadline := time.Now().Add(5 * time.Second)
+		for router.Epoch() == previous {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the file to be reloaded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if router.Epoch() != initial+2 || router.EpochHash() != initialHash {
+		t.Fatalf("expected version %d with the initial hash, got %d and %d", initial+2, router.Epoch(), router.EpochHash())
+	}
+}
+
+func TestOwnerRedirect(t *testing.T) {
+	caller := newStaticRouter(t, "10.0.0.1:3000", "10.0.0.2:3000")
+	sidecar := newStaticRouter(t, "10.0.0.1:3000", "10.0.0.2:3000", "10.0.0.3:3000")
+	owner := sidecar.Route("user")
+	other := "10.0.0.1:3000"
+	if owner.Address() == other {
+		other = "10.0.0.2:3000"
+	}
+	request := func(host string, epoch uint64) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "http://"+host+"/message", nil)
+		if epoch != 0 {
+			r.Header.Set(EpochHeader, FormatEpoch(epoch))
+		}
+		return r
+	}
+
+	redirect, ok := OwnerRedirect(sidecar, request(other, caller.EpochHash()), "user", 1)
+	if !ok || redirect.Address() != owner.Address() {
+		t.Fatalf("expected a caller with another membership to be redirected to %s, got %v %v", owner.Address(), redirect, ok)
+	}
+	if _, ok := OwnerRedirect(sidecar, request(owner.Address(), caller.EpochHash()), "user", 1); ok {
+		t.Fatal("expected no redirect on the owner")
+	}
+	if _, ok := OwnerRedirect(sidecar, request(other, sidecar.EpochHash()), "user", 1); ok {
+		t.Fatal("expected no redirect when the caller routed with the same membership")
+	}
+	if _, ok := OwnerRedirect(sidecar, request(other, 0), "user", 1); ok {
+		t.Fatal("expected no redirect without the epoch of the caller")
+	}
+	if _, ok := OwnerRedirect(sidecar, request(other, caller.EpochHash()), "user", len(sidecar.Snapshot().Members)); ok {
+		t.Fatal("expected no redirect on any placement candidate")
+	}
+}
@@ -0,0 +1,150 @@
+package route
+
+import (
+	"flag"
+	"fmt"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/dns"
+	"lukas8219/websocket-operator/internal/gossip"
+	"lukas8219/websocket-operator/internal/kubernetes"
+	"lukas8219/websocket-operator/internal/recipients"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"lukas8219/websocket-operator/internal/static"
+	"os"
+	"strings"
+	"time"
+)
+
+// MetaFlags binds the RouterMeta options to flags. The sidecar and the load balancer
+// register the same flags so both build their router the same way.
+type MetaFlags struct {
+	algorithm           *string
+	boundedLoadFactor   *float64
+	boundedLoadMaxSpill *int
+	hasher              *string
+	hasherSeed          *uint64
+	hasherKeyFile       *string
+	scoring             *string
+	skeletonFanout      *int
+	skeletonDepth       *int
+	zone                *string
+	zoneBias            *float64
+	zoneMaxSpill        *int
+	dnsServer           *string
+	dnsRefresh          *time.Duration
+	dnsMinRefresh       *time.Duration
+	dnsNotFoundGrace    *time.Duration
+	namespace           *string
+	service             *string
+	portName            *string
+	hosts               *string
+	hostsFile           *string
+	hostsFileInterval   *time.Duration
+	trackedMax          *int
+	trackedTTL          *time.Duration
+	gossipBind          *string
+	gossipAddress       *string
+	gossipHost          *string
+	gossipSeeds         *string
+	gossipProbe         *time.Duration
+	gossipSuspicion     *time.Duration
+	gossipKeyFile       *string
+}
+
+func BindMetaFlags(fs *flag.FlagSet) *MetaFlags {
+	return &MetaFlags{
+		algorithm:           fs.String("algorithm", balancer.AlgorithmRendezvous, fmt.Sprintf("Consistent-hash algorithm: %v. Weights, bounded load and zones need rendezvous, jump only suits the static mode", balancer.Algorithms)),
+		boundedLoadFactor:   fs.Float64("boundedLoadFactor", 0, "Bounded-load factor c (>= 1 enables bounded-load placement)"),
+		boundedLoadMaxSpill: fs.Int("boundedLoadMaxSpill", rendezvous.DefaultMaxSpill, "How many lower-ranked sidecars a user can spill over to"),
+		hasher:              fs.String("hasher", rendezvous.HasherXXH3, "Routing hash function: xxh3, siphash or fnv"),
+		hasherSeed:          fs.Uint64("hasherSeed", 0, "Seed for the xxh3 hasher"),
+		hasherKeyFile:       fs.String("hasherKeyFile", "", "File holding the siphash key, falls back to "+rendezvous.HasherKeyEnv),
+		scoring:             fs.String("scoring", envOr("WS_OPERATOR_SCORING", string(rendezvous.ScoringConcat)), fmt.Sprintf("Rendezvous scoring: %v. Changing it moves users, every component must switch together", rendezvous.Scorings)),
+		skeletonFanout:      fs.Int("skeletonFanout", 0, fmt.Sprintf("Children per level of the hierarchical rendezvous lookup, like %d (> 1 with skeletonDepth > 0 enables it)", rendezvous.DefaultSkeletonConfig.Fanout)),
+		skeletonDepth:       fs.Int("skeletonDepth", 0, fmt.Sprintf("Levels of the hierarchical rendezvous lookup, like %d", rendezvous.DefaultSkeletonConfig.Depth)),
+		zone:                fs.String("zone", os.Getenv("WS_OPERATOR_ZONE"), "Zone of this instance, resolved from the NODE_NAME node labels when empty"),
+		zoneBias:            fs.Float64("zoneBias", 0, "Extra weight the load balancer gives to zone-local sidecars (> 0 enables zone-aware placement)"),
+		zoneMaxSpill:        fs.Int("zoneMaxSpill", rendezvous.DefaultMaxSpill, "How many lower-ranked sidecars a user can be moved to for zone locality"),
+		dnsServer:           fs.String("dnsServer", "", "Nameserver for the dns mode, defaults to WS_OPERATOR_DNS_SERVER or the nameservers of resolv.conf"),
+		dnsRefresh:          fs.Duration("dnsRefreshInterval", dns.DefaultRefreshInterval, "Longest time between SRV record refreshes in dns mode, shorter TTLs refresh sooner"),
+		dnsMinRefresh:       fs.Duration("dnsMinRefreshInterval", dns.DefaultMinRefreshInterval, "Shortest time between SRV record refreshes in dns mode"),
+		dnsNotFoundGrace:    fs.Duration("dnsNotFoundGrace", dns.DefaultNotFoundGrace, "How long the SRV record may be missing in dns mode before its hosts are dropped"),
+		namespace:           fs.String("namespace", envOr("WS_OPERATOR_NAMESPACE", kubernetes.DefaultNamespace), "Namespace of the sidecars service in kubernetes mode"),
+		service:             fs.String("service", envOr("WS_OPERATOR_SERVICE", kubernetes.DefaultService), "Name of the sidecars service in kubernetes mode"),
+		portName:            fs.String("portName", envOr("WS_OPERATOR_PORT_NAME", kubernetes.DefaultPortName), "Name of the service port the sidecars listen on in kubernetes mode"),
+		hosts:               fs.String("hosts", os.Getenv("WS_OPERATOR_HOSTS"), "Comma-separated host:port[=weight] list of the sidecars in static mode"),
+		hostsFile:           fs.String("hostsFile", os.Getenv("WS_OPERATOR_HOSTS_FILE"), "YAML or JSON file listing the sidecars in file mode"),
+		hostsFileInterval:   fs.Duration("hostsFileInterval", static.DefaultInterval, "How often the hosts file is checked for changes in file mode"),
+		trackedMax:          fs.Int("trackedRecipientsMax", recipients.DefaultMaxSize, "How many connected recipients are tracked for rebalancing before the least recently connected is evicted"),
+		trackedTTL:          fs.Duration("trackedRecipientsTTL", 0, "Evict tracked recipients not connected again for this long, 0 keeps them until they disconnect"),
+		gossipBind:          fs.String("gossipBind", envOr("WS_OPERATOR_GOSSIP_BIND", fmt.Sprintf("0.0.0.0:%d", gossip.DefaultPort)), "UDP address the gossip mode listens on"),
+		gossipAddress:       fs.String("gossipAddress", os.Getenv("WS_OPERATOR_GOSSIP_ADDRESS"), "Gossip address advertised to the other members, derived from gossipBind or gossipHost when empty"),
+		gossipHost:          fs.String("gossipHost", os.Getenv("WS_OPERATOR_GOSSIP_HOST"), "host:port users are routed to on this member in gossip mode, empty to only observe the membership"),
+		gossipSeeds:         fs.String("gossipSeeds", os.Getenv("WS_OPERATOR_GOSSIP_SEEDS"), "Comma-separated host:port gossip seeds, hostnames are resolved through DNS"),
+		gossipProbe:         fs.Duration("gossipProbeInterval", gossip.DefaultProbeInterval, "How often a gossip member is probed"),
+		gossipSuspicion:     fs.Duration("gossipSuspicionTimeout", gossip.DefaultSuspicionTimeout, "How long a gossip member failing probes is suspected before it is removed"),
+		gossipKeyFile:       fs.String("gossipKeyFile", "", "File holding the key gossip messages are signed with, falls back to "+gossip.KeyEnv),
+	}
+}
+
+// Meta builds the RouterMeta from the parsed flags.
+func (f *MetaFlags) Meta() (RouterMeta, error) {
+	if _, err := balancer.New(*f.algorithm, rendezvous.Config{}); err != nil {
+		return RouterMeta{}, err
+	}
+	hasher, err := rendezvous.NewHasher(rendezvous.HasherConfig{
+		Name:    *f.hasher,
+		Seed:    *f.hasherSeed,
+		KeyFile: *f.hasherKeyFile,
+	})
+	if err != nil {
+		return RouterMeta{}, err
+	}
+	scoring, err := rendezvous.ParseScoring(*f.scoring)
+	if err != nil {
+		return RouterMeta{}, err
+	}
+	gossipKey, err := gossip.LoadKey(*f.gossipKeyFile)
+	if err != nil {
+		return RouterMeta{}, err
+	}
+	return RouterMeta{
+		Algorithm:   *f.algorithm,
+		BoundedLoad: rendezvous.BoundedLoadConfig{LoadFactor: *f.boundedLoadFactor, MaxSpill: *f.boundedLoadMaxSpill},
+		Hasher:      hasher,
+		Scoring:     scoring,
+		Skeleton:    rendezvous.SkeletonConfig{Fanout: *f.skeletonFanout, Depth: *f.skeletonDepth},
+		Zone:        rendezvous.ZoneConfig{LocalZone: *f.zone, Bias: *f.zoneBias, MaxSpill: *f.zoneMaxSpill},
+		Dns:         dns.Config{Server: *f.dnsServer, Interval: *f.dnsRefresh, MinInterval: *f.dnsMinRefresh, NotFoundGrace: *f.dnsNotFoundGrace},
+		Kubernetes:  kubernetes.Config{Namespace: *f.namespace, Service: *f.service, PortName: *f.portName},
+		Static:      static.Config{Hosts: splitList(*f.hosts), File: *f.hostsFile, Interval: *f.hostsFileInterval},
+		Recipients:  recipients.Config{MaxSize: *f.trackedMax, TTL: *f.trackedTTL},
+		Gossip: gossip.Config{
+			Bind:             *f.gossipBind,
+			Address:          *f.gossipAddress,
+			Host:             *f.gossipHost,
+			Seeds:            splitList(*f.gossipSeeds),
+			ProbeInterval:    *f.gossipProbe,
+			SuspicionTimeout: *f.gossipSuspicion,
+			Key:              gossipKey,
+		},
+	}, nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(list string) []string {
+	entries := make([]string, 0)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,54 @@
+package route
+
+import (
+	"flag"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"testing"
+)
+
+func parseMeta(t *testing.T, args ...string) RouterMeta {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := BindMetaFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := flags.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func TestMetaFlags(t *testing.T) {
+	meta := parseMeta(t, "-hosts", "")
+	if len(meta.Static.Hosts) != 0 {
+		t.Fatalf("expected no static hosts from an empty flag, got %q", meta.Static.Hosts)
+	}
+	if info := NewHasherInfo(meta); info != (HasherInfo{Algorithm: info.Algorithm, Fingerprint: info.Fingerprint}) {
+		t.Fatalf("expected the defaults and disabled placements to be omitted, got %+v", info)
+	}
+
+	meta = parseMeta(t, "-hosts", "10.0.0.1:3000, 10.0.0.2:3000", "-scoring", "mixed", "-skeletonFanout", "16", "-skeletonDepth", "2")
+	if len(meta.Static.Hosts) != 2 || meta.Static.Hosts[1] != "10.0.0.2:3000" {
+		t.Fatalf("expected both static hosts, got %q", meta.Static.Hosts)
+	}
+	if meta.Scoring != rendezvous.ScoringMixed || meta.Skeleton != rendezvous.DefaultSkeletonConfig {
+		t.Fatalf("expected the mixed scoring and the skeleton, got %s %+v", meta.Scoring, meta.Skeleton)
+	}
+	info := NewHasherInfo(meta)
+	if info.Scoring != "mixed" || info.Skeleton != "fanout=16,depth=2" {
+		t.Fatalf("expected the scoring and skeleton in the hasher info, got %+v", info)
+	}
+}
+
+func TestHasherInfoPlacementSettings(t *testing.T) {
+	meta := parseMeta(t, "-boundedLoadFactor", "1.25", "-zoneBias", "0.5", "-zoneMaxSpill", "3", "-zone", "a")
+	info := NewHasherInfo(meta)
+	if info.LoadFactor != 1.25 || info.MaxSpill != rendezvous.DefaultMaxSpill || info.ZoneBias != 0.5 || info.ZoneMaxSpill != 3 {
+		t.Fatalf("expected the bounded-load and zone settings in the hasher info, got %+v", info)
+	}
+	if other := NewHasherInfo(parseMeta(t, "-boundedLoadFactor", "1.25", "-zoneBias", "0.5", "-zoneMaxSpill", "3", "-zone", "b")); other != info {
+		t.Fatalf("expected the local zone to be left out, got %+v and %+v", info, other)
+	}
+}
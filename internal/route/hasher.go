@@ -0,0 +1,169 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/metrics"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HasherPath is served by the sidecar with its HasherInfo, so other components can compare hashers.
+const HasherPath = "/hasher"
+
+// HasherInfo describes how a component ranks sidecars for a user. Components only agree on owners
+// when every field matches. The scoring and skeleton are omitted when they are the defaults, and the
+// bounded-load and zone settings when they are disabled, which components predating them used.
+type HasherInfo struct {
+	Algorithm   string `json:"algorithm"`
+	Fingerprint string `json:"fingerprint"`
+	Scoring     string `json:"scoring,omitempty"`
+	Skeleton    string `json:"skeleton,omitempty"`
+	// LoadFactor and MaxSpill are the bounded-load settings.
+	LoadFactor float64 `json:"loadFactor,omitempty"`
+	MaxSpill   int     `json:"maxSpill,omitempty"`
+	// ZoneBias and ZoneMaxSpill are the zone-aware settings. The local zone differs between components.
+	ZoneBias     float64 `json:"zoneBias,omitempty"`
+	ZoneMaxSpill int     `json:"zoneMaxSpill,omitempty"`
+}
+
+// UpstreamHostLister is implemented by routers that can list every upstream host they route to.
+type UpstreamHostLister interface {
+	GetAllUpstreamHosts() []string
+}
+
+func NewHasherInfo(meta RouterMeta) HasherInfo {
+	hasher := meta.Hasher
+	if hasher == nil {
+		hasher = &rendezvous.DefaultHasher{}
+	}
+	algorithm := meta.Algorithm
+	if algorithm == "" {
+		algorithm = balancer.AlgorithmRendezvous
+	}
+	info := HasherInfo{Algorithm: algorithm, Fingerprint: rendezvous.Fingerprint(hasher)}
+	if algorithm == balancer.AlgorithmRendezvous {
+		if meta.Scoring != "" && meta.Scoring != rendezvous.ScoringConcat {
+			info.Scoring = string(meta.Scoring)
+		}
+		info.Skeleton = meta.Skeleton.String()
+		// The spill is compared as the candidates it allows, an unset one meaning the default.
+		if meta.BoundedLoad.Enabled() {
+			info.LoadFactor = meta.BoundedLoad.LoadFactor
+			info.MaxSpill = meta.BoundedLoad.Candidates() - 1
+		}
+		if meta.Zone.Enabled() {
+			info.ZoneBias = meta.Zone.Bias
+			info.ZoneMaxSpill = meta.Zone.Candidates() - 1
+		}
+	}
+	return info
+}
+
+// DefaultHasherCheckInterval is how often WatchHasherAgreement compares hashers with the sidecars.
+const DefaultHasherCheckInterval = time.Minute
+
+var (
+	// mismatchedHosts holds the number of mismatched sidecars found by the last check of each router.
+	mismatchedHosts sync.Map
+	_               = metrics.NewGaugeFunc("ws_operator_hasher_mismatched_hosts", "Sidecars ranking users with other hasher settings at the last check", func() float64 {
+		total := 0
+		mismatchedHosts.Range(func(_, count any) bool {
+			total += count.(int)
+			return true
+		})
+		return float64(total)
+	})
+)
+
+// CheckHasherAgreement asks every upstream sidecar for its hasher info, concurrently, and returns an error
+// listing the ones that differ. Sidecars that can't be reached are skipped, they are checked again when
+// they start themselves. The number of mismatched sidecars is exported as a metric.
+func CheckHasherAgreement(router RouterImpl, meta RouterMeta) error {
+	lister, ok := router.(UpstreamHostLister)
+	if !ok {
+		return nil
+	}
+	expected := NewHasherInfo(meta)
+	client := &http.Client{Timeout: 2 * time.Second}
+	hosts := lister.GetAllUpstreamHosts()
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = checkHasher(router, client, host, expected)
+		}()
+	}
+	wg.Wait()
+	mismatched := 0
+	for _, err := range errs {
+		if err != nil {
+			mismatched++
+		}
+	}
+	mismatchedHosts.Store(router, mismatched)
+	if mismatched > 0 {
+		return errors.Join(errs...)
+	}
+	slog.With("component", "router").Debug("Hasher agrees with upstream hosts", "algorithm", expected.Algorithm, "fingerprint", expected.Fingerprint)
+	return nil
+}
+
+func checkHasher(router RouterImpl, client *http.Client, host string, expected HasherInfo) error {
+	req, err := http.NewRequest(http.MethodGet, TargetFromAddress(host).HTTPURL(HasherPath), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		router.Debug("Skipping hasher check for unreachable host", "host", host, "error", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	var info HasherInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil || resp.StatusCode != http.StatusOK {
+		router.Debug("Skipping hasher check for host without hasher info", "host", host, "status", resp.StatusCode)
+		return nil
+	}
+	if info.Algorithm != "" && info.Algorithm != expected.Algorithm {
+		return fmt.Errorf("balancer mismatch with %s: expected algorithm %s, got %s", host, expected.Algorithm, info.Algorithm)
+	}
+	if info.Fingerprint != expected.Fingerprint {
+		return fmt.Errorf("hasher mismatch with %s: expected fingerprint %s, got %s", host, expected.Fingerprint, info.Fingerprint)
+	}
+	if info.Scoring != expected.Scoring || info.Skeleton != expected.Skeleton {
+		return fmt.Errorf("rendezvous mismatch with %s: expected scoring %q and skeleton %q, got %q and %q", host, expected.Scoring, expected.Skeleton, info.Scoring, info.Skeleton)
+	}
+	if info.LoadFactor != expected.LoadFactor || info.MaxSpill != expected.MaxSpill {
+		return fmt.Errorf("bounded load mismatch with %s: expected load factor %v and max spill %d, got %v and %d", host, expected.LoadFactor, expected.MaxSpill, info.LoadFactor, info.MaxSpill)
+	}
+	if info.ZoneBias != expected.ZoneBias || info.ZoneMaxSpill != expected.ZoneMaxSpill {
+		return fmt.Errorf("zone mismatch with %s: expected bias %v and max spill %d, got %v and %d", host, expected.ZoneBias, expected.ZoneMaxSpill, info.ZoneBias, info.ZoneMaxSpill)
+	}
+	return nil
+}
+
+// WatchHasherAgreement runs CheckHasherAgreement now and then every interval. A mismatch is expected
+// while hasher settings are rolled out, so it is logged instead of stopping the component, once when
+// it starts and once when it is resolved.
+func WatchHasherAgreement(router RouterImpl, meta RouterMeta, interval time.Duration) {
+	mismatched := false
+	for {
+		err := CheckHasherAgreement(router, meta)
+		if err != nil && !mismatched {
+			router.Error("Hasher does not match every sidecar, users may be routed to sidecars that don't own them until the rollout completes", "error", err)
+		}
+		if err == nil && mismatched {
+			router.Info("Hasher matches every sidecar again")
+		}
+		mismatched = err != nil
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,78 @@
+package route
+
+import (
+	"encoding/json"
+	"lukas8219/websocket-operator/internal/static"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHasherSidecar serves info on HasherPath after delay.
+func newHasherSidecar(t *testing.T, info HasherInfo, delay time.Duration) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		json.NewEncoder(w).Encode(info)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestCheckHasherAgreement(t *testing.T) {
+	meta := RouterMeta{}
+	expected := NewHasherInfo(meta)
+	other := expected
+	other.Fingerprint = "0000000000000000"
+	hosts := []string{
+		newHasherSidecar(t, expected, time.Second),
+		newHasherSidecar(t, expected, time.Second),
+		newHasherSidecar(t, other, time.Second),
+	}
+	router, err := NewRouter(RouterConfig{Mode: RouterConfigModeStatic, ConfigMeta: RouterMeta{Static: static.Config{Hosts: hosts}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now()
+	err = CheckHasherAgreement(router, meta)
+	if err == nil || !strings.Contains(err.Error(), hosts[2]) || strings.Contains(err.Error(), hosts[0]) {
+		t.Fatalf("expected a mismatch with %s alone, got %v", hosts[2], err)
+	}
+	if elapsed := time.Since(started); elapsed > 1900*time.Millisecond {
+		t.Fatalf("expected the sidecars to be checked concurrently, took %v", elapsed)
+	}
+	if count, _ := mismatchedHosts.Load(router); count != 1 {
+		t.Fatalf("expected a single mismatched host to be exported, got %v", count)
+	}
+}
+
+func TestCheckHasherComparesPlacementSettings(t *testing.T) {
+	meta := RouterMeta{}
+	meta.BoundedLoad.LoadFactor = 1.25
+	expected := NewHasherInfo(meta)
+	router, err := NewRouter(RouterConfig{Mode: RouterConfigModeStatic, ConfigMeta: RouterMeta{Static: static.Config{Hosts: []string{"10.0.0.1:3000"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Timeout: time.Second}
+	for _, change := range []func(*HasherInfo){
+		func(info *HasherInfo) { info.LoadFactor = 1.5 },
+		func(info *HasherInfo) { info.MaxSpill++ },
+		func(info *HasherInfo) { info.ZoneBias = 0.5 },
+		func(info *HasherInfo) { info.ZoneMaxSpill = 1 },
+	} {
+		other := expected
+		change(&other)
+		if err := checkHasher(router, client, newHasherSidecar(t, other, 0), expected); err == nil {
+			t.Fatalf("expected a mismatch with %+v", other)
+		}
+	}
+	if err := checkHasher(router, client, newHasherSidecar(t, expected, 0), expected); err != nil {
+		t.Fatal(err)
+	}
+}
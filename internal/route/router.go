@@ -1,11 +1,20 @@
 package route
 
 import (
+	"fmt"
 	"log/slog"
+	"lukas8219/websocket-operator/internal/balancer"
 	"lukas8219/websocket-operator/internal/dns"
+	"lukas8219/websocket-operator/internal/gossip"
 	"lukas8219/websocket-operator/internal/kubernetes"
+	"lukas8219/websocket-operator/internal/recipients"
+	"lukas8219/websocket-operator/internal/static"
 
 	"lukas8219/websocket-operator/internal/rendezvous"
+	"lukas8219/websocket-operator/internal/snapshot"
+	"slices"
+	"strings"
+	"sync"
 )
 
 type Logger interface {
@@ -16,11 +25,22 @@ type Logger interface {
 
 type RouterImpl interface {
 	InitializeHosts() error
-	Route(recipientId string) string
-	RebalanceRequests() <-chan [][2]string
+	Route(recipientId string) Target
+	RouteN(recipientId string, n int) []Target
+	RebalanceRequests() <-chan []RebalanceRequest
+	// Epoch is the version of the membership the router currently routes with. It only increases.
+	Epoch() uint64
+	// EpochHash identifies the members the router currently routes with, equal on every component
+	// routing with the same members.
+	EpochHash() uint64
+	// Snapshot returns the membership the router currently routes with, for diagnostics.
+	Snapshot() Snapshot
 	Logger
 }
 
+// Snapshot is the membership a router currently routes with, see SnapshotHandler.
+type Snapshot = snapshot.Snapshot
+
 type RouterConfigMode string
 
 type RouterConfig struct {
@@ -28,20 +48,165 @@ type RouterConfig struct {
 	ConfigMeta interface{}
 }
 
+// RouterMeta is the typed configuration read from RouterConfig.ConfigMeta.
+type RouterMeta struct {
+	// Algorithm is the balancer.Algorithms entry keys are routed with. Empty means rendezvous.
+	Algorithm string
+	// BoundedLoad enables bounded-load placement. The sidecar and the load balancer must use the same values.
+	BoundedLoad rendezvous.BoundedLoadConfig
+	// Hasher is the routing hash function. Nil means unseeded xxh3.
+	Hasher rendezvous.Hasher
+	// Scoring is how rendezvous scores members, ScoringConcat when empty.
+	Scoring rendezvous.Scoring
+	// Skeleton enables the hierarchical rendezvous lookup, for thousands of sidecars.
+	Skeleton rendezvous.SkeletonConfig
+	// Zone enables zone-aware placement. Bias and MaxSpill must match between components, LocalZone
+	// doesn't, and only the load balancer prefers it, see rendezvous.ZoneConfig.
+	Zone rendezvous.ZoneConfig
+	// Dns configures how the dns mode resolves and refreshes the SRV record.
+	Dns dns.Config
+	// Kubernetes selects the service the kubernetes mode discovers the sidecars from.
+	Kubernetes kubernetes.Config
+	// Static holds the hosts of the static mode and the hosts file of the file mode.
+	Static static.Config
+	// Recipients bounds how many connected recipients the router tracks for rebalancing.
+	Recipients recipients.Config
+	// Gossip configures how the gossip mode joins the other members.
+	Gossip gossip.Config
+}
+
+// Candidates is how many ranked targets a user may be placed on with the bounded load and zone
+// preference of m. Components without the load information of the load balancer look for the owner of a
+// user among all of them.
+func (m RouterMeta) Candidates() int {
+	return rendezvous.Config{BoundedLoad: m.BoundedLoad, Zone: m.Zone}.Candidates()
+}
+
+// FailoverTargets is how many ranked targets a user may be connected to: the owner and the next one the
+// load balancer falls back to when the owner can't be dialed. Messages look for the user on all of them.
+const FailoverTargets = 2
+
+// LoadReporter is implemented by routers that take live load into account when placing users.
+type LoadReporter interface {
+	ReportLoads(loads map[string]int)
+}
+
+// RecipientTracker is implemented by routers that rebalance connected recipients. The load balancer
+// tracks a recipient when its connection is proxied to a target and forgets it when the connection ends.
+// A rebalanced recipient is moved to its new target once its connections were migrated.
+type RecipientTracker interface {
+	Track(recipientId string, t Target)
+	Forget(recipientId string)
+	Move(recipientId string, t Target)
+}
+
+// MetaFromConfig returns the RouterMeta held by config, or the zero value when there is none.
+func MetaFromConfig(config RouterConfig) RouterMeta {
+	switch meta := config.ConfigMeta.(type) {
+	case RouterMeta:
+		return meta
+	case *RouterMeta:
+		if meta != nil {
+			return *meta
+		}
+	}
+	return RouterMeta{}
+}
+
 const (
 	RouterConfigModeDns        RouterConfigMode = "dns"
 	RouterConfigModeKubernetes RouterConfigMode = "kubernetes"
+	RouterConfigModeStatic     RouterConfigMode = "static"
+	RouterConfigModeFile       RouterConfigMode = "file"
+	RouterConfigModeGossip     RouterConfigMode = "gossip"
 )
 
-func NewRouter(config RouterConfig) RouterImpl {
+// dynamicModes are the built-in modes whose hosts come and go, which need a balancer.Dynamic algorithm.
+var dynamicModes = []RouterConfigMode{RouterConfigModeDns, RouterConfigModeKubernetes, RouterConfigModeFile, RouterConfigModeGossip}
+
+// Factory creates the router of a mode. loadbalancer is built from the RouterMeta of config and starts empty.
+// config is passed as is so modes registered outside this package can carry their own ConfigMeta.
+type Factory func(loadbalancer balancer.Balancer, config RouterConfig) (RouterImpl, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[RouterConfigMode]Factory)
+)
+
+func init() {
+	Register(RouterConfigModeDns, func(loadbalancer balancer.Balancer, config RouterConfig) (RouterImpl, error) {
+		meta := MetaFromConfig(config)
+		return dns.WithDns(loadbalancer, recipients.NewStore(meta.Recipients), meta.Dns), nil
+	})
+	Register(RouterConfigModeKubernetes, func(loadbalancer balancer.Balancer, config RouterConfig) (RouterImpl, error) {
+		meta := MetaFromConfig(config)
+		return kubernetes.NewRouter(loadbalancer, recipients.NewStore(meta.Recipients), meta.Kubernetes), nil
+	})
+	Register(RouterConfigModeStatic, func(loadbalancer balancer.Balancer, config RouterConfig) (RouterImpl, error) {
+		meta := MetaFromConfig(config)
+		return static.NewStatic(loadbalancer, recipients.NewStore(meta.Recipients), meta.Static), nil
+	})
+	Register(RouterConfigModeFile, func(loadbalancer balancer.Balancer, config RouterConfig) (RouterImpl, error) {
+		meta := MetaFromConfig(config)
+		return static.NewFile(loadbalancer, recipients.NewStore(meta.Recipients), meta.Static), nil
+	})
+	Register(RouterConfigModeGossip, func(loadbalancer balancer.Balancer, config RouterConfig) (RouterImpl, error) {
+		meta := MetaFromConfig(config)
+		return gossip.NewRouter(loadbalancer, recipients.NewStore(meta.Recipients), meta.Gossip), nil
+	})
+}
+
+// Register makes a router mode available to NewRouter. It is meant to be called from init
+// and panics when the mode is empty, already registered or factory is nil.
+func Register(mode RouterConfigMode, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if mode == "" {
+		panic("route: Register with an empty mode")
+	}
+	if factory == nil {
+		panic("route: Register factory is nil for mode " + string(mode))
+	}
+	if _, ok := factories[mode]; ok {
+		panic("route: Register called twice for mode " + string(mode))
+	}
+	factories[mode] = factory
+}
+
+// Modes returns the registered router modes, sorted.
+func Modes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	modes := make([]string, 0, len(factories))
+	for mode := range factories {
+		modes = append(modes, string(mode))
+	}
+	slices.Sort(modes)
+	return modes
+}
+
+// NewRouter creates the router of config.Mode. It fails when the mode isn't registered.
+func NewRouter(config RouterConfig) (RouterImpl, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[config.Mode]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("invalid router mode %q, expected one of %s", config.Mode, strings.Join(Modes(), ", "))
+	}
 	slog.With("component", "router").With("mode", config.Mode).Info("New router")
-	rendezvous := rendezvous.NewDefault()
-	switch config.Mode {
-	case RouterConfigModeDns:
-		return dns.WithDns(rendezvous)
-	case RouterConfigModeKubernetes:
-		return kubernetes.NewRouter(rendezvous)
-	default:
-		panic("invalid router mode")
+	meta := MetaFromConfig(config)
+	if slices.Contains(dynamicModes, config.Mode) && !balancer.Dynamic(meta.Algorithm) {
+		return nil, fmt.Errorf("the %s algorithm moves most users when a host other than the last one changes, it only suits the %s mode", meta.Algorithm, RouterConfigModeStatic)
+	}
+	loadbalancer, err := balancer.New(meta.Algorithm, rendezvous.Config{
+		Hasher:      meta.Hasher,
+		Scoring:     meta.Scoring,
+		Skeleton:    meta.Skeleton,
+		BoundedLoad: meta.BoundedLoad,
+		Zone:        meta.Zone,
+	})
+	if err != nil {
+		return nil, err
 	}
+	return factory(loadbalancer, config)
 }
@@ -0,0 +1,59 @@
+package route
+
+import (
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/static"
+	"slices"
+	"testing"
+)
+
+func TestRegisteredModes(t *testing.T) {
+	modes := Modes()
+	for _, mode := range []RouterConfigMode{RouterConfigModeDns, RouterConfigModeKubernetes, RouterConfigModeStatic, RouterConfigModeFile} {
+		if !slices.Contains(modes, string(mode)) {
+			t.Errorf("expected %s to be registered, got %v", mode, modes)
+		}
+	}
+	if _, err := NewRouter(RouterConfig{Mode: "unknown"}); err == nil {
+		t.Fatal("expected an unknown mode to be rejected")
+	}
+	if _, err := NewRouter(RouterConfig{Mode: RouterConfigModeStatic, ConfigMeta: RouterMeta{Algorithm: "unknown"}}); err == nil {
+		t.Fatal("expected an unknown algorithm to be rejected")
+	}
+}
+
+func TestJumpIsLimitedToStaticHosts(t *testing.T) {
+	for _, mode := range dynamicModes {
+		if _, err := NewRouter(RouterConfig{Mode: mode, ConfigMeta: RouterMeta{Algorithm: balancer.AlgorithmJump}}); err == nil {
+			t.Errorf("expected jump to be rejected in %s mode", mode)
+		}
+	}
+	if _, err := NewRouter(RouterConfig{Mode: RouterConfigModeStatic, ConfigMeta: RouterMeta{Algorithm: balancer.AlgorithmJump}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterCustomMode(t *testing.T) {
+	const mode RouterConfigMode = "test-registry"
+	type registryConfig struct{ hosts []string }
+	Register(mode, func(loadbalancer balancer.Balancer, config RouterConfig) (RouterImpl, error) {
+		return static.NewStatic(loadbalancer, nil, static.Config{Hosts: config.ConfigMeta.(registryConfig).hosts}), nil
+	})
+	router, err := NewRouter(RouterConfig{Mode: mode, ConfigMeta: registryConfig{hosts: []string{"10.0.0.1:3000"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	if host := router.Route("user"); host.Address() != "10.0.0.1:3000" {
+		t.Fatalf("expected the registered mode to route, got %v", host)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a mode twice to panic")
+		}
+	}()
+	Register(mode, func(balancer.Balancer, RouterConfig) (RouterImpl, error) { return nil, nil })
+}
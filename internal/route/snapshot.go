@@ -0,0 +1,35 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// SnapshotPath is served by the sidecar and the load balancer with the Snapshot of their router.
+// With ?key=<user id> it also returns the targets the user is ranked on, best first.
+const SnapshotPath = "/debug/router"
+
+type snapshotResponse struct {
+	Snapshot
+	Key    string   `json:"key,omitempty"`
+	Owners []Target `json:"owners,omitempty"`
+}
+
+// SnapshotHandler serves the Snapshot of router as JSON.
+func SnapshotHandler(router RouterImpl) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := snapshotResponse{Snapshot: router.Snapshot()}
+		if key := r.URL.Query().Get("key"); key != "" {
+			response.Key = key
+			response.Owners = router.RouteN(key, len(response.Members))
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			router.Error("Failed to encode router snapshot", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
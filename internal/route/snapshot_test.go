@@ -0,0 +1,39 @@
+package route
+
+import (
+	"encoding/json"
+	"lukas8219/websocket-operator/internal/static"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSnapshotHandler(t *testing.T) {
+	router, err := NewRouter(RouterConfig{
+		Mode:       RouterConfigModeStatic,
+		ConfigMeta: RouterMeta{Static: static.Config{Hosts: []string{"10.0.0.1:3000=2", "10.0.0.2:3000"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	router.(RecipientTracker).Track("user", router.Route("user"))
+
+	recorder := httptest.NewRecorder()
+	SnapshotHandler(router).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, SnapshotPath+"?key=user", nil))
+	var response snapshotResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Mode != "static" || response.Tracked != 1 || response.LastSync.IsZero() {
+		t.Fatalf("unexpected snapshot %+v", response.Snapshot)
+	}
+	if len(response.Members) != 2 || response.Members[0].Host != "10.0.0.1:3000" || response.Members[0].Weight != 2 {
+		t.Fatalf("unexpected members %+v", response.Members)
+	}
+	if len(response.Owners) != 2 || response.Owners[0] != router.Route("user") {
+		t.Fatalf("expected both hosts ranked for the key, got %v", response.Owners)
+	}
+}
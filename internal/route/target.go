@@ -0,0 +1,22 @@
+package route
+
+import (
+	"lukas8219/websocket-operator/internal/target"
+	"net/url"
+)
+
+// Target is an upstream sidecar a recipient is routed to.
+type Target = target.Target
+
+// RebalanceRequest asks to move the connection of a recipient to a new target.
+type RebalanceRequest = target.RebalanceRequest
+
+// TargetFromAddress returns the target of a host:port address.
+func TargetFromAddress(address string) Target {
+	return target.FromAddress(address)
+}
+
+// TargetFromURL returns the target of a URL, like the Location of an owner redirect.
+func TargetFromURL(u *url.URL) Target {
+	return target.FromURL(u)
+}
@@ -0,0 +1,43 @@
+package route
+
+import (
+	"lukas8219/websocket-operator/internal/metrics"
+)
+
+// ZoneResolver is implemented by routers that know the zone of their upstream hosts.
+type ZoneResolver interface {
+	LocalZone() string
+	Zone(host string) string
+}
+
+var (
+	crossZoneConnections = metrics.NewCounter("ws_operator_cross_zone_hops_total", "Connections and messages sent to an upstream in another zone", "kind", "connection")
+	crossZoneMessages    = metrics.NewCounter("ws_operator_cross_zone_hops_total", "Connections and messages sent to an upstream in another zone", "kind", "message")
+)
+
+func isCrossZone(router RouterImpl, t Target) bool {
+	resolver, ok := router.(ZoneResolver)
+	if !ok {
+		return false
+	}
+	localZone := resolver.LocalZone()
+	zone := t.Zone
+	if zone == "" {
+		zone = resolver.Zone(t.Address())
+	}
+	return localZone != "" && zone != "" && localZone != zone
+}
+
+// CountConnectionHop records a connection placed on t when it is in another zone.
+func CountConnectionHop(router RouterImpl, t Target) {
+	if isCrossZone(router, t) {
+		crossZoneConnections.Inc()
+	}
+}
+
+// CountMessageHop records a message sent to t when it is in another zone.
+func CountMessageHop(router RouterImpl, t Target) {
+	if isCrossZone(router, t) {
+		crossZoneMessages.Inc()
+	}
+}
@@ -0,0 +1,59 @@
+package route
+
+import (
+	"testing"
+)
+
+// zonedRouter places its hosts in zones, like the kubernetes router does from the node labels.
+type zonedRouter struct {
+	RouterImpl
+	local string
+	zones map[string]string
+}
+
+func (z zonedRouter) LocalZone() string {
+	return z.local
+}
+
+func (z zonedRouter) Zone(host string) string {
+	return z.zones[host]
+}
+
+func TestCountCrossZoneHops(t *testing.T) {
+	router := zonedRouter{
+		RouterImpl: newStaticRouter(t, "10.0.0.1:3000", "10.0.0.2:3000"),
+		local:      "zone-a",
+		zones:      map[string]string{"10.0.0.1:3000": "zone-a", "10.0.0.2:3000": "zone-b"},
+	}
+	local, remote := TargetFromAddress("10.0.0.1:3000"), TargetFromAddress("10.0.0.2:3000")
+	cases := []struct {
+		name     string
+		router   RouterImpl
+		target   Target
+		crossing bool
+	}{
+		{"same zone", router, local, false},
+		{"other zone", router, remote, true},
+		{"zone of the target", router, Target{Host: "10.0.0.3", Port: 3000, Zone: "zone-c"}, true},
+		{"unknown zone", router, TargetFromAddress("10.0.0.3:3000"), false},
+		{"unknown local zone", zonedRouter{RouterImpl: router.RouterImpl, zones: router.zones}, remote, false},
+		{"without zones", router.RouterImpl, remote, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			connections, messages := crossZoneConnections.Value(), crossZoneMessages.Value()
+			CountConnectionHop(c.router, c.target)
+			CountMessageHop(c.router, c.target)
+			expected := uint64(0)
+			if c.crossing {
+				expected = 1
+			}
+			if got := crossZoneConnections.Value() - connections; got != expected {
+				t.Errorf("expected %d cross-zone connections, got %d", expected, got)
+			}
+			if got := crossZoneMessages.Value() - messages; got != expected {
+				t.Errorf("expected %d cross-zone messages, got %d", expected, got)
+			}
+		})
+	}
+}
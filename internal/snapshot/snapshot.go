@@ -0,0 +1,90 @@
+package snapshot
+
+import (
+	"lukas8219/websocket-operator/internal/balancer"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxErrors is how many of the latest discovery errors a Sync keeps.
+const maxErrors = 10
+
+// Snapshot is the membership a router currently routes with.
+type Snapshot struct {
+	Mode    string   `json:"mode"`
+	Members []Member `json:"members"`
+	Epoch   uint64   `json:"epoch"`
+	// EpochHash is equal on the components routing with the same members.
+	EpochHash uint64 `json:"epochHash"`
+	// LastSync is when the membership was last read successfully from discovery.
+	LastSync time.Time `json:"lastSync"`
+	// Errors are the latest discovery errors, oldest first.
+	Errors []Error `json:"errors"`
+	// Tracked is how many connected recipients are tracked for rebalancing.
+	Tracked int `json:"tracked"`
+}
+
+// Member is a host of the membership.
+type Member struct {
+	Host   string  `json:"host"`
+	Weight float64 `json:"weight"`
+	Zone   string  `json:"zone,omitempty"`
+	// Draining hosts keep their users but take no new ones.
+	Draining bool `json:"draining,omitempty"`
+}
+
+// Error is a discovery error and when it happened.
+type Error struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// Members lists the members of b sorted by host. hostPort formats a member as a host, nil keeps it as is.
+func Members(b balancer.Balancer, hostPort func(string) string) []Member {
+	nodes := balancer.Nodes(b)
+	members := make([]Member, 0, len(nodes))
+	for _, node := range nodes {
+		host := node.Member()
+		if hostPort != nil {
+			host = hostPort(host)
+		}
+		members = append(members, Member{Host: host, Weight: node.Weight(), Zone: balancer.Zone(b, node.Member())})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Host < members[j].Host
+	})
+	return members
+}
+
+// Sync records the outcome of the discovery syncs of a router. It is safe for concurrent use.
+type Sync struct {
+	mu       sync.Mutex
+	lastSync time.Time
+	errors   []Error
+}
+
+// Succeeded records a successful sync.
+func (s *Sync) Succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSync = time.Now()
+}
+
+// Failed records a discovery error, dropping the oldest one past maxErrors.
+func (s *Sync) Failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, Error{Time: time.Now(), Error: err.Error()})
+	if len(s.errors) > maxErrors {
+		s.errors = s.errors[len(s.errors)-maxErrors:]
+	}
+}
+
+// Fill sets the last sync time and errors of snapshot.
+func (s *Sync) Fill(snapshot *Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot.LastSync = s.lastSync
+	snapshot.Errors = append([]Error{}, s.errors...)
+}
@@ -0,0 +1,182 @@
+package static
+
+import (
+	"errors"
+	"fmt"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/membership"
+	"lukas8219/websocket-operator/internal/recipients"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultInterval is how often the hosts file is checked for changes.
+const DefaultInterval = 2 * time.Second
+
+// Config configures the static and file modes.
+type Config struct {
+	// Hosts is the host list of the static mode, each one as host:port or host:port=weight.
+	Hosts []string
+	// File is the YAML or JSON hosts file of the file mode.
+	File string
+	// Interval is how often the file is checked for changes.
+	Interval time.Duration
+}
+
+// hostsFile is the format of the file mode hosts file:
+//
+//	hosts:
+//	  - host: 10.0.0.1:3000
+//	    weight: 2
+//	  - host: 10.0.0.2:3000
+type hostsFile struct {
+	Hosts []struct {
+		Host   string  `json:"host"`
+		Weight float64 `json:"weight,omitempty"`
+	} `json:"hosts"`
+}
+
+// StaticRouter routes to a fixed list of hosts, or to the hosts of a file it reloads when it changes.
+type StaticRouter struct {
+	*membership.Membership
+	config  Config
+	modTime time.Time
+	size    int64
+}
+
+// NewStatic creates a router for the hosts of config.Hosts. Nil tracked tracks recipients in a default store.
+func NewStatic(loadbalancer balancer.Balancer, tracked *recipients.Store, config Config) *StaticRouter {
+	return &StaticRouter{Membership: membership.New("static", loadbalancer, tracked, nil), config: config}
+}
+
+// NewFile creates a router for the hosts of config.File. The recipients of tracked are rebalanced
+// when the file changes, nil tracks them in a default store.
+func NewFile(loadbalancer balancer.Balancer, tracked *recipients.Store, config Config) *StaticRouter {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	return &StaticRouter{Membership: membership.New("file", loadbalancer, tracked, nil), config: config}
+}
+
+// ParseHosts parses host:port entries with an optional =weight suffix. Empty entries are skipped.
+func ParseHosts(entries []string) ([]rendezvous.WeightedMember, error) {
+	members := make([]rendezvous.WeightedMember, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, weight := entry, rendezvous.DefaultWeight
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			parsed, err := strconv.ParseFloat(entry[i+1:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight in %q: %w", entry, err)
+			}
+			host, weight = entry[:i], parsed
+		}
+		member, err := newMember(host, weight)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// ParseHostsFile parses the YAML or JSON content of a hosts file.
+func ParseHostsFile(data []byte) ([]rendezvous.WeightedMember, error) {
+	var file hostsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	members := make([]rendezvous.WeightedMember, 0, len(file.Hosts))
+	for _, entry := range file.Hosts {
+		member, err := newMember(entry.Host, entry.Weight)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func newMember(host string, weight float64) (rendezvous.WeightedMember, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return rendezvous.WeightedMember{}, fmt.Errorf("invalid host %q, expected host:port: %w", host, err)
+	}
+	return rendezvous.NewWeightedMember(host, weight), nil
+}
+
+func (r *StaticRouter) InitializeHosts() error {
+	if r.config.File == "" {
+		members, err := ParseHosts(r.config.Hosts)
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return errors.New("no hosts configured")
+		}
+		r.Apply(membership.Update{Members: members})
+		r.Sync.Succeeded()
+		return nil
+	}
+	// A missing or invalid file is returned, and the watch picks it up once it is fixed.
+	_, err := r.reload()
+	go r.watch()
+	return err
+}
+
+func (r *StaticRouter) watch() {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Stopped():
+			return
+		case <-ticker.C:
+		}
+		if _, err := r.reload(); err != nil {
+			r.Error("Failed to reload hosts file, keeping the current hosts", "file", r.config.File, "error", err)
+		}
+	}
+}
+
+// reload applies the hosts file when it changed since the last reload and records the outcome.
+// It returns whether the file changed.
+func (r *StaticRouter) reload() (bool, error) {
+	changed, err := r.readFile()
+	if err != nil {
+		r.Sync.Failed(err)
+		return false, err
+	}
+	r.Sync.Succeeded()
+	return changed, nil
+}
+
+// readFile applies the hosts file when it changed since the last reload.
+func (r *StaticRouter) readFile() (bool, error) {
+	info, err := os.Stat(r.config.File)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return false, nil
+	}
+	data, err := os.ReadFile(r.config.File)
+	if err != nil {
+		return false, err
+	}
+	members, err := ParseHostsFile(data)
+	if err != nil {
+		return false, fmt.Errorf("parse %s: %w", r.config.File, err)
+	}
+	r.modTime, r.size = info.ModTime(), info.Size()
+	r.Apply(membership.Update{Members: members})
+	return true, nil
+}
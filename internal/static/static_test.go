@@ -0,0 +1,187 @@
+package static
+
+import (
+	"fmt"
+	"lukas8219/websocket-operator/internal/balancer"
+	"lukas8219/websocket-operator/internal/membership"
+	"lukas8219/websocket-operator/internal/rendezvous"
+	"lukas8219/websocket-operator/internal/target"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newBalancer(t *testing.T) balancer.Balancer {
+	t.Helper()
+	b, err := balancer.New(balancer.AlgorithmRendezvous, rendezvous.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseHosts(t *testing.T) {
+	members, err := ParseHosts([]string{"10.0.0.1:3000", " 10.0.0.2:3000=2.5 ", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[0].Weight() != rendezvous.DefaultWeight || members[1].Member() != "10.0.0.2:3000" || members[1].Weight() != 2.5 {
+		t.Fatalf("unexpected members %v", members)
+	}
+	for _, invalid := range []string{"10.0.0.1", "10.0.0.1:3000=heavy"} {
+		if _, err := ParseHosts([]string{invalid}); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestParseHostsFile(t *testing.T) {
+	yamlMembers, err := ParseHostsFile([]byte("hosts:\n  - host: 10.0.0.1:3000\n    weight: 2\n  - host: 10.0.0.2:3000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonMembers, err := ParseHostsFile([]byte(`{"hosts": [{"host": "10.0.0.1:3000", "weight": 2}, {"host": "10.0.0.2:3000"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !balancer.SameMembers(yamlMembers, jsonMembers) || len(yamlMembers) != 2 {
+		t.Fatalf("expected the same members from YAML and JSON, got %v and %v", yamlMembers, jsonMembers)
+	}
+	if _, err := ParseHostsFile([]byte("hosts:\n  - address: 10.0.0.1:3000\n")); err == nil {
+		t.Fatal("expected unknown fields to be rejected")
+	}
+}
+
+func TestStaticRoutesToConfiguredHosts(t *testing.T) {
+	router := NewStatic(newBalancer(t), nil, Config{Hosts: []string{"10.0.0.1:3000", "10.0.0.2:3000"}})
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	hosts := router.GetAllUpstreamHosts()
+	slices.Sort(hosts)
+	if !slices.Equal(hosts, []string{"10.0.0.1:3000", "10.0.0.2:3000"}) {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+	if host := router.Route("user").Address(); host != "10.0.0.1:3000" && host != "10.0.0.2:3000" {
+		t.Fatalf("unexpected route %s", host)
+	}
+	if err := NewStatic(newBalancer(t), nil, Config{}).InitializeHosts(); err == nil {
+		t.Fatal("expected an error without hosts")
+	}
+}
+
+func TestLookupsDuringMembershipUpdates(t *testing.T) {
+	router := NewStatic(newBalancer(t), nil, Config{Hosts: []string{"10.0.0.1:3000", "10.0.0.2:3000"}})
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range router.RebalanceRequests() {
+		}
+	}()
+	sets := [][]rendezvous.WeightedMember{
+		{rendezvous.NewWeightedMember("10.0.0.1:3000", 1), rendezvous.NewWeightedMember("10.0.0.2:3000", 1)},
+		{rendezvous.NewWeightedMember("10.0.0.3:3000", 1), rendezvous.NewWeightedMember("10.0.0.4:3000", 1)},
+	}
+	firstSet := func(t target.Target) bool {
+		return t.Address() == "10.0.0.1:3000" || t.Address() == "10.0.0.2:3000"
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			router.Apply(membership.Update{Members: sets[i%2]})
+		}
+	}()
+	// Lookups share the lock, and never see the members of both sets at once.
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		targets := router.RouteN("user", 2)
+		if len(targets) != 2 || firstSet(targets[0]) != firstSet(targets[1]) {
+			t.Fatalf("expected the members of a single set, got %v", targets)
+		}
+	}
+}
+
+func TestFileReloadRebalances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("hosts:\n  - host: 10.0.0.1:3000\n  - host: 10.0.0.2:3000\n")
+	router := NewFile(newBalancer(t), nil, Config{File: path, Interval: 10 * time.Millisecond})
+	if err := router.InitializeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.Stop)
+	owners := make(map[string]target.Target)
+	for i := 0; i < 200; i++ {
+		recipient := fmt.Sprintf("user-%d", i)
+		owners[recipient] = router.Route(recipient)
+		router.Track(recipient, owners[recipient])
+	}
+
+	write("hosts:\n  - host: 10.0.0.1:3000\n  - host: 10.0.0.2:3000\n  - host: 10.0.0.3:3000\n    weight: 2\n")
+	var moves []target.RebalanceRequest
+	select {
+	case moves = <-router.RebalanceRequests():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the file to be reloaded")
+	}
+	if len(moves) == 0 {
+		t.Fatal("expected recipients to move to the added host")
+	}
+	for _, move := range moves {
+		if move.New.Address() != "10.0.0.3:3000" {
+			t.Fatalf("%s moved to %v, only the added host can win recipients", move.RecipientId, move.New)
+		}
+		if move.Old != owners[move.RecipientId] {
+			t.Fatalf("%s moved from %v, expected %v", move.RecipientId, move.Old, owners[move.RecipientId])
+		}
+		owners[move.RecipientId] = move.New
+	}
+	for recipient, owner := range owners {
+		if got := router.Route(recipient); got.Address() != owner.Address() {
+			t.Fatalf("%s routes to %v, expected %v", recipient, got, owner)
+		}
+	}
+
+	write("hosts: [")
+	time.Sleep(50 * time.Millisecond)
+	if hosts := router.GetAllUpstreamHosts(); len(hosts) != 3 {
+		t.Fatalf("expected an invalid file to keep the hosts, got %v", hosts)
+	}
+}
+
+func TestFileWatchRecoversFromAMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.yaml")
+	router := NewFile(newBalancer(t), nil, Config{File: path, Interval: 10 * time.Millisecond})
+	if err := router.InitializeHosts(); err == nil {
+		t.Fatal("expected an error without the file")
+	}
+	t.Cleanup(router.Stop)
+	if current := router.Snapshot(); len(current.Errors) == 0 || !current.LastSync.IsZero() {
+		t.Fatalf("expected the failure to be recorded, got %+v", current)
+	}
+	if err := os.WriteFile(path, []byte("hosts:\n  - host: 10.0.0.1:3000\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(router.GetAllUpstreamHosts()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the file to be read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if current := router.Snapshot(); current.LastSync.IsZero() {
+		t.Fatalf("expected the recovery to be recorded, got %+v", current)
+	}
+}
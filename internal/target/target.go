@@ -0,0 +1,119 @@
+package target
+
+import (
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// DefaultScheme is the scheme of targets that don't set one.
+const DefaultScheme = "ws"
+
+// Target is an upstream sidecar a recipient is routed to.
+type Target struct {
+	Host string `json:"host"`
+	// Port is 0 when the host is dialed on the default port of its scheme.
+	Port int `json:"port,omitempty"`
+	// Scheme is ws or wss, DefaultScheme when empty.
+	Scheme string `json:"scheme,omitempty"`
+	// Pod is the name of the sidecar pod, when the router knows it.
+	Pod  string `json:"pod,omitempty"`
+	Zone string `json:"zone,omitempty"`
+	// Epoch is the membership epoch the target was routed with.
+	Epoch uint64 `json:"epoch,omitempty"`
+}
+
+// FromAddress returns the target of a host:port address. An address without port is a host.
+func FromAddress(address string) Target {
+	host, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return Target{Host: address}
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return Target{Host: address}
+	}
+	return Target{Host: host, Port: port}
+}
+
+// FromURL returns the target of a ws, wss, http or https URL, like the Location of a redirect.
+func FromURL(u *url.URL) Target {
+	t := FromAddress(u.Host)
+	switch u.Scheme {
+	case "https", "wss":
+		t.Scheme = "wss"
+	default:
+		t.Scheme = DefaultScheme
+	}
+	return t
+}
+
+// IsZero reports whether t is no target.
+func (t Target) IsZero() bool {
+	return t.Host == ""
+}
+
+// Address is host:port, or the host alone when the port is 0.
+func (t Target) Address() string {
+	if t.Port == 0 {
+		return t.Host
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+func (t Target) scheme() string {
+	if t.Scheme == "" {
+		return DefaultScheme
+	}
+	return t.Scheme
+}
+
+// WebSocketURL is the URL the target is dialed at.
+func (t Target) WebSocketURL(path string) string {
+	return t.scheme() + "://" + t.Address() + path
+}
+
+// HTTPURL is the URL of path on the target, over TLS when the target uses wss.
+func (t Target) HTTPURL(path string) string {
+	scheme := "http"
+	if t.scheme() == "wss" {
+		scheme = "https"
+	}
+	return scheme + "://" + t.Address() + path
+}
+
+func (t Target) String() string {
+	return t.WebSocketURL("")
+}
+
+// LogValue logs the address with the pod, zone and epoch when known.
+func (t Target) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("address", t.Address())}
+	if t.Pod != "" {
+		attrs = append(attrs, slog.String("pod", t.Pod))
+	}
+	if t.Zone != "" {
+		attrs = append(attrs, slog.String("zone", t.Zone))
+	}
+	if t.Epoch != 0 {
+		attrs = append(attrs, slog.Uint64("epoch", t.Epoch))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// RebalanceRequest asks to move the connection of a recipient from the Old target to the New one.
+// Old is zero when the previous owner is unknown.
+type RebalanceRequest struct {
+	RecipientId string `json:"recipientId"`
+	Old         Target `json:"old"`
+	New         Target `json:"new"`
+}
+
+func (r RebalanceRequest) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("recipientId", r.RecipientId),
+		slog.Any("old", r.Old),
+		slog.Any("new", r.New),
+	)
+}
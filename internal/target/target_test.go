@@ -0,0 +1,55 @@
+package target
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestFromAddress(t *testing.T) {
+	for address, expected := range map[string]Target{
+		"10.0.0.1:3000":  {Host: "10.0.0.1", Port: 3000},
+		"[::1]:3000":     {Host: "::1", Port: 3000},
+		"ws-proxy.local": {Host: "ws-proxy.local"},
+		"":               {},
+	} {
+		if got := FromAddress(address); got != expected {
+			t.Fatalf("FromAddress(%q) = %+v, expected %+v", address, got, expected)
+		}
+	}
+	if address := FromAddress("[::1]:3000").Address(); address != "[::1]:3000" {
+		t.Fatalf("expected the address to round trip, got %s", address)
+	}
+}
+
+func TestURLs(t *testing.T) {
+	plain := Target{Host: "10.0.0.1", Port: 3000}
+	if got := plain.WebSocketURL(""); got != "ws://10.0.0.1:3000" {
+		t.Fatalf("unexpected websocket URL %s", got)
+	}
+	if got := plain.HTTPURL("/message"); got != "http://10.0.0.1:3000/message" {
+		t.Fatalf("unexpected HTTP URL %s", got)
+	}
+	secure := Target{Host: "ws-proxy.local", Scheme: "wss"}
+	if got := secure.WebSocketURL(""); got != "wss://ws-proxy.local" {
+		t.Fatalf("unexpected websocket URL %s", got)
+	}
+	if got := secure.HTTPURL("/message"); got != "https://ws-proxy.local/message" {
+		t.Fatalf("unexpected HTTP URL %s", got)
+	}
+}
+
+func TestFromURL(t *testing.T) {
+	for location, expected := range map[string]Target{
+		"http://10.0.0.1:3000/message": {Host: "10.0.0.1", Port: 3000, Scheme: "ws"},
+		"wss://10.0.0.1:3443":          {Host: "10.0.0.1", Port: 3443, Scheme: "wss"},
+		"https://ws-proxy.local":       {Host: "ws-proxy.local", Scheme: "wss"},
+	} {
+		u, err := url.Parse(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := FromURL(u); got != expected {
+			t.Fatalf("FromURL(%q) = %+v, expected %+v", location, got, expected)
+		}
+	}
+}